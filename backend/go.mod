@@ -6,6 +6,7 @@ require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/jmoiron/sqlx v1.3.5
 	golang.org/x/crypto v0.17.0
+	golang.org/x/image v0.25.0
 )
 
 require github.com/lib/pq v1.10.9
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errResetTokenInvalid = errors.New("reset token is invalid or expired")
+	errWeakPassword      = errors.New("password must be at least 8 characters")
+	errFrontendURLUnset  = errors.New("FRONTEND_URL must be set to mail links")
+)
+
+const minPasswordLength = 8
+
+// ==================== Service Layer ====================
+
+// AccountService implements account recovery flows that need to send mail.
+type AccountService struct {
+	db          *sqlx.DB
+	mailer      utils.Mailer
+	logger      *log.Logger
+	frontendURL string
+}
+
+func NewAccountService(db *sqlx.DB, mailer utils.Mailer, logger *log.Logger) *AccountService {
+	if logger == nil {
+		logger = log.New(os.Stderr, "[account] ", log.LstdFlags)
+	}
+	frontendURL := strings.TrimSuffix(strings.TrimSpace(getEnv("FRONTEND_URL", "")), "/")
+	if frontendURL == "" {
+		logger.Printf("FRONTEND_URL is not set; password reset, verification and login emails will not be sent")
+	}
+	return &AccountService{
+		db:          db,
+		mailer:      mailer,
+		logger:      logger,
+		frontendURL: frontendURL,
+	}
+}
+
+// emailLink builds a link to a frontend page for an email. It only uses the
+// configured FRONTEND_URL, never request headers: a link carrying a token
+// goes to the account's owner, so whoever asked for it must not choose
+// where it points.
+func (s *AccountService) emailLink(path, token string) (string, error) {
+	if s.frontendURL == "" {
+		return "", errFrontendURLUnset
+	}
+	return s.frontendURL + path + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// passwordResetTTL returns how long a reset link stays valid
+// Default: 30 minutes
+// Can be overridden with PASSWORD_RESET_TOKEN_MINUTES environment variable
+func passwordResetTTL() time.Duration {
+	if v := getEnv("PASSWORD_RESET_TOKEN_MINUTES", ""); v != "" {
+		if minutes, err := strconv.Atoi(v); err == nil && minutes > 0 {
+			return time.Duration(minutes) * time.Minute
+		}
+	}
+	return 30 * time.Minute
+}
+
+// passwordMatches reports whether password matches a stored hash. A hash in
+// an unknown format is logged and treated as a mismatch.
+func passwordMatches(password, hash string) bool {
+	ok, _, err := utils.VerifyPassword(password, hash)
+	if err != nil {
+		log.Printf("[AUTH] cannot verify stored password hash: %v", err)
+	}
+	return ok
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errWeakPassword
+	}
+	return nil
+}
+
+// RequestPasswordReset mails a reset link when the email belongs to an account.
+// It reports success either way so callers cannot probe for registered emails.
+func (s *AccountService) RequestPasswordReset(email, requestIP string) error {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return nil
+	}
+
+	var user struct {
+		ID    int    `db:"id"`
+		Name  string `db:"name"`
+		Email string `db:"email"`
+	}
+	err := s.db.Get(&user, `SELECT id, name, email FROM users WHERE email = $1`, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return err
+	}
+	link, err := s.emailLink("/reset-password", token)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the newest link is valid.
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, requested_ip)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+	`, user.ID, utils.HashToken(token), time.Now().Add(passwordResetTTL()), requestIP); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	msg := utils.MailMessage{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password for your account. Open the link below to choose a new one:\n\n%s\n\nThe link expires in %d minutes. If you did not ask for this, you can ignore this email.\n",
+			firstNameFromUserName(user.Name),
+			link,
+			int(passwordResetTTL().Minutes()),
+		),
+	}
+	// Send in the background so response timing does not reveal whether the email exists.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			s.logger.Printf("failed to send password reset email to user_id=%d: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword consumes a reset token, stores the new password and signs
+// the user out everywhere, cancelling pending email changes. It returns the
+// id of that user.
+func (s *AccountService) ResetPassword(token, newPassword string) (int, error) {
+	if err := validatePassword(newPassword); err != nil {
+		return 0, err
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return 0, errResetTokenInvalid
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var row struct {
+		ID     int64 `db:"id"`
+		UserID int   `db:"user_id"`
+	}
+	err = tx.Get(&row, `
+		SELECT id, user_id
+		FROM password_reset_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		FOR UPDATE
+	`, utils.HashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errResetTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password = $1 WHERE id = $2`, hashedPassword, row.UserID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1`, row.ID); err != nil {
+		return 0, err
+	}
+	if _, err := revokeOtherSessions(tx, row.UserID, ""); err != nil {
+		return 0, err
+	}
+	if err := deleteOpenVerificationTokens(tx, row.UserID); err != nil {
+		return 0, err
+	}
+	return row.UserID, tx.Commit()
+}
+
+// ==================== Request/Response Types ====================
+
+type RequestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type AccountActionResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// RequestPasswordResetAction handles the request_password_reset action from Hasura.
+func RequestPasswordResetAction(svc *AccountService) ActionFunc[RequestPasswordResetRequest, AccountActionResponse] {
+	return func(ctx context.Context, s Session, req RequestPasswordResetRequest) (AccountActionResponse, error) {
+		if err := svc.RequestPasswordReset(req.Email, clientIP(s.Request)); err != nil {
+			svc.logger.Printf("password reset request failed: %v", err)
+		}
+
+		return AccountActionResponse{
+			Success: true,
+			Message: "If an account exists for this email, a reset link has been sent",
+		}, nil
+	}
+}
+
+// ResetPasswordAction handles the reset_password action from Hasura.
+func ResetPasswordAction(svc *AccountService) ActionFunc[ResetPasswordRequest, AccountActionResponse] {
+	return func(ctx context.Context, s Session, req ResetPasswordRequest) (AccountActionResponse, error) {
+		userID, err := svc.ResetPassword(req.Token, req.NewPassword)
+		switch {
+		case errors.Is(err, errWeakPassword):
+			return AccountActionResponse{}, newActionError(codeWeakPassword).with("min", strconv.Itoa(minPasswordLength))
+		case errors.Is(err, errResetTokenInvalid):
+			return AccountActionResponse{}, newActionError(codeInvalidResetToken)
+		case err != nil:
+			svc.logger.Printf("password reset failed: %v", err)
+			return AccountActionResponse{}, internalError()
+		}
+
+		logAuditEvent(s.Request, auditEntry{Action: auditPasswordReset, SubjectID: userID})
+		return AccountActionResponse{
+			Success: true,
+			Message: "Password has been reset",
+		}, nil
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"foodrecipes/utils"
+)
+
+// recordingMailer keeps sent messages for the test to read. Some flows send
+// in the background, so messages arrive on a channel.
+type recordingMailer struct {
+	sent chan utils.MailMessage
+}
+
+func newRecordingMailer() *recordingMailer {
+	return &recordingMailer{sent: make(chan utils.MailMessage, 16)}
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg utils.MailMessage) error {
+	m.sent <- msg
+	return nil
+}
+
+// next waits for the next message.
+func (m *recordingMailer) next(t *testing.T) utils.MailMessage {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return utils.MailMessage{}
+	}
+}
+
+// none fails the test if a message arrives within a short wait.
+func (m *recordingMailer) none(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		t.Errorf("unexpected email to %s: %s", msg.To, msg.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// linkToken returns the token of the link in msg, checking the link points
+// at path on the configured frontend.
+func linkToken(t *testing.T, msg utils.MailMessage, path string) string {
+	t.Helper()
+	link, err := url.Parse(linkPattern.FindString(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Scheme+"://"+link.Host != "https://recipes.example.com" || link.Path != path {
+		t.Fatalf("link %s does not point at %s on FRONTEND_URL", link, path)
+	}
+	token := link.Query().Get("token")
+	if token == "" {
+		t.Fatalf("link %s has no token", link)
+	}
+	return token
+}
+
+// testAccountService returns a service that mails links for
+// https://recipes.example.com.
+func testAccountService(t *testing.T) (*AccountService, *recordingMailer) {
+	t.Helper()
+	db := testDB(t)
+	t.Setenv("FRONTEND_URL", "https://recipes.example.com/")
+	mailer := newRecordingMailer()
+	return NewAccountService(db, mailer, nil), mailer
+}
+
+func TestPasswordReset(t *testing.T) {
+	svc, mailer := testAccountService(t)
+	user := createTestUser(t, svc.db, "old password 1")
+	session, _ := signIn(t, user, "phone")
+
+	if err := svc.RequestPasswordReset(strings.ToUpper("nobody-"+user.Email), "203.0.113.7"); err != nil {
+		t.Fatalf("unknown email: %v", err)
+	}
+	mailer.none(t)
+
+	if err := svc.RequestPasswordReset(" "+user.Email+" ", "203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	msg := mailer.next(t)
+	if msg.To != user.Email {
+		t.Errorf("reset mailed to %s, want %s", msg.To, user.Email)
+	}
+	token := linkToken(t, msg, "/reset-password")
+
+	var stored struct {
+		Hash string `db:"token_hash"`
+		IP   string `db:"requested_ip"`
+	}
+	if err := svc.db.Get(&stored, `SELECT token_hash, requested_ip FROM password_reset_tokens WHERE user_id = $1`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hash != utils.HashToken(token) || stored.IP != "203.0.113.7" {
+		t.Errorf("stored token = %+v", stored)
+	}
+
+	if _, err := svc.ResetPassword(token, "short"); !errors.Is(err, errWeakPassword) {
+		t.Fatalf("weak password: err = %v", err)
+	}
+	userID, err := svc.ResetPassword(token, "new password 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != user.ID {
+		t.Errorf("reset user %d, want %d", userID, user.ID)
+	}
+	var hash string
+	if err := svc.db.Get(&hash, `SELECT password FROM users WHERE id = $1`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !passwordMatches("new password 2", hash) || passwordMatches("old password 1", hash) {
+		t.Error("password was not replaced")
+	}
+	if _, _, err := sessionFor(user.ID, session).ActiveUser(); err == nil {
+		t.Error("sessions survived the reset")
+	}
+
+	if _, err := svc.ResetPassword(token, "another password 3"); !errors.Is(err, errResetTokenInvalid) {
+		t.Errorf("reusing the token: err = %v, want errResetTokenInvalid", err)
+	}
+}
+
+func TestPasswordResetTokens(t *testing.T) {
+	svc, mailer := testAccountService(t)
+	user := createTestUser(t, svc.db, "old password 1")
+
+	t.Run("only the newest link works", func(t *testing.T) {
+		if err := svc.RequestPasswordReset(user.Email, ""); err != nil {
+			t.Fatal(err)
+		}
+		first := linkToken(t, mailer.next(t), "/reset-password")
+		if err := svc.RequestPasswordReset(user.Email, ""); err != nil {
+			t.Fatal(err)
+		}
+		second := linkToken(t, mailer.next(t), "/reset-password")
+		if _, err := svc.ResetPassword(first, "new password 2"); !errors.Is(err, errResetTokenInvalid) {
+			t.Errorf("older link: err = %v, want errResetTokenInvalid", err)
+		}
+		if _, err := svc.ResetPassword(second, "new password 2"); err != nil {
+			t.Errorf("newest link: %v", err)
+		}
+	})
+
+	t.Run("expired links do not work", func(t *testing.T) {
+		if err := svc.RequestPasswordReset(user.Email, ""); err != nil {
+			t.Fatal(err)
+		}
+		token := linkToken(t, mailer.next(t), "/reset-password")
+		if _, err := svc.db.Exec(`UPDATE password_reset_tokens SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 second' WHERE token_hash = $1`,
+			utils.HashToken(token)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.ResetPassword(token, "new password 3"); !errors.Is(err, errResetTokenInvalid) {
+			t.Errorf("expired link: err = %v, want errResetTokenInvalid", err)
+		}
+	})
+
+	t.Run("guessed tokens do not work", func(t *testing.T) {
+		for _, token := range []string{"", "  ", "not-a-token"} {
+			if _, err := svc.ResetPassword(token, "new password 4"); !errors.Is(err, errResetTokenInvalid) {
+				t.Errorf("ResetPassword(%q): err = %v, want errResetTokenInvalid", token, err)
+			}
+		}
+	})
+
+	t.Run("no links without FRONTEND_URL", func(t *testing.T) {
+		t.Setenv("FRONTEND_URL", "")
+		bare := NewAccountService(svc.db, mailer, nil)
+		if err := bare.RequestPasswordReset(user.Email, ""); !errors.Is(err, errFrontendURLUnset) {
+			t.Errorf("err = %v, want errFrontendURLUnset", err)
+		}
+		mailer.none(t)
+	})
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// ActionFunc is a typed Hasura action handler. In is decoded from the
+// action input and Out is encoded as the action response.
+type ActionFunc[In, Out any] func(ctx context.Context, s Session, in In) (Out, error)
+
+// Session is the caller of an action, as described by Hasura.
+type Session struct {
+	Variables map[string]interface{}
+	// Request is the call from Hasura. Client headers are only present when
+	// the action forwards them.
+	Request *http.Request
+}
+
+// ActiveUser returns the calling user and session id, refusing tokens whose
+// session was signed out. See requireActiveSession.
+func (s Session) ActiveUser() (userID int, sessionID string, err error) {
+	userID, sessionID, err = requireActiveSession(s.Variables)
+	if errors.Is(err, errSessionRevoked) {
+		return 0, "", newActionError(codeSessionRevoked)
+	}
+	if err != nil {
+		return 0, "", newActionError(codeInvalidSession)
+	}
+	return userID, sessionID, nil
+}
+
+// ActionError is an error reported to Hasura as
+// {"message": ..., "extensions": {"code": ...}}. Its status and message come
+// from errorCatalog; errors of any other type become a logged internal_error.
+type ActionError struct {
+	Code       ErrorCode
+	Status     int
+	Params     map[string]string // fills {name} placeholders in the message
+	RetryAfter int               // seconds, for throttled requests
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message(langEnglish))
+}
+
+// Message renders the catalog message for code in lang.
+func (e *ActionError) Message(lang string) string {
+	msg := lookupError(e.Code).message(lang)
+	for name, value := range e.Params {
+		msg = strings.ReplaceAll(msg, "{"+name+"}", value)
+	}
+	return msg
+}
+
+// with sets a message parameter. It modifies e, so never call it on a
+// shared error value.
+func (e *ActionError) with(name, value string) *ActionError {
+	if e.Params == nil {
+		e.Params = map[string]string{}
+	}
+	e.Params[name] = value
+	return e
+}
+
+func newActionError(code ErrorCode) *ActionError {
+	return &ActionError{Code: code, Status: lookupError(code).Status}
+}
+
+// missingFields reports required input fields that were not given.
+func missingFields(fields ...string) *ActionError {
+	return newActionError(codeInvalidInput).with("fields", strings.Join(fields, ", "))
+}
+
+// internalError hides a failure from the client; log the cause first.
+func internalError() *ActionError {
+	return newActionError(codeInternal)
+}
+
+// ActionRegistry mounts typed actions on a mux.
+type ActionRegistry struct {
+	mux    *http.ServeMux
+	logger *log.Logger
+}
+
+func NewActionRegistry(mux *http.ServeMux, logger *log.Logger) *ActionRegistry {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &ActionRegistry{mux: mux, logger: logger}
+}
+
+// HandleAction registers fn as the action served at path.
+func HandleAction[In, Out any](reg *ActionRegistry, path string, fn ActionFunc[In, Out]) {
+	reg.mux.Handle(path, actionHandler(fn, reg.logger))
+}
+
+// actionHandler adapts an ActionFunc to HTTP: it decodes the envelope,
+// recovers from panics and writes the result or error.
+func actionHandler[In, Out any](fn ActionFunc[In, Out], logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		defer func() {
+			if rec := recover(); rec != nil {
+				logger.Printf("panic in action %s: %v\n%s", r.URL.Path, rec, debug.Stack())
+				writeActionError(w, r, internalError())
+			}
+		}()
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeActionError(w, r, newActionError(codeInvalidBody))
+			return
+		}
+		in, variables, err := decodeActionInput[In](body)
+		if err != nil {
+			writeActionError(w, r, newActionError(codeInvalidBody))
+			return
+		}
+
+		out, err := fn(r.Context(), Session{Variables: variables, Request: r}, in)
+		if err != nil {
+			var actionErr *ActionError
+			if !errors.As(err, &actionErr) {
+				logger.Printf("action %s failed: %v", r.URL.Path, err)
+				actionErr = internalError()
+			}
+			writeActionError(w, r, actionErr)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// decodeActionInput extracts the input and session variables from a Hasura
+// action request. The input may be given directly ({"input": {...}}) or
+// wrapped in a single argument ({"input": {"arg": {...}}}); actions without
+// arguments may omit it.
+func decodeActionInput[T any](body []byte) (T, map[string]interface{}, error) {
+	var zero T
+	var envelope struct {
+		Input            json.RawMessage        `json:"input"`
+		SessionVariables map[string]interface{} `json:"session_variables"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return zero, nil, fmt.Errorf("invalid hasura action payload")
+	}
+	if len(envelope.Input) == 0 || string(envelope.Input) == "null" {
+		return zero, envelope.SessionVariables, nil
+	}
+
+	// Try wrapped format: {"arg": {...}}
+	var argWrapper struct {
+		Arg json.RawMessage `json:"arg"`
+	}
+	if err := json.Unmarshal(envelope.Input, &argWrapper); err == nil && len(argWrapper.Arg) > 0 && string(argWrapper.Arg) != "null" {
+		var fromArg T
+		if err := json.Unmarshal(argWrapper.Arg, &fromArg); err == nil {
+			return fromArg, envelope.SessionVariables, nil
+		}
+	}
+
+	// Try direct format
+	var direct T
+	if err := json.Unmarshal(envelope.Input, &direct); err == nil {
+		return direct, envelope.SessionVariables, nil
+	}
+
+	return zero, nil, fmt.Errorf("invalid hasura action input")
+}
+
+// writeActionError writes e in the language the client asked for.
+func writeActionError(w http.ResponseWriter, r *http.Request, e *ActionError) {
+	w.Header().Set("Content-Type", "application/json")
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(HasuraErrorResponse{
+		Message:    e.Message(requestLanguage(r)),
+		Extensions: &HasuraErrorExtensions{Code: e.Code, RetryAfter: e.RetryAfter},
+	})
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireActionSecret(t *testing.T) {
+	const secret = "action-secret"
+	const body = `{"input":{},"session_variables":{"x-hasura-user-id":"1"}}`
+	now := time.Now().Unix()
+	sign := func(timestamp, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "." + body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	fresh := strconv.FormatInt(now, 10)
+	stale := strconv.FormatInt(now-int64(actionSignatureMaxAge/time.Second)-60, 10)
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  map[string]string
+		body     string
+		wantCode int
+	}{
+		{"secret", "/hasura/login", map[string]string{actionSecretHeader: secret}, body, http.StatusOK},
+		{"wrong secret", "/hasura/login", map[string]string{actionSecretHeader: "nope"}, body, http.StatusUnauthorized},
+		{"no credentials", "/hasura/login", nil, body, http.StatusUnauthorized},
+		{"exempt route", "/hasura/payment/callback", nil, body, http.StatusOK},
+		{"not an action", "/health", nil, body, http.StatusOK},
+		{"path tricks", "/x/../hasura/login", nil, body, http.StatusUnauthorized},
+		{"signature", "/hasura/login", map[string]string{
+			actionTimestampHeader: fresh, actionSignatureHeader: sign(fresh, body)}, body, http.StatusOK},
+		{"signature over another body", "/hasura/login", map[string]string{
+			actionTimestampHeader: fresh, actionSignatureHeader: sign(fresh, body)}, body + " ", http.StatusUnauthorized},
+		{"signature without timestamp", "/hasura/login", map[string]string{
+			actionSignatureHeader: sign("", body)}, body, http.StatusUnauthorized},
+		{"timestamp not signed", "/hasura/login", map[string]string{
+			actionTimestampHeader: fresh, actionSignatureHeader: sign(stale, body)}, body, http.StatusUnauthorized},
+		{"stale signature", "/hasura/login", map[string]string{
+			actionTimestampHeader: stale, actionSignatureHeader: sign(stale, body)}, body, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBody string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				gotBody = string(b)
+			})
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			RequireActionSecret(secret, next).ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode == http.StatusOK && gotBody != tt.body {
+				t.Errorf("handler got body %q, want %q", gotBody, tt.body)
+			}
+		})
+	}
+}
+
+func TestRequireActionSecretBodyLimit(t *testing.T) {
+	t.Setenv("UPLOAD_MAX_REQUEST_BYTES", "1024")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r := httptest.NewRequest(http.MethodPost, "/hasura/upload", strings.NewReader(strings.Repeat("a", int(actionMaxBodyBytes())+1)))
+	r.Header.Set(actionTimestampHeader, ts)
+	r.Header.Set(actionSignatureHeader, "sha256=00")
+	w := httptest.NewRecorder()
+	RequireActionSecret("secret", http.NotFoundHandler()).ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestFreshActionTimestamp(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	tests := []struct {
+		ts   string
+		want bool
+	}{
+		{"1800000000", true},
+		{" 1800000000 ", true},
+		{"1799999700", true},
+		{"1799999699", false},
+		{"1800000300", true},
+		{"1800000301", false},
+		{"", false},
+		{"1.8e9", false},
+	}
+	for _, tt := range tests {
+		if got := freshActionTimestamp(tt.ts, now); got != tt.want {
+			t.Errorf("freshActionTimestamp(%q) = %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeActionInput(t *testing.T) {
+	type input struct {
+		Email string `json:"email"`
+		Count int    `json:"count"`
+	}
+	session := map[string]interface{}{"x-hasura-user-id": "42"}
+
+	tests := []struct {
+		name        string
+		body        string
+		want        input
+		wantSession map[string]interface{}
+		wantErr     bool
+	}{
+		{"direct input", `{"input":{"email":"a@example.com","count":2},"session_variables":{"x-hasura-user-id":"42"}}`,
+			input{"a@example.com", 2}, session, false},
+		{"wrapped in arg", `{"input":{"arg":{"email":"a@example.com","count":2}},"session_variables":{"x-hasura-user-id":"42"}}`,
+			input{"a@example.com", 2}, session, false},
+		{"null arg falls back to direct", `{"input":{"arg":null,"email":"a@example.com"}}`,
+			input{Email: "a@example.com"}, nil, false},
+		{"no input", `{"session_variables":{"x-hasura-user-id":"42"}}`, input{}, session, false},
+		{"null input", `{"input":null}`, input{}, nil, false},
+		{"wrong field type", `{"input":{"count":"two"}}`, input{}, nil, true},
+		{"not json", `email=a@example.com`, input{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotSession, err := decodeActionInput[input]([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("input = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gotSession, tt.wantSession) {
+				t.Errorf("session = %v, want %v", gotSession, tt.wantSession)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Scopes an API key can carry.
+const (
+	ScopeRecipesRead     = "recipes:read"
+	ScopeCategoriesRead  = "categories:read"
+	ScopePurchasesCreate = "purchases:create"
+)
+
+// apiKeyPrefix marks our keys so they are easy to spot in logs and secret scanners.
+const apiKeyPrefix = "frk_"
+
+var (
+	errUnknownScope      = errors.New("unknown scope")
+	errInvalidRateLimit  = errors.New("invalid rate limit")
+	errAPIKeyNotFound    = errors.New("api key not found")
+	errAPIKeyInvalid     = errors.New("api key is invalid or revoked")
+	errAPIKeyRateLimited = errors.New("api key rate limit exceeded")
+)
+
+func isAPIScope(scope string) bool {
+	switch scope {
+	case ScopeRecipesRead, ScopeCategoriesRead, ScopePurchasesCreate:
+		return true
+	}
+	return false
+}
+
+// apiKeyDefaultRateLimit is the requests per minute of a key created without a limit
+// Default: 60
+// Can be overridden with API_KEY_RATE_LIMIT environment variable
+func apiKeyDefaultRateLimit() int {
+	return envInt("API_KEY_RATE_LIMIT", 60)
+}
+
+// apiKeyMaxRateLimit caps the limit an owner can choose
+// Default: 600
+// Can be overridden with API_KEY_MAX_RATE_LIMIT environment variable
+func apiKeyMaxRateLimit() int {
+	return envInt("API_KEY_MAX_RATE_LIMIT", 600)
+}
+
+// APIKey is a partner credential. The secret itself is never stored.
+type APIKey struct {
+	ID                 int64          `db:"id" json:"id"`
+	UserID             int            `db:"user_id" json:"-"`
+	Name               string         `db:"name" json:"name"`
+	KeyPrefix          string         `db:"key_prefix" json:"key_prefix"`
+	Scopes             pq.StringArray `db:"scopes" json:"scopes"`
+	RateLimitPerMinute int            `db:"rate_limit_per_minute" json:"rate_limit_per_minute"`
+	LastUsedAt         *time.Time     `db:"last_used_at" json:"last_used_at"`
+	RevokedAt          *time.Time     `db:"revoked_at" json:"revoked_at"`
+	CreatedAt          time.Time      `db:"created_at" json:"created_at"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ==================== Service Layer ====================
+
+// APIKeyService creates, revokes and authenticates partner API keys.
+type APIKeyService struct {
+	db     *sqlx.DB
+	logger *log.Logger
+}
+
+func NewAPIKeyService(db *sqlx.DB, logger *log.Logger) *APIKeyService {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &APIKeyService{db: db, logger: logger}
+}
+
+// CreateKey stores a new key for the owner and returns it with its secret,
+// which is shown only this once.
+func (s *APIKeyService) CreateKey(userID int, name string, scopes []string, rateLimit int) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "API key"
+	}
+	seen := map[string]bool{}
+	clean := pq.StringArray{}
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !isAPIScope(scope) {
+			return nil, "", errUnknownScope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			clean = append(clean, scope)
+		}
+	}
+	if len(clean) == 0 {
+		return nil, "", errUnknownScope
+	}
+	if rateLimit == 0 {
+		rateLimit = apiKeyDefaultRateLimit()
+	}
+	if rateLimit < 0 || rateLimit > apiKeyMaxRateLimit() {
+		return nil, "", errInvalidRateLimit
+	}
+
+	token, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := apiKeyPrefix + token
+
+	var key APIKey
+	err = s.db.Get(&key, `
+		INSERT INTO api_keys (user_id, name, key_prefix, key_hash, scopes, rate_limit_per_minute)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, user_id, name, key_prefix, scopes, rate_limit_per_minute, last_used_at, revoked_at, created_at
+	`, userID, truncate(name, 100), secret[:len(apiKeyPrefix)+8], utils.HashToken(secret), clean, rateLimit)
+	if err != nil {
+		return nil, "", err
+	}
+	s.logger.Printf("[AUTH] api key created: user_id=%d key_id=%d scopes=%s", userID, key.ID, strings.Join(clean, ","))
+	return &key, secret, nil
+}
+
+// ListKeys returns the owner's keys, newest first.
+func (s *APIKeyService) ListKeys(userID int) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := s.db.Select(&keys, `
+		SELECT id, user_id, name, key_prefix, scopes, rate_limit_per_minute, last_used_at, revoked_at, created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	return keys, err
+}
+
+// RevokeKey disables one of the owner's keys.
+func (s *APIKeyService) RevokeKey(userID int, keyID int64) error {
+	res, err := s.db.Exec(`
+		UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, keyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAPIKeyNotFound
+	}
+	s.logger.Printf("[AUTH] api key revoked: user_id=%d key_id=%d", userID, keyID)
+	return nil
+}
+
+// Authenticate resolves a presented secret and counts the request against the
+// key's per-minute limit. The counter lives in the key row, so every replica
+// enforces the same limit.
+func (s *APIKeyService) Authenticate(ctx context.Context, secret string) (*APIKey, time.Duration, error) {
+	secret = strings.TrimSpace(secret)
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, 0, errAPIKeyInvalid
+	}
+
+	var row struct {
+		APIKey
+		WindowStart    time.Time `db:"window_start"`
+		WindowRequests int       `db:"window_requests"`
+	}
+	err := s.db.GetContext(ctx, &row, `
+		UPDATE api_keys
+		SET window_requests = CASE
+		        WHEN window_start = date_trunc('minute', CURRENT_TIMESTAMP) THEN window_requests + 1
+		        ELSE 1
+		    END,
+		    window_start = date_trunc('minute', CURRENT_TIMESTAMP),
+		    last_used_at = CURRENT_TIMESTAMP
+		WHERE key_hash = $1 AND revoked_at IS NULL
+		RETURNING id, user_id, name, key_prefix, scopes, rate_limit_per_minute, last_used_at, revoked_at, created_at,
+		          window_start, window_requests
+	`, utils.HashToken(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if row.WindowRequests > row.RateLimitPerMinute {
+		return &row.APIKey, time.Until(row.WindowStart.Add(time.Minute)), errAPIKeyRateLimited
+	}
+	return &row.APIKey, 0, nil
+}
+
+// ==================== Middleware ====================
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the key that authenticated the request.
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// RequireAPIKey authenticates the X-API-Key header (or an "ApiKey" bearer
+// scheme), enforces the key's rate limit and checks that it carries scope.
+func (s *APIKeyService) RequireAPIKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return withRecovery(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		secret := r.Header.Get("X-API-Key")
+		if secret == "" {
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "ApiKey ") {
+				secret = strings.TrimPrefix(auth, "ApiKey ")
+			}
+		}
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", `ApiKey realm="api"`)
+			writeActionError(w, r, newActionError(codeAPIKeyRequired))
+			return
+		}
+
+		key, retryAfter, err := s.Authenticate(r.Context(), secret)
+		switch {
+		case errors.Is(err, errAPIKeyInvalid):
+			writeActionError(w, r, newActionError(codeInvalidAPIKey))
+			return
+		case errors.Is(err, errAPIKeyRateLimited):
+			limited := newActionError(codeRateLimited)
+			limited.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+			writeActionError(w, r, limited)
+			return
+		case err != nil:
+			s.logger.Printf("[AUTH] api key lookup failed: %v", err)
+			writeActionError(w, r, internalError())
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(key.RateLimitPerMinute))
+
+		if !key.HasScope(scope) {
+			writeActionError(w, r, newActionError(codeInsufficientScope).with("scope", scope))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}, s.logger)
+}
+
+// ==================== Request/Response Types ====================
+
+type CreateAPIKeyRequest struct {
+	Name               string   `json:"name"`
+	Scopes             []string `json:"scopes"`
+	RateLimitPerMinute int      `json:"rate_limit_per_minute"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"` // shown once
+}
+
+type RevokeAPIKeyRequest struct {
+	ID int64 `json:"id"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// CreateAPIKeyAction handles the create_api_key action from Hasura.
+func CreateAPIKeyAction(svc *APIKeyService) ActionFunc[CreateAPIKeyRequest, CreateAPIKeyResponse] {
+	return func(ctx context.Context, s Session, req CreateAPIKeyRequest) (CreateAPIKeyResponse, error) {
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return CreateAPIKeyResponse{}, err
+		}
+
+		key, secret, err := svc.CreateKey(userID, req.Name, req.Scopes, req.RateLimitPerMinute)
+		switch {
+		case errors.Is(err, errUnknownScope):
+			return CreateAPIKeyResponse{}, newActionError(codeInvalidScope).with("scopes", strings.Join([]string{ScopeRecipesRead, ScopeCategoriesRead, ScopePurchasesCreate}, ", "))
+		case errors.Is(err, errInvalidRateLimit):
+			return CreateAPIKeyResponse{}, newActionError(codeInvalidRateLimit).with("max", strconv.Itoa(apiKeyMaxRateLimit()))
+		case err != nil:
+			svc.logger.Printf("[AUTH] api key creation failed: %v", err)
+			return CreateAPIKeyResponse{}, internalError()
+		}
+
+		logAuditEvent(s.Request, auditEntry{Action: auditAPIKeyCreated, ActorID: userID, Metadata: auditMetadata{
+			"key_id": key.ID,
+			"scopes": key.Scopes,
+		}})
+		return CreateAPIKeyResponse{APIKey: *key, Key: secret}, nil
+	}
+}
+
+// ListAPIKeysAction handles the api_keys action from Hasura.
+func ListAPIKeysAction(svc *APIKeyService) ActionFunc[struct{}, []APIKey] {
+	return func(ctx context.Context, s Session, _ struct{}) ([]APIKey, error) {
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := svc.ListKeys(userID)
+		if err != nil {
+			svc.logger.Printf("[AUTH] listing api keys failed: %v", err)
+			return nil, internalError()
+		}
+		return keys, nil
+	}
+}
+
+// RevokeAPIKeyAction handles the revoke_api_key action from Hasura.
+func RevokeAPIKeyAction(svc *APIKeyService) ActionFunc[RevokeAPIKeyRequest, AccountActionResponse] {
+	return func(ctx context.Context, s Session, req RevokeAPIKeyRequest) (AccountActionResponse, error) {
+		if req.ID <= 0 {
+			return AccountActionResponse{}, missingFields("id")
+		}
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return AccountActionResponse{}, err
+		}
+
+		err = svc.RevokeKey(userID, req.ID)
+		switch {
+		case errors.Is(err, errAPIKeyNotFound):
+			return AccountActionResponse{}, newActionError(codeAPIKeyNotFound)
+		case err != nil:
+			svc.logger.Printf("[AUTH] api key revoke failed: %v", err)
+			return AccountActionResponse{}, internalError()
+		}
+
+		logAuditEvent(s.Request, auditEntry{Action: auditAPIKeyRevoked, ActorID: userID, Metadata: auditMetadata{"key_id": req.ID}})
+		return AccountActionResponse{
+			Success: true,
+			Message: "API key revoked",
+		}, nil
+	}
+}
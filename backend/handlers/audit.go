@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Audit actions. Related actions share a prefix so the admin query can ask
+// for e.g. every "login" event.
+const (
+	auditLoginSucceeded         = "login.succeeded"
+	auditLoginFailed            = "login.failed"
+	auditLoginThrottled         = "login.throttled"
+	auditAccountCreated         = "account.created"
+	auditExportRequested        = "account.export_requested"
+	auditDeletionRequested      = "account.deletion_requested"
+	auditPasswordChanged        = "password.changed"
+	auditPasswordReset          = "password.reset"
+	auditEmailChangeRequested   = "email.change_requested"
+	auditEmailChanged           = "email.changed"
+	auditTwoFactorEnabled       = "2fa.enabled"
+	auditTwoFactorDisabled      = "2fa.disabled"
+	auditSessionRevoked         = "session.revoked"
+	auditRoleGranted            = "role.granted"
+	auditRoleRevoked            = "role.revoked"
+	auditAPIKeyCreated          = "api_key.created"
+	auditAPIKeyRevoked          = "api_key.revoked"
+	auditUploadCreated          = "upload.created"
+	auditPaymentInitialized     = "payment.initialized"
+	auditPaymentVerified        = "payment.verified"
+	auditPaymentWebhook         = "payment.webhook"
+	auditPaymentWebhookRejected = "payment.webhook_rejected"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 500
+)
+
+// auditMetadata holds action-specific details. Never put passwords, tokens
+// or full email addresses in it; use maskEmail.
+type auditMetadata map[string]interface{}
+
+// auditEntry is an event to record. Zero user ids are stored as NULL.
+type auditEntry struct {
+	Action    string
+	ActorID   int // who did it
+	SubjectID int // whose account it affected, when that is someone else or the actor is unknown
+	Metadata  auditMetadata
+}
+
+// AuditEvent is a stored audit log row.
+type AuditEvent struct {
+	ID            int64           `db:"id" json:"id"`
+	ActorUserID   *int            `db:"actor_user_id" json:"actor_user_id"`
+	SubjectUserID *int            `db:"subject_user_id" json:"subject_user_id"`
+	Action        string          `db:"action" json:"action"`
+	IPAddress     string          `db:"ip_address" json:"ip_address"`
+	UserAgent     string          `db:"user_agent" json:"user_agent"`
+	Metadata      json.RawMessage `db:"metadata" json:"metadata"`
+	CreatedAt     time.Time       `db:"created_at" json:"created_at"`
+}
+
+// recordAuditEvent writes an audit event with q, so it can join the
+// caller's transaction. r supplies the client IP and user agent; it is nil
+// for events without a request.
+func recordAuditEvent(q sqlx.Execer, r *http.Request, e auditEntry) error {
+	var ip, userAgent string
+	if r != nil {
+		ip = truncate(clientIP(r), 64)
+		userAgent = truncate(r.UserAgent(), 512)
+	}
+	metadata := []byte("{}")
+	if len(e.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(e.Metadata); err != nil {
+			return err
+		}
+	}
+	_, err := q.Exec(`
+		INSERT INTO audit_events (actor_user_id, subject_user_id, action, ip_address, user_agent, metadata)
+		VALUES (NULLIF($1, 0), NULLIF($2, 0), $3, NULLIF($4, ''), NULLIF($5, ''), $6)
+	`, e.ActorID, e.SubjectID, e.Action, ip, userAgent, string(metadata))
+	return err
+}
+
+// logAuditEvent records an event outside of any transaction. A failed write
+// is logged but does not fail the request that caused it.
+func logAuditEvent(r *http.Request, e auditEntry) {
+	if err := recordAuditEvent(DB, r, e); err != nil {
+		log.Printf("[AUDIT] could not record %s: %v", e.Action, err)
+	}
+}
+
+// auditPersonalDataRetention returns how long an event keeps its IP address,
+// user agent and masked emails before they are scrubbed (see V28)
+// Default: 90 days
+// Can be overridden with AUDIT_PERSONAL_DATA_RETENTION_DAYS environment variable
+func auditPersonalDataRetention() time.Duration {
+	return time.Duration(envInt("AUDIT_PERSONAL_DATA_RETENTION_DAYS", 90)) * 24 * time.Hour
+}
+
+// AuditRetention scrubs personal details from audit events once they are
+// older than the retention period. The events themselves are kept.
+type AuditRetention struct {
+	db        *sqlx.DB
+	logger    *log.Logger
+	retention time.Duration
+}
+
+func NewAuditRetention(db *sqlx.DB, logger *log.Logger) *AuditRetention {
+	if logger == nil {
+		logger = log.New(os.Stderr, "[audit] ", log.LstdFlags)
+	}
+	return &AuditRetention{db: db, logger: logger, retention: auditPersonalDataRetention()}
+}
+
+// Run scrubs hourly until ctx is cancelled.
+func (a *AuditRetention) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		var scrubbed int
+		err := a.db.GetContext(ctx, &scrubbed, `SELECT scrub_audit_events_before($1)`, time.Now().Add(-a.retention))
+		if err != nil {
+			a.logger.Printf("scrubbing audit events failed: %v", err)
+		} else if scrubbed > 0 {
+			a.logger.Printf("scrubbed personal data from %d audit events", scrubbed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queryAuditEvents returns events newest first. userID matches the actor or
+// the subject; action matches exactly or as a dotted prefix ("login" finds
+// "login.failed"). beforeID pages through older events.
+func queryAuditEvents(q sqlx.Queryer, userID int, action string, since, until *time.Time, beforeID int64, limit int) ([]AuditEvent, error) {
+	// Escape LIKE wildcards; action names contain underscores.
+	prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(action) + ".%"
+	events := []AuditEvent{}
+	err := sqlx.Select(q, &events, `
+		SELECT id, actor_user_id, subject_user_id, action,
+		       COALESCE(ip_address, '') AS ip_address, COALESCE(user_agent, '') AS user_agent,
+		       metadata, created_at
+		FROM audit_events
+		WHERE ($1 = 0 OR actor_user_id = $1 OR subject_user_id = $1)
+		  AND ($2 = '' OR action = $2 OR action LIKE $3)
+		  AND ($4::TIMESTAMPTZ IS NULL OR created_at >= $4)
+		  AND ($5::TIMESTAMPTZ IS NULL OR created_at < $5)
+		  AND ($6::BIGINT = 0 OR id < $6)
+		ORDER BY id DESC
+		LIMIT $7
+	`, userID, action, prefix, since, until, beforeID, limit)
+	return events, err
+}
+
+// ==================== Request/Response Types ====================
+
+type AuditEventsRequest struct {
+	UserID   int        `json:"user_id"`
+	Action   string     `json:"action"`
+	Since    *time.Time `json:"since"`
+	Until    *time.Time `json:"until"`
+	BeforeID int64      `json:"before_id"`
+	Limit    int        `json:"limit"`
+}
+
+type AuditEventsResponse struct {
+	Events []AuditEvent `json:"events"`
+	// NextBeforeID is passed as before_id to load the next page; 0 when there is none.
+	NextBeforeID int64 `json:"next_before_id"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// AuditEventsAction handles the admin-only audit_events action from Hasura.
+func AuditEventsAction(ctx context.Context, s Session, req AuditEventsRequest) (AuditEventsResponse, error) {
+	if _, err := requireAdmin(s); err != nil {
+		return AuditEventsResponse{}, err
+	}
+
+	if req.Limit <= 0 {
+		req.Limit = defaultAuditPageSize
+	}
+	if req.Limit > maxAuditPageSize {
+		req.Limit = maxAuditPageSize
+	}
+	if req.Since != nil && req.Until != nil && !req.Until.After(*req.Since) {
+		return AuditEventsResponse{}, newActionError(codeInvalidTimeRange)
+	}
+
+	events, err := queryAuditEvents(DB, req.UserID, strings.TrimSpace(req.Action), req.Since, req.Until, req.BeforeID, req.Limit)
+	if err != nil {
+		log.Printf("[AUDIT] query failed: %v", err)
+		return AuditEventsResponse{}, internalError()
+	}
+	resp := AuditEventsResponse{Events: events}
+	if len(events) == req.Limit {
+		resp.NextBeforeID = events[len(events)-1].ID
+	}
+	return resp, nil
+}
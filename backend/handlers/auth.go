@@ -1,16 +1,15 @@
 package handlers
 
 import (
-	"encoding/json"
-	"io"
+	"context"
+	"fmt"
 	"log"
-	"net/http"
+	"math"
 
 	"foodrecipes/models"
 	"foodrecipes/utils"
 
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // ...existing code...
@@ -22,18 +21,33 @@ func SetDB(db *sqlx.DB) {
 	DB = db
 }
 
+// Blobs is where uploaded files are stored.
+var Blobs utils.BlobStore
+
+// SetBlobStore sets the storage backend for the handlers package.
+func SetBlobStore(store utils.BlobStore) {
+	Blobs = store
+}
+
 // Request/response structs for the Hasura actions
 
 type HasuraLoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	DeviceLabel string `json:"device_label"`
 }
 
 type HasuraLoginResponse struct {
-	Token  string `json:"token"`
-	UserID int    `json:"user_id"`
-	Name   string `json:"name"`
-	Email  string `json:"email"`
+	Token         string `json:"token"`
+	RefreshToken  string `json:"refresh_token"`
+	ExpiresIn     int    `json:"expires_in"` // access token (or challenge) lifetime in seconds
+	UserID        int    `json:"user_id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	// Set instead of Token when the account has 2FA; pass ChallengeToken to verify_2fa.
+	RequiresTwoFactor bool   `json:"requires_2fa"`
+	ChallengeToken    string `json:"challenge_token,omitempty"`
 }
 
 type HasuraSignupRequest struct {
@@ -43,184 +57,167 @@ type HasuraSignupRequest struct {
 }
 
 type HasuraSignupResponse struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
 }
 
+// HasuraErrorResponse is the error body Hasura passes on to the client.
 type HasuraErrorResponse struct {
-	Message string `json:"message"`
-	Code    string `json:"code,omitempty"`
+	Message    string                 `json:"message"`
+	Extensions *HasuraErrorExtensions `json:"extensions,omitempty"`
 }
 
-// HasuraLoginHandler handles the login action from Hasura
-func HasuraLoginHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+type HasuraErrorExtensions struct {
+	Code       ErrorCode `json:"code,omitempty"`
+	RetryAfter int       `json:"retry_after,omitempty"` // seconds, for throttled requests
+}
 
-	// Read the whole body
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Invalid request body"})
-		return
+// limitError reports a throttled login. Lockouts use their own code so
+// clients can tell them apart from a wrong password.
+func limitError(decision LimitDecision) *ActionError {
+	code := codeTooManyAttempts
+	if decision.Locked {
+		code = codeLoginLocked
 	}
+	e := newActionError(code)
+	e.RetryAfter = int(math.Ceil(decision.RetryAfter.Seconds()))
+	return e
+}
 
-	var req HasuraLoginRequest
-	parsed := false
+var errInvalidCredentials = newActionError(codeInvalidCredentials)
+
+// LoginAction handles the login action from Hasura
+func LoginAction(throttle *LoginThrottle) ActionFunc[HasuraLoginRequest, *HasuraLoginResponse] {
+	return func(ctx context.Context, s Session, req HasuraLoginRequest) (*HasuraLoginResponse, error) {
+		r := s.Request
+
+		// Refuse the attempt while the email or client IP is throttled
+		ip := clientIP(r)
+		attempt, err := throttle.Begin(ctx, req.Email, ip)
+		if err != nil {
+			log.Printf("[AUTH] login limiter unavailable: %v", err)
+		} else if !attempt.Allowed {
+			logAuditEvent(r, auditEntry{Action: auditLoginThrottled, Metadata: auditMetadata{"method": "password", "email": maskEmail(req.Email)}})
+			return nil, limitError(attempt.LimitDecision)
+		}
 
-	// Try to parse as Hasura action payload (input wrapper)
-	var wrapper struct {
-		Input json.RawMessage `json:"input"`
-	}
-	if err := json.Unmarshal(bodyBytes, &wrapper); err == nil && len(wrapper.Input) > 0 {
-		// First try input.arg format
-		var argWrapper struct {
-			Arg HasuraLoginRequest `json:"arg"`
+		// Fetch user from DB
+		var user models.User
+		err = DB.Get(&user, "SELECT id, name, email, password, COALESCE(avatar_url, '') as avatar_url, email_verified_at FROM users WHERE email=$1", req.Email)
+		if err != nil {
+			// As slow as checking a real password, so the response time
+			// does not tell which emails are registered
+			utils.VerifyDummyPassword(req.Password)
+			throttle.Failure(attempt)
+			logAuditEvent(r, auditEntry{Action: auditLoginFailed, Metadata: auditMetadata{"method": "password", "reason": "unknown_email", "email": maskEmail(req.Email)}})
+			return nil, errInvalidCredentials
 		}
-		if err := json.Unmarshal(wrapper.Input, &argWrapper); err == nil {
-			if argWrapper.Arg.Email != "" || argWrapper.Arg.Password != "" {
-				req = argWrapper.Arg
-				parsed = true
-			}
+
+		// Compare password
+		ok, needsRehash, err := utils.VerifyPassword(req.Password, user.Password)
+		if err != nil {
+			log.Printf("[AUTH] cannot verify password hash of user_id=%d: %v", user.ID, err)
 		}
-		// Then try input direct format
-		if !parsed {
-			if err := json.Unmarshal(wrapper.Input, &req); err == nil {
-				parsed = true
-			}
+		if !ok {
+			throttle.Failure(attempt)
+			logAuditEvent(r, auditEntry{Action: auditLoginFailed, SubjectID: user.ID, Metadata: auditMetadata{"method": "password", "reason": "wrong_password"}})
+			return nil, errInvalidCredentials
 		}
-	}
 
-	// Fallback: try plain JSON (for testing)
-	if !parsed {
-		if err := json.Unmarshal(bodyBytes, &req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Invalid request format"})
-			return
+		// Upgrade bcrypt or outdated Argon2id hashes while we have the password
+		if needsRehash {
+			upgradePasswordHash(user.ID, user.Password, req.Password)
 		}
-	}
 
-	// Fetch user from DB
-	var user models.User
-	err = DB.Get(&user, "SELECT id, name, email, password, COALESCE(avatar_url, '') as avatar_url FROM users WHERE email=$1", req.Email)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Invalid email or password", Code: "invalid_credentials"})
-		return
-	}
+		throttle.Success(ctx, attempt)
 
-	// Compare password
-	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Invalid email or password", Code: "invalid_credentials"})
-		return
-	}
+		// Accounts with 2FA get a challenge; the session is issued by verify_2fa
+		hasTwoFactor, err := twoFactorEnabled(DB, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("check 2fa: %w", err)
+		}
+		if hasTwoFactor {
+			challenge, err := issueTwoFactorChallenge(user, req.DeviceLabel)
+			if err != nil {
+				return nil, fmt.Errorf("issue 2fa challenge: %w", err)
+			}
+			return challenge, nil
+		}
 
-	// Generate JWT with Hasura claims
-	token, err := utils.GenerateJWT(user.ID, user.Email, user.Name)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Could not generate token"})
-		return
-	}
+		// Generate JWT with Hasura claims and a refresh token
+		resp, err := issueLoginTokens(user, newSessionMetadata(r, req.DeviceLabel))
+		if err != nil {
+			return nil, fmt.Errorf("issue login tokens: %w", err)
+		}
 
-	// Return success
-	json.NewEncoder(w).Encode(HasuraLoginResponse{
-		Token:  token,
-		UserID: user.ID,
-		Name:   user.Name,
-		Email:  user.Email,
-	})
+		logAuditEvent(r, auditEntry{Action: auditLoginSucceeded, ActorID: user.ID, Metadata: auditMetadata{"method": "password"}})
+		return resp, nil
+	}
 }
 
-// HasuraSignupHandler handles the signup action from Hasura
-func HasuraSignupHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	bodyBytes, err := io.ReadAll(r.Body)
+// upgradePasswordHash re-hashes a password with the current settings. The
+// update only applies if the stored hash is still the one that was verified,
+// so it cannot overwrite a concurrent password change.
+func upgradePasswordHash(userID int, oldHash, password string) {
+	newHash, err := utils.HashPassword(password)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Invalid request body"})
+		log.Printf("[AUTH] password rehash failed for user_id=%d: %v", userID, err)
 		return
 	}
+	if _, err := DB.Exec(`UPDATE users SET password = $1 WHERE id = $2 AND password = $3`, newHash, userID, oldHash); err != nil {
+		log.Printf("[AUTH] saving upgraded password hash failed for user_id=%d: %v", userID, err)
+	}
+}
 
-	var req HasuraSignupRequest
-	parsed := false
+// SignupAction handles the signup action from Hasura
+func SignupAction(accounts *AccountService) ActionFunc[HasuraSignupRequest, HasuraSignupResponse] {
+	return func(ctx context.Context, s Session, req HasuraSignupRequest) (HasuraSignupResponse, error) {
+		var resp HasuraSignupResponse
 
-	// Try to parse as Hasura action payload (input wrapper)
-	var wrapper struct {
-		Input json.RawMessage `json:"input"`
-	}
-	if err := json.Unmarshal(bodyBytes, &wrapper); err == nil && len(wrapper.Input) > 0 {
-		// First try input.arg format
-		var argWrapper struct {
-			Arg HasuraSignupRequest `json:"arg"`
+		// Check if email already exists
+		var count int
+		err := DB.Get(&count, "SELECT COUNT(*) FROM users WHERE email=$1", req.Email)
+		if err != nil {
+			return resp, fmt.Errorf("check existing email: %w", err)
 		}
-		if err := json.Unmarshal(wrapper.Input, &argWrapper); err == nil {
-			if argWrapper.Arg.Email != "" || argWrapper.Arg.Password != "" || argWrapper.Arg.Name != "" {
-				req = argWrapper.Arg
-				parsed = true
-			}
-		}
-		// Then try input direct format
-		if !parsed {
-			if err := json.Unmarshal(wrapper.Input, &req); err == nil {
-				parsed = true
-			}
+		if count > 0 {
+			return resp, newActionError(codeEmailExists)
 		}
-	}
 
-	// Fallback: plain JSON
-	if !parsed {
-		if err := json.Unmarshal(bodyBytes, &req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Invalid request format"})
-			return
+		// Hash password
+		hashedPassword, err := utils.HashPassword(req.Password)
+		if err != nil {
+			return resp, fmt.Errorf("hash password: %w", err)
 		}
-	}
 
-	// Debug: log received values
-	log.Printf("Signup request: name=%q, email=%q", req.Name, req.Email)
+		// Insert user
+		var user models.User
+		err = DB.Get(&user, `
+			INSERT INTO users (name, email, password)
+			VALUES ($1, $2, $3)
+			RETURNING id, name, email
+		`, req.Name, req.Email, hashedPassword)
+		if err != nil {
+			return resp, fmt.Errorf("create user: %w", err)
+		}
 
-	// Check if email already exists
-	var count int
-	err = DB.Get(&count, "SELECT COUNT(*) FROM users WHERE email=$1", req.Email)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Database error"})
-		return
-	}
-	if count > 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Email already registered", Code: "email_exists"})
-		return
-	}
+		log.Printf("[AUTH] signup: user_id=%d", user.ID)
+		logAuditEvent(s.Request, auditEntry{Action: auditAccountCreated, ActorID: user.ID, Metadata: auditMetadata{"method": "password"}})
 
-	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Could not hash password"})
-		return
-	}
+		// Send the verification link; the account works without it until a
+		// verified-email rule applies.
+		if err := accounts.SendVerificationEmail(user.ID, user.Name, user.Email); err != nil {
+			log.Printf("Could not send verification email to user %d: %v", user.ID, err)
+		}
 
-	// Insert user
-	var user models.User
-	err = DB.Get(&user, `
-		INSERT INTO users (name, email, password)
-		VALUES ($1, $2, $3)
-		RETURNING id, name, email
-	`, req.Name, req.Email, string(hashedPassword))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(HasuraErrorResponse{Message: "Could not create user"})
-		return
+		// Return the new user
+		return HasuraSignupResponse{
+			ID:            user.ID,
+			Name:          user.Name,
+			Email:         user.Email,
+			EmailVerified: false,
+		}, nil
 	}
-
-	// Return the new user
-	json.NewEncoder(w).Encode(HasuraSignupResponse{
-		ID:    user.ID,
-		Name:  user.Name,
-		Email: user.Email,
-	})
-}
\ No newline at end of file
+}
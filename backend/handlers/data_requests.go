@@ -0,0 +1,669 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds and states of a data_requests row.
+const (
+	DataRequestExport   = "export"
+	DataRequestDeletion = "deletion"
+
+	dataRequestPending   = "pending"
+	dataRequestRunning   = "running"
+	dataRequestCompleted = "completed"
+	dataRequestFailed    = "failed"
+)
+
+const (
+	// dataExportDownloadPurpose is the audience of the signed download links.
+	dataExportDownloadPurpose = "data-export-download"
+	dataExportDownloadTTL     = 15 * time.Minute
+	dataRequestMaxAttempts    = 3
+	// A running request older than this is assumed to belong to a crashed worker.
+	dataRequestStaleAfter = 30 * time.Minute
+)
+
+var (
+	errDataRequestOpen = errors.New("a request of this kind is already in progress")
+	errInvalidPassword = errors.New("password is incorrect")
+)
+
+// dataExportDir returns where export archives are written
+// Default: ./data-exports
+// Can be overridden with DATA_EXPORT_DIR environment variable
+func dataExportDir() string {
+	return getEnv("DATA_EXPORT_DIR", "./data-exports")
+}
+
+// dataExportRetention returns how long a finished archive can be downloaded
+// Default: 7 days
+// Can be overridden with DATA_EXPORT_RETENTION_HOURS environment variable
+func dataExportRetention() time.Duration {
+	return time.Duration(envInt("DATA_EXPORT_RETENTION_HOURS", 7*24)) * time.Hour
+}
+
+// DataRequest is the status of an export or deletion request.
+type DataRequest struct {
+	ID          int64      `db:"id" json:"id"`
+	UserID      *int       `db:"user_id" json:"-"`
+	Kind        string     `db:"kind" json:"kind"`
+	Status      string     `db:"status" json:"status"`
+	Attempts    int        `db:"attempts" json:"-"`
+	ArchivePath *string    `db:"archive_path" json:"-"`
+	LastError   *string    `db:"last_error" json:"-"`
+	RequestedAt time.Time  `db:"requested_at" json:"requested_at"`
+	StartedAt   *time.Time `db:"started_at" json:"started_at"`
+	CompletedAt *time.Time `db:"completed_at" json:"completed_at"`
+	ExpiresAt   *time.Time `db:"expires_at" json:"expires_at"`
+	DownloadURL string     `db:"-" json:"download_url,omitempty"`
+}
+
+const dataRequestColumns = `id, user_id, kind, status, attempts, archive_path, last_error,
+	requested_at, started_at, completed_at, expires_at`
+
+// ==================== Service Layer ====================
+
+// DataRequestService queues personal data exports and account deletions and
+// processes them in the background.
+type DataRequestService struct {
+	db           *sqlx.DB
+	mailer       utils.Mailer
+	logger       *log.Logger
+	exportDir    string
+	pollInterval time.Duration
+}
+
+func NewDataRequestService(db *sqlx.DB, mailer utils.Mailer, logger *log.Logger) *DataRequestService {
+	if logger == nil {
+		logger = log.New(os.Stderr, "[data-requests] ", log.LstdFlags)
+	}
+	return &DataRequestService{
+		db:           db,
+		mailer:       mailer,
+		logger:       logger,
+		exportDir:    dataExportDir(),
+		pollInterval: 10 * time.Second,
+	}
+}
+
+// RequestExport queues an archive of everything stored about the user.
+func (s *DataRequestService) RequestExport(userID int) (*DataRequest, error) {
+	return s.enqueue(userID, DataRequestExport)
+}
+
+// RequestDeletion queues the deletion of the account after re-checking the
+// password, so a stolen session alone cannot delete it.
+func (s *DataRequestService) RequestDeletion(userID int, password string) (*DataRequest, error) {
+	var hash string
+	if err := s.db.Get(&hash, `SELECT password FROM users WHERE id = $1`, userID); err != nil {
+		return nil, err
+	}
+	if !passwordMatches(password, hash) {
+		return nil, errInvalidPassword
+	}
+
+	// The last admin has to hand over the role first.
+	isAdmin, err := hasRole(s.db, userID, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if isAdmin {
+		var others int
+		if err := s.db.Get(&others, `SELECT COUNT(*) FROM user_roles WHERE role = $1 AND user_id <> $2`, RoleAdmin, userID); err != nil {
+			return nil, err
+		}
+		if others == 0 {
+			return nil, errLastAdmin
+		}
+	}
+	return s.enqueue(userID, DataRequestDeletion)
+}
+
+func (s *DataRequestService) enqueue(userID int, kind string) (*DataRequest, error) {
+	var req DataRequest
+	err := s.db.Get(&req, `
+		INSERT INTO data_requests (user_id, kind) VALUES ($1, $2)
+		ON CONFLICT (user_id, kind) WHERE status IN ('pending', 'running') DO NOTHING
+		RETURNING `+dataRequestColumns, userID, kind)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errDataRequestOpen
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Printf("%s request queued: request_id=%d user_id=%d", kind, req.ID, userID)
+	return &req, nil
+}
+
+// ListRequests returns the user's requests, newest first, with download links
+// for archives that are still available.
+func (s *DataRequestService) ListRequests(userID int, urlBuilder *URLBuilder) ([]DataRequest, error) {
+	requests := []DataRequest{}
+	err := s.db.Select(&requests, `
+		SELECT `+dataRequestColumns+`
+		FROM data_requests
+		WHERE user_id = $1
+		ORDER BY requested_at DESC
+		LIMIT 20
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range requests {
+		req := &requests[i]
+		if req.Kind != DataRequestExport || req.Status != dataRequestCompleted || req.ArchivePath == nil {
+			continue
+		}
+		if req.ExpiresAt != nil && time.Now().After(*req.ExpiresAt) {
+			continue
+		}
+		token, err := utils.GenerateChallengeToken(userID, dataExportDownloadPurpose, dataExportDownloadTTL, map[string]interface{}{
+			"request_id": req.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		req.DownloadURL = urlBuilder.APIURL("/data-exports/download", url.Values{"token": {token}})
+	}
+	return requests, nil
+}
+
+// Run processes queued requests until ctx is cancelled. Several replicas can
+// run it at once; each request is claimed with FOR UPDATE SKIP LOCKED.
+func (s *DataRequestService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			processed, err := s.processNext(ctx)
+			if err != nil {
+				s.logger.Printf("processing data request failed: %v", err)
+			}
+			if !processed {
+				break
+			}
+		}
+		if err := s.purgeExpiredArchives(); err != nil {
+			s.logger.Printf("purging expired archives failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNext claims and runs one request. It reports whether a request was found.
+func (s *DataRequestService) processNext(ctx context.Context) (bool, error) {
+	var req DataRequest
+	err := s.db.GetContext(ctx, &req, `
+		UPDATE data_requests
+		SET status = 'running', started_at = CURRENT_TIMESTAMP, attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM data_requests
+			WHERE status = 'pending'
+			   OR (status = 'running' AND started_at < CURRENT_TIMESTAMP - make_interval(secs => $1))
+			ORDER BY requested_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+dataRequestColumns, dataRequestStaleAfter.Seconds())
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if req.UserID == nil {
+		// The account is already gone; nothing left to export or delete.
+		return true, s.finish(req.ID, nil, nil)
+	}
+
+	switch req.Kind {
+	case DataRequestExport:
+		err = s.runExport(ctx, &req)
+	case DataRequestDeletion:
+		err = s.runDeletion(ctx, &req)
+	default:
+		err = fmt.Errorf("unknown request kind %q", req.Kind)
+	}
+	if err == nil {
+		return true, nil
+	}
+
+	s.logger.Printf("%s request failed: request_id=%d attempt=%d: %v", req.Kind, req.ID, req.Attempts, err)
+	status := dataRequestPending
+	if req.Attempts >= dataRequestMaxAttempts {
+		status = dataRequestFailed
+	}
+	_, updateErr := s.db.Exec(`
+		UPDATE data_requests SET status = $2, last_error = $3 WHERE id = $1
+	`, req.ID, status, truncate(err.Error(), 1000))
+	return true, updateErr
+}
+
+func (s *DataRequestService) finish(id int64, archivePath *string, expiresAt *time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE data_requests
+		SET status = 'completed', completed_at = CURRENT_TIMESTAMP, archive_path = $2, expires_at = $3, last_error = NULL
+		WHERE id = $1
+	`, id, archivePath, expiresAt)
+	return err
+}
+
+// purgeExpiredArchives deletes archive files whose download window has passed.
+func (s *DataRequestService) purgeExpiredArchives() error {
+	var expired []DataRequest
+	err := s.db.Select(&expired, `
+		SELECT `+dataRequestColumns+`
+		FROM data_requests
+		WHERE archive_path IS NOT NULL AND expires_at < CURRENT_TIMESTAMP
+	`)
+	if err != nil {
+		return err
+	}
+	for _, req := range expired {
+		if err := os.Remove(*req.ArchivePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Printf("could not remove archive of request_id=%d: %v", req.ID, err)
+			continue
+		}
+		if _, err := s.db.Exec(`UPDATE data_requests SET archive_path = NULL WHERE id = $1`, req.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==================== Export ====================
+
+type exportRecipe struct {
+	models.Recipe
+	Ingredients []models.RecipeIngredient `json:"ingredients"`
+	Steps       []models.RecipeStep       `json:"steps"`
+}
+
+type exportPurchase struct {
+	ID        int       `db:"id" json:"id"`
+	RecipeID  *int      `db:"recipe_id" json:"recipe_id"`
+	Amount    float64   `db:"amount" json:"amount"`
+	Currency  string    `db:"currency" json:"currency"`
+	TxRef     string    `db:"chapa_tx_ref" json:"tx_ref"`
+	Status    string    `db:"status" json:"status"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// DataExport is the JSON archive handed to the user.
+type DataExport struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Profile     models.User       `json:"profile"`
+	Recipes     []exportRecipe    `json:"recipes"`
+	Comments    []models.Comment  `json:"comments"`
+	Ratings     []models.Rating   `json:"ratings"`
+	Likes       []models.Like     `json:"likes"`
+	Bookmarks   []models.Bookmark `json:"bookmarks"`
+	Purchases   []exportPurchase  `json:"purchases"`
+}
+
+// buildExport collects the user's data inside one read-only snapshot.
+func (s *DataRequestService) buildExport(ctx context.Context, userID int) (*DataExport, error) {
+	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	export := &DataExport{GeneratedAt: time.Now().UTC()}
+	if err := tx.Get(&export.Profile, `
+		SELECT id, name, email, COALESCE(avatar_url, '') AS avatar_url, email_verified_at
+		FROM users WHERE id = $1
+	`, userID); err != nil {
+		return nil, err
+	}
+
+	var recipes []models.Recipe
+	if err := tx.Select(&recipes, `
+		SELECT id, user_id, COALESCE(category_id, 0) AS category_id, title,
+		       COALESCE(description, '') AS description, COALESCE(preparation_time, 0) AS preparation_time,
+		       COALESCE(price, 0) AS price, COALESCE(thumbnail_url, '') AS thumbnail_url,
+		       COALESCE(thumbnail_card_url, thumbnail_url, '') AS thumbnail_card_url,
+		       COALESCE(thumbnail_placeholder, '') AS thumbnail_placeholder, created_at
+		FROM recipes WHERE user_id = $1 ORDER BY id
+	`, userID); err != nil {
+		return nil, err
+	}
+	export.Recipes = make([]exportRecipe, 0, len(recipes))
+	for _, recipe := range recipes {
+		item := exportRecipe{Recipe: recipe}
+		if err := tx.Select(&item.Images, `
+			SELECT id, recipe_id, url, is_featured,
+			       COALESCE(thumbnail_url, url) AS thumbnail_url, COALESCE(card_url, url) AS card_url,
+			       COALESCE(full_url, url) AS full_url, COALESCE(placeholder, '') AS placeholder
+			FROM recipe_images WHERE recipe_id = $1 ORDER BY id
+		`, recipe.ID); err != nil {
+			return nil, err
+		}
+		if err := tx.Select(&item.Ingredients, `
+			SELECT id, recipe_id, name, COALESCE(quantity, '') AS quantity, COALESCE(unit_id, 0) AS unit_id
+			FROM recipe_ingredients WHERE recipe_id = $1 ORDER BY id
+		`, recipe.ID); err != nil {
+			return nil, err
+		}
+		if err := tx.Select(&item.Steps, `
+			SELECT id, recipe_id, step_number, instruction, COALESCE(image_url, '') AS image_url
+			FROM recipe_steps WHERE recipe_id = $1 ORDER BY step_number
+		`, recipe.ID); err != nil {
+			return nil, err
+		}
+		export.Recipes = append(export.Recipes, item)
+	}
+
+	queries := []struct {
+		dest  interface{}
+		query string
+	}{
+		{&export.Comments, `SELECT id, user_id, recipe_id, content, created_at FROM comments WHERE user_id = $1 ORDER BY created_at`},
+		{&export.Ratings, `SELECT user_id, recipe_id, rating, created_at FROM ratings WHERE user_id = $1 ORDER BY created_at`},
+		{&export.Likes, `SELECT user_id, recipe_id, created_at FROM likes WHERE user_id = $1 ORDER BY created_at`},
+		{&export.Bookmarks, `SELECT user_id, recipe_id, created_at FROM bookmarks WHERE user_id = $1 ORDER BY created_at`},
+		{&export.Purchases, `
+			SELECT id, recipe_id, COALESCE(amount, 0) AS amount, COALESCE(currency, '') AS currency,
+			       COALESCE(chapa_tx_ref, '') AS chapa_tx_ref, COALESCE(status, '') AS status, created_at
+			FROM purchases WHERE user_id = $1 ORDER BY created_at`},
+	}
+	for _, q := range queries {
+		if err := tx.Select(q.dest, q.query, userID); err != nil {
+			return nil, err
+		}
+	}
+	return export, nil
+}
+
+func (s *DataRequestService) runExport(ctx context.Context, req *DataRequest) error {
+	export, err := s.buildExport(ctx, *req.UserID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.exportDir, 0o700); err != nil {
+		return err
+	}
+	suffix, err := utils.GenerateOpaqueToken(12)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.exportDir, fmt.Sprintf("export-%d-%s.json", req.ID, suffix))
+
+	// Write to a temp file first so a crash never leaves a truncated archive behind.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	expiresAt := time.Now().Add(dataExportRetention())
+	if err := s.finish(req.ID, &path, &expiresAt); err != nil {
+		os.Remove(path)
+		return err
+	}
+	s.logger.Printf("export completed: request_id=%d user_id=%d", req.ID, *req.UserID)
+
+	s.notify(export.Profile.Email, export.Profile.Name, "Your data export is ready",
+		"your data export is ready. Sign in and open your account settings to download it. The download is available until "+
+			expiresAt.UTC().Format("2 Jan 2006 15:04 MST")+".")
+	return nil
+}
+
+// ==================== Deletion ====================
+
+// runDeletion removes the account in one transaction. Purchases are kept for
+// accounting but lose their link to the account, and to the user's own
+// recipes, before the recipes and everything hanging off them (V6 cascades)
+// are deleted. Audit events are kept but scrubbed of personal details (V28).
+func (s *DataRequestService) runDeletion(ctx context.Context, req *DataRequest) error {
+	userID := *req.UserID
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var user struct {
+		Name  string `db:"name"`
+		Email string `db:"email"`
+	}
+	if err := tx.Get(&user, `SELECT name, email FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return err
+	}
+
+	var archives []string
+	if err := tx.Select(&archives, `
+		SELECT archive_path FROM data_requests WHERE user_id = $1 AND archive_path IS NOT NULL
+	`, userID); err != nil {
+		return err
+	}
+
+	steps := []string{
+		// Anonymize purchases made by the user and sales of the user's recipes.
+		`UPDATE purchases SET user_id = NULL, checkout_url = NULL WHERE user_id = $1`,
+		`UPDATE purchases SET recipe_id = NULL WHERE recipe_id IN (SELECT id FROM recipes WHERE user_id = $1)`,
+		`UPDATE payment_events SET user_id = NULL, payload = payload - 'user_id' WHERE user_id = $1`,
+		`UPDATE payment_events SET recipe_id = NULL, payload = payload - 'recipe_id'
+		 WHERE recipe_id IN (SELECT id FROM recipes WHERE user_id = $1)`,
+		// Activity on other people's recipes.
+		`DELETE FROM comments WHERE user_id = $1`,
+		`DELETE FROM ratings WHERE user_id = $1`,
+		`DELETE FROM likes WHERE user_id = $1`,
+		`DELETE FROM bookmarks WHERE user_id = $1`,
+		// The user's recipes; images, ingredients, steps and the activity of
+		// others on them go through the V6 cascades.
+		`DELETE FROM recipes WHERE user_id = $1`,
+		`UPDATE data_requests SET archive_path = NULL WHERE user_id = $1`,
+		// Sessions, tokens, 2FA, API keys and roles cascade from users.
+		`DELETE FROM users WHERE id = $1`,
+	}
+	for _, step := range steps {
+		if _, err := tx.ExecContext(ctx, step, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_attempts WHERE key IN ($1, $2)`,
+		emailLimitKey(user.Email), userLimitKey(userID)); err != nil {
+		return err
+	}
+	// The audit trail stays, without the IPs, user agents and emails in it.
+	if _, err := tx.ExecContext(ctx, `SELECT scrub_audit_events_for_user($1)`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE data_requests
+		SET status = 'completed', completed_at = CURRENT_TIMESTAMP, last_error = NULL
+		WHERE id = $1
+	`, req.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, path := range archives {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Printf("could not remove archive of deleted account: %v", err)
+		}
+	}
+	s.logger.Printf("account deleted: request_id=%d user_id=%d", req.ID, userID)
+
+	s.notify(user.Email, user.Name, "Your account has been deleted",
+		"your account and personal data have been deleted. Purchase records are kept without your details for accounting.")
+	return nil
+}
+
+func (s *DataRequestService) notify(email, name, subject, text string) {
+	if s.mailer == nil {
+		return
+	}
+	msg := utils.MailMessage{
+		To:      email,
+		Subject: subject,
+		Body:    fmt.Sprintf("Hi %s,\n\n%s\n", firstNameFromUserName(name), text),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		s.logger.Printf("failed to send %q email: %v", subject, err)
+	}
+}
+
+// ==================== Request/Response Types ====================
+
+type RequestAccountDeletionRequest struct {
+	Password string `json:"password"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// RequestDataExportAction handles the request_data_export action from Hasura.
+func RequestDataExportAction(svc *DataRequestService) ActionFunc[struct{}, *DataRequest] {
+	return func(ctx context.Context, s Session, _ struct{}) (*DataRequest, error) {
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return nil, err
+		}
+		req, err := svc.RequestExport(userID)
+		switch {
+		case errors.Is(err, errDataRequestOpen):
+			return nil, newActionError(codeDataRequestInProgress)
+		case err != nil:
+			svc.logger.Printf("queueing export failed: %v", err)
+			return nil, internalError()
+		}
+		logAuditEvent(s.Request, auditEntry{Action: auditExportRequested, ActorID: userID, Metadata: auditMetadata{"request_id": req.ID}})
+		return req, nil
+	}
+}
+
+// RequestAccountDeletionAction handles the request_account_deletion action
+// from Hasura. Wrong passwords are throttled like failed logins.
+func RequestAccountDeletionAction(svc *DataRequestService, throttle *LoginThrottle) ActionFunc[RequestAccountDeletionRequest, *DataRequest] {
+	return func(ctx context.Context, s Session, in RequestAccountDeletionRequest) (*DataRequest, error) {
+		if in.Password == "" {
+			return nil, missingFields("password")
+		}
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return nil, err
+		}
+
+		attempt, err := beginPasswordCheck(ctx, throttle, s, userID)
+		if err != nil {
+			return nil, err
+		}
+		req, err := svc.RequestDeletion(userID, in.Password)
+		finishPasswordCheck(ctx, throttle, attempt, err)
+		switch {
+		case errors.Is(err, errInvalidPassword):
+			return nil, newActionError(codeInvalidPassword)
+		case errors.Is(err, errLastAdmin):
+			return nil, newActionError(codeLastAdmin)
+		case errors.Is(err, errDataRequestOpen):
+			return nil, newActionError(codeDataRequestInProgress)
+		case err != nil:
+			svc.logger.Printf("queueing deletion failed: %v", err)
+			return nil, internalError()
+		}
+		logAuditEvent(s.Request, auditEntry{Action: auditDeletionRequested, ActorID: userID, Metadata: auditMetadata{"request_id": req.ID}})
+		return req, nil
+	}
+}
+
+// DataRequestsAction handles the data_requests action from Hasura.
+func DataRequestsAction(svc *DataRequestService) ActionFunc[struct{}, []DataRequest] {
+	return func(ctx context.Context, s Session, _ struct{}) ([]DataRequest, error) {
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return nil, err
+		}
+		requests, err := svc.ListRequests(userID, NewURLBuilder(s.Request))
+		if err != nil {
+			svc.logger.Printf("listing data requests failed: %v", err)
+			return nil, internalError()
+		}
+		return requests, nil
+	}
+}
+
+// DownloadDataExportHandler serves an archive through the short-lived signed
+// link returned by the data_requests action.
+func DownloadDataExportHandler(svc *DataRequestService) http.HandlerFunc {
+	return withRecovery(func(w http.ResponseWriter, r *http.Request) {
+		userID, claims, err := utils.ParseChallengeToken(r.URL.Query().Get("token"), dataExportDownloadPurpose)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeActionError(w, r, newActionError(codeInvalidDownloadLink))
+			return
+		}
+		requestID, _ := claims["request_id"].(float64)
+
+		var req DataRequest
+		err = svc.db.Get(&req, `
+			SELECT `+dataRequestColumns+`
+			FROM data_requests
+			WHERE id = $1 AND user_id = $2 AND kind = 'export' AND status = 'completed'
+			  AND archive_path IS NOT NULL AND expires_at > CURRENT_TIMESTAMP
+		`, int64(requestID), userID)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeActionError(w, r, newActionError(codeDataRequestNotFound))
+			return
+		}
+
+		f, err := os.Open(*req.ArchivePath)
+		if err != nil {
+			svc.logger.Printf("opening archive of request_id=%d failed: %v", req.ID, err)
+			w.Header().Set("Content-Type", "application/json")
+			writeActionError(w, r, newActionError(codeDataRequestNotFound))
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="food-recipes-export-`+strconv.FormatInt(req.ID, 10)+`.json"`)
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := io.Copy(w, f); err != nil {
+			svc.logger.Printf("streaming archive of request_id=%d failed: %v", req.ID, err)
+		}
+	}, svc.logger)
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"foodrecipes/utils"
+)
+
+// Direct uploads let clients send an image straight to storage with signed
+// parameters instead of through this server. The upload is unusable until
+// the client calls the completion action: the backend then reads the stored
+// file back, checks it like any other upload, stores and records a cleaned
+// copy in its place, after which that copy can be attached to a recipe.
+
+// directUploadFormats are the extensions a signed upload accepts.
+var directUploadFormats = []string{"jpg", "png", "webp", "gif"}
+
+// directUploadMaxPending bounds the unexpired uploads a user may have signed
+// but not completed.
+const directUploadMaxPending = 20
+
+// directUploadTTL returns how long signed upload parameters stay valid
+// Default: 10 minutes
+// Can be overridden with DIRECT_UPLOAD_TTL_MINUTES environment variable
+func directUploadTTL() time.Duration {
+	return time.Duration(envInt("DIRECT_UPLOAD_TTL_MINUTES", 10)) * time.Minute
+}
+
+// ==================== Request/Response Types ====================
+
+type CreateDirectUploadRequest struct {
+	Purpose string `json:"purpose"` // optional; "avatar" sets the caller's avatar on completion
+}
+
+// CreateDirectUploadResponse is the signed request to send the file with,
+// and the limits the file is checked against on completion.
+type CreateDirectUploadResponse struct {
+	UploadID int64 `json:"upload_id"`
+	utils.SignedUpload
+	MaxBytes       int64     `json:"max_bytes"`
+	AllowedFormats []string  `json:"allowed_formats"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+type CompleteDirectUploadRequest struct {
+	UploadID int64 `json:"upload_id"`
+}
+
+type directUpload struct {
+	ID         int64          `db:"id"`
+	StorageKey string         `db:"storage_key"`
+	Purpose    sql.NullString `db:"purpose"`
+	MaxBytes   int64          `db:"max_bytes"`
+	Status     string         `db:"status"`
+	URL        sql.NullString `db:"url"`
+	ExpiresAt  time.Time      `db:"expires_at"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// CreateDirectUploadAction signs the parameters for one upload straight to
+// storage.
+func CreateDirectUploadAction(ctx context.Context, s Session, req CreateDirectUploadRequest) (CreateDirectUploadResponse, error) {
+	userID, _, err := s.ActiveUser()
+	if err != nil {
+		return CreateDirectUploadResponse{}, err
+	}
+	store, ok := Blobs.(utils.DirectUploader)
+	if !ok {
+		return CreateDirectUploadResponse{}, newActionError(codeDirectUploadUnavailable)
+	}
+	if len(req.Purpose) > 32 {
+		return CreateDirectUploadResponse{}, missingFields("purpose")
+	}
+
+	var pending int
+	if err := DB.GetContext(ctx, &pending, `
+		SELECT COUNT(*) FROM direct_uploads
+		WHERE user_id = $1 AND status = 'pending' AND expires_at > NOW()
+	`, userID); err != nil {
+		return CreateDirectUploadResponse{}, fmt.Errorf("count pending direct uploads: %w", err)
+	}
+	if pending >= directUploadMaxPending {
+		return CreateDirectUploadResponse{}, newActionError(codeTooManyRequests)
+	}
+
+	// The extension is unknown until the file is checked; the stored type
+	// comes from the content.
+	key := "direct/" + uploadFilename("")
+	maxBytes := UploadMaxFileBytes()
+	expiresAt := time.Now().Add(directUploadTTL()).UTC()
+	signed, err := store.SignUpload(key, utils.DirectUploadPolicy{
+		MaxBytes: maxBytes,
+		Formats:  directUploadFormats,
+		Expires:  expiresAt,
+	})
+	if err != nil {
+		return CreateDirectUploadResponse{}, fmt.Errorf("sign direct upload: %w", err)
+	}
+
+	var id int64
+	if err := DB.GetContext(ctx, &id, `
+		INSERT INTO direct_uploads (user_id, storage_key, purpose, max_bytes, expires_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		RETURNING id
+	`, userID, key, req.Purpose, maxBytes, expiresAt); err != nil {
+		return CreateDirectUploadResponse{}, fmt.Errorf("create direct upload: %w", err)
+	}
+
+	return CreateDirectUploadResponse{
+		UploadID:       id,
+		SignedUpload:   *signed,
+		MaxBytes:       maxBytes,
+		AllowedFormats: directUploadFormats,
+		ExpiresAt:      expiresAt,
+	}, nil
+}
+
+// CompleteDirectUploadAction checks a file the caller uploaded with
+// CreateDirectUploadAction's parameters and returns the URL of its cleaned
+// copy. A file that fails the checks is deleted from storage. Completing an
+// upload twice returns the same URL.
+func CompleteDirectUploadAction(ctx context.Context, s Session, req CompleteDirectUploadRequest) (HasuraUploadResponse, error) {
+	userID, _, err := s.ActiveUser()
+	if err != nil {
+		return HasuraUploadResponse{}, err
+	}
+	if req.UploadID == 0 {
+		return HasuraUploadResponse{}, missingFields("upload_id")
+	}
+	store, ok := Blobs.(utils.DirectUploader)
+	if !ok {
+		return HasuraUploadResponse{}, newActionError(codeDirectUploadUnavailable)
+	}
+
+	var upload directUpload
+	err = DB.GetContext(ctx, &upload, `
+		SELECT id, storage_key, purpose, max_bytes, status, url, expires_at
+		FROM direct_uploads WHERE id = $1 AND user_id = $2
+	`, req.UploadID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return HasuraUploadResponse{}, newActionError(codeUploadNotFound)
+	}
+	if err != nil {
+		return HasuraUploadResponse{}, fmt.Errorf("load direct upload: %w", err)
+	}
+	switch {
+	case upload.Status == "completed":
+		return HasuraUploadResponse{URL: upload.URL.String}, nil
+	case upload.Status == "rejected":
+		return HasuraUploadResponse{}, newActionError(codeUploadNotFound)
+	case time.Now().After(upload.ExpiresAt):
+		rejectDirectUpload(ctx, store, upload)
+		return HasuraUploadResponse{}, newActionError(codeUploadExpired)
+	}
+
+	release, err := acquireUploadSlot(ctx)
+	if err != nil {
+		return HasuraUploadResponse{}, err
+	}
+	defer release()
+	rc, err := store.Open(ctx, upload.StorageKey)
+	if errors.Is(err, utils.ErrBlobNotFound) {
+		return HasuraUploadResponse{}, newActionError(codeUploadNotReceived)
+	}
+	if err != nil {
+		log.Printf("reading direct upload %d failed: %v", upload.ID, err)
+		return HasuraUploadResponse{}, newActionError(codeUploadFailed)
+	}
+	src := &sizeLimitedReader{r: rc, limit: upload.MaxBytes}
+	data, err := io.ReadAll(src)
+	rc.Close()
+	if src.exceeded {
+		rejectDirectUpload(ctx, store, upload)
+		return HasuraUploadResponse{}, newActionError(codeFileTooLarge).with("max", formatBytes(upload.MaxBytes))
+	}
+	if err != nil {
+		log.Printf("reading direct upload %d failed: %v", upload.ID, err)
+		return HasuraUploadResponse{}, newActionError(codeUploadFailed)
+	}
+
+	clean, info, actionErr := sanitizeUpload(data)
+	if actionErr != nil {
+		rejectDirectUpload(ctx, store, upload)
+		return HasuraUploadResponse{}, actionErr
+	}
+	// The cleaned copy goes under a new key: the client's copy may carry
+	// metadata, and its signed parameters stay usable until they expire, so
+	// the client could still overwrite it. The sweeper deletes the client's
+	// key again once they have expired.
+	url, variants, err := storeUploadedImage(ctx, userID, clean, info)
+	if err != nil {
+		return HasuraUploadResponse{}, err
+	}
+	if err := store.Delete(ctx, upload.StorageKey); err != nil {
+		log.Printf("deleting direct upload %d failed: %v", upload.ID, err)
+	}
+
+	result, err := DB.ExecContext(ctx, `
+		UPDATE direct_uploads SET status = 'completed', url = $2, completed_at = NOW()
+		WHERE id = $1 AND status = 'pending'
+	`, upload.ID, url)
+	if err != nil {
+		return HasuraUploadResponse{}, fmt.Errorf("complete direct upload: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Completed concurrently; that call did the rest
+		return HasuraUploadResponse{URL: url, Variants: variants}, nil
+	}
+
+	if upload.Purpose.String == "avatar" {
+		if _, err := DB.ExecContext(ctx, `UPDATE users SET avatar_url = $1 WHERE id = $2`, url, userID); err != nil {
+			log.Printf("avatar update failed for user_id=%d: %v", userID, err)
+			return HasuraUploadResponse{}, internalError()
+		}
+	}
+
+	logAuditEvent(s.Request, auditEntry{Action: auditUploadCreated, ActorID: userID, Metadata: auditMetadata{
+		"url":       url,
+		"purpose":   upload.Purpose.String,
+		"bytes":     len(clean),
+		"upload_id": upload.ID,
+	}})
+
+	return HasuraUploadResponse{URL: url, Variants: variants}, nil
+}
+
+// rejectDirectUpload deletes a direct upload that failed its checks and marks
+// it rejected. Failures are only logged; the caller already has an error to
+// report.
+func rejectDirectUpload(ctx context.Context, store utils.BlobStore, upload directUpload) {
+	if err := store.Delete(ctx, upload.StorageKey); err != nil {
+		log.Printf("deleting rejected direct upload %d failed: %v", upload.ID, err)
+	}
+	if _, err := DB.ExecContext(ctx, `
+		UPDATE direct_uploads SET status = 'rejected' WHERE id = $1 AND status = 'pending'
+	`, upload.ID); err != nil {
+		log.Printf("rejecting direct upload %d failed: %v", upload.ID, err)
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorCode is the stable identifier sent as extensions.code. Clients branch
+// on it, so a code is never renamed or reused for a different error; add a
+// new one instead.
+type ErrorCode string
+
+const (
+	codeInternal         ErrorCode = "internal_error"
+	codeInvalidInput     ErrorCode = "invalid_input"
+	codeInvalidBody      ErrorCode = "invalid_body"
+	codeInvalidJSON      ErrorCode = "invalid_json"
+	codeMethodNotAllowed ErrorCode = "method_not_allowed"
+	codeForbidden        ErrorCode = "forbidden"
+
+	codeAuthenticationRequired ErrorCode = "authentication_required"
+	codeInvalidSession         ErrorCode = "invalid_session"
+	codeSessionRevoked         ErrorCode = "session_revoked"
+	codeSessionNotFound        ErrorCode = "session_not_found"
+	codeActionSecretRequired   ErrorCode = "action_secret_required"
+	codeInvalidActionSecret    ErrorCode = "invalid_action_secret"
+	codeInvalidActionSignature ErrorCode = "invalid_action_signature"
+	codeActionSignatureExpired ErrorCode = "action_signature_expired"
+
+	codeInvalidCredentials  ErrorCode = "invalid_credentials"
+	codeTooManyAttempts     ErrorCode = "too_many_attempts"
+	codeLoginLocked         ErrorCode = "login_locked"
+	codeTooManyRequests     ErrorCode = "too_many_requests"
+	codeInvalidRefreshToken ErrorCode = "invalid_refresh_token"
+	codeRefreshTokenExpired ErrorCode = "refresh_token_expired"
+	codeRefreshTokenReused  ErrorCode = "refresh_token_reused"
+	codeInvalidMagicLink    ErrorCode = "invalid_magic_link"
+	codeUnknownProvider     ErrorCode = "unknown_provider"
+	codeProviderUnavailable ErrorCode = "provider_unavailable"
+	codeInvalidOIDCState    ErrorCode = "invalid_oidc_state"
+	codeOIDCLoginFailed     ErrorCode = "oidc_login_failed"
+	codeOIDCEmailRequired   ErrorCode = "oidc_email_required"
+
+	codeTwoFactorEnabled     ErrorCode = "two_factor_enabled"
+	codeTwoFactorNotEnrolled ErrorCode = "two_factor_not_enrolled"
+	codeInvalidTwoFactorCode ErrorCode = "invalid_2fa_code"
+	codeInvalidChallenge     ErrorCode = "invalid_challenge"
+
+	codeEmailExists              ErrorCode = "email_exists"
+	codeInvalidEmail             ErrorCode = "invalid_email"
+	codeEmailUnchanged           ErrorCode = "email_unchanged"
+	codeEmailAlreadyVerified     ErrorCode = "email_already_verified"
+	codeEmailNotVerified         ErrorCode = "email_not_verified"
+	codeInvalidVerificationToken ErrorCode = "invalid_verification_token"
+	codeWeakPassword             ErrorCode = "weak_password"
+	codeInvalidPassword          ErrorCode = "invalid_password"
+	codeInvalidResetToken        ErrorCode = "invalid_reset_token"
+	codeInvalidName              ErrorCode = "invalid_name"
+	codeInvalidAvatarURL         ErrorCode = "invalid_avatar_url"
+
+	codeInvalidRole      ErrorCode = "invalid_role"
+	codeUserNotFound     ErrorCode = "user_not_found"
+	codeLastAdmin        ErrorCode = "last_admin"
+	codeInvalidTimeRange ErrorCode = "invalid_time_range"
+
+	codeAPIKeyRequired    ErrorCode = "api_key_required"
+	codeInvalidAPIKey     ErrorCode = "invalid_api_key"
+	codeInsufficientScope ErrorCode = "insufficient_scope"
+	codeInvalidScope      ErrorCode = "invalid_scope"
+	codeInvalidRateLimit  ErrorCode = "invalid_rate_limit"
+	codeAPIKeyNotFound    ErrorCode = "api_key_not_found"
+	codeRateLimited       ErrorCode = "rate_limited"
+
+	codeDataRequestInProgress ErrorCode = "data_request_in_progress"
+	codeDataRequestNotFound   ErrorCode = "data_request_not_found"
+	codeInvalidDownloadLink   ErrorCode = "invalid_download_link"
+
+	codeInvalidBase64        ErrorCode = "invalid_base64"
+	codeUploadFailed         ErrorCode = "upload_failed"
+	codeFileTooLarge         ErrorCode = "file_too_large"
+	codeRequestTooLarge      ErrorCode = "request_too_large"
+	codeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	codeUnsupportedImageType ErrorCode = "unsupported_image_type"
+	codeInvalidImage         ErrorCode = "invalid_image"
+	codeImageTooLarge        ErrorCode = "image_dimensions_too_large"
+	codeImageTooManyPixels   ErrorCode = "image_too_many_pixels"
+	codeImageTooManyFrames   ErrorCode = "image_too_many_frames"
+
+	codeDirectUploadUnavailable ErrorCode = "direct_upload_unavailable"
+	codeUploadNotFound          ErrorCode = "upload_not_found"
+	codeUploadExpired           ErrorCode = "upload_expired"
+	codeUploadNotReceived       ErrorCode = "upload_not_received"
+
+	codeInvalidAmount        ErrorCode = "invalid_amount"
+	codeRecipeNotFound       ErrorCode = "recipe_not_found"
+	codePurchaseNotFound     ErrorCode = "purchase_not_found"
+	codePaymentProviderError ErrorCode = "payment_provider_error"
+)
+
+// Languages error messages are available in.
+const (
+	langEnglish = "en"
+	langAmharic = "am"
+)
+
+// errorSpec is a catalog entry. Messages may contain {name} placeholders,
+// filled from ActionError.Params.
+type errorSpec struct {
+	Status  int
+	English string
+	Amharic string
+}
+
+func (s errorSpec) message(lang string) string {
+	if lang == langAmharic && s.Amharic != "" {
+		return s.Amharic
+	}
+	return s.English
+}
+
+var errorCatalog = map[ErrorCode]errorSpec{
+	codeInternal:         {http.StatusInternalServerError, "Something went wrong, please try again later", "ችግር ተፈጥሯል፣ እባክዎ ቆይተው እንደገና ይሞክሩ"},
+	codeInvalidInput:     {http.StatusBadRequest, "Missing or invalid fields: {fields}", "የጎደሉ ወይም ትክክል ያልሆኑ መስኮች፦ {fields}"},
+	codeInvalidBody:      {http.StatusBadRequest, "The request could not be read", "ጥያቄው ሊነበብ አልቻለም"},
+	codeInvalidJSON:      {http.StatusBadRequest, "Request body must be valid JSON", "የጥያቄው አካል ትክክለኛ JSON መሆን አለበት"},
+	codeMethodNotAllowed: {http.StatusMethodNotAllowed, "Method not allowed", "ይህ ዘዴ አይፈቀድም"},
+	codeForbidden:        {http.StatusForbidden, "You do not have permission to do this", "ይህን ለማድረግ ፈቃድ የለዎትም"},
+
+	codeAuthenticationRequired: {http.StatusUnauthorized, "Log in to continue", "ለመቀጠል እባክዎ ይግቡ"},
+	codeInvalidSession:         {http.StatusUnauthorized, "Your session is invalid, please log in again", "ክፍለ ጊዜዎ ትክክል አይደለም፣ እባክዎ እንደገና ይግቡ"},
+	codeSessionRevoked:         {http.StatusUnauthorized, "Session has been signed out", "ክፍለ ጊዜው ተዘግቷል፣ እባክዎ እንደገና ይግቡ"},
+	codeSessionNotFound:        {http.StatusNotFound, "Session not found", "ክፍለ ጊዜው አልተገኘም"},
+	codeActionSecretRequired:   {http.StatusUnauthorized, "This endpoint only accepts calls from Hasura", "ይህ አድራሻ ከHasura የሚመጡ ጥሪዎችን ብቻ ይቀበላል"},
+	codeInvalidActionSecret:    {http.StatusUnauthorized, "Invalid action secret", "የተሳሳተ የድርጊት ሚስጥር"},
+	codeInvalidActionSignature: {http.StatusUnauthorized, "Invalid action signature", "የተሳሳተ የድርጊት ፊርማ"},
+	codeActionSignatureExpired: {http.StatusUnauthorized, "Action signature is missing a timestamp or has expired", "የድርጊቱ ፊርማ የጊዜ ማህተም የለውም ወይም ጊዜው አልፎበታል"},
+
+	codeInvalidCredentials:  {http.StatusBadRequest, "Invalid email or password", "ኢሜይል ወይም የይለፍ ቃል የተሳሳተ ነው"},
+	codeTooManyAttempts:     {http.StatusTooManyRequests, "Too many failed login attempts, please wait before trying again", "ብዙ ያልተሳኩ የመግቢያ ሙከራዎች ተደርገዋል፣ እባክዎ ትንሽ ቆይተው ይሞክሩ"},
+	codeLoginLocked:         {http.StatusTooManyRequests, "Login is temporarily locked after too many failed attempts", "ከብዙ ያልተሳኩ ሙከራዎች በኋላ መግቢያ ለጊዜው ተቆልፏል"},
+	codeTooManyRequests:     {http.StatusTooManyRequests, "Too many requests, please wait a moment and try again", "ብዙ ጥያቄዎች ቀርበዋል፣ እባክዎ ትንሽ ቆይተው እንደገና ይሞክሩ"},
+	codeInvalidRefreshToken: {http.StatusUnauthorized, "Invalid refresh token", "የተሳሳተ የማደሻ ቶከን"},
+	codeRefreshTokenExpired: {http.StatusUnauthorized, "Refresh token expired", "የማደሻ ቶከኑ ጊዜው አልፏል"},
+	codeRefreshTokenReused:  {http.StatusUnauthorized, "Refresh token reuse detected, please log in again", "የማደሻ ቶከኑ በድጋሚ ጥቅም ላይ ውሏል፣ እባክዎ እንደገና ይግቡ"},
+	codeInvalidMagicLink:    {http.StatusBadRequest, "Sign-in link is invalid or has expired", "የመግቢያ አገናኙ ትክክል አይደለም ወይም ጊዜው አልፏል"},
+	codeUnknownProvider:     {http.StatusBadRequest, "Unknown identity provider", "ያልታወቀ የማንነት አቅራቢ"},
+	codeProviderUnavailable: {http.StatusBadGateway, "Identity provider is unavailable", "የማንነት አቅራቢው አይገኝም"},
+	codeInvalidOIDCState:    {http.StatusBadRequest, "Login attempt is invalid or has expired, please start again", "የመግቢያ ሙከራው ትክክል አይደለም ወይም ጊዜው አልፏል፣ እባክዎ እንደገና ይጀምሩ"},
+	codeOIDCLoginFailed:     {http.StatusUnauthorized, "Identity provider rejected the login", "የማንነት አቅራቢው መግቢያውን አልተቀበለም"},
+	codeOIDCEmailRequired:   {http.StatusBadRequest, "The identity provider did not share an email address", "የማንነት አቅራቢው የኢሜይል አድራሻ አላጋራም"},
+
+	codeTwoFactorEnabled:     {http.StatusConflict, "Two-factor authentication is already enabled", "ባለሁለት ደረጃ ማረጋገጫ አስቀድሞ በርቷል"},
+	codeTwoFactorNotEnrolled: {http.StatusBadRequest, "Two-factor authentication is not set up", "ባለሁለት ደረጃ ማረጋገጫ አልተዘጋጀም"},
+	codeInvalidTwoFactorCode: {http.StatusBadRequest, "Invalid authentication code", "የተሳሳተ የማረጋገጫ ኮድ"},
+	codeInvalidChallenge:     {http.StatusUnauthorized, "Login challenge is invalid or has expired", "የመግቢያ ፈተናው ትክክል አይደለም ወይም ጊዜው አልፏል"},
+
+	codeEmailExists:              {http.StatusConflict, "An account with this email already exists", "በዚህ ኢሜይል የተመዘገበ መለያ አለ"},
+	codeInvalidEmail:             {http.StatusBadRequest, "Invalid email address", "የተሳሳተ የኢሜይል አድራሻ"},
+	codeEmailUnchanged:           {http.StatusBadRequest, "New email is the same as the current one", "አዲሱ ኢሜይል ከአሁኑ ጋር አንድ ነው"},
+	codeEmailAlreadyVerified:     {http.StatusBadRequest, "Email address is already verified", "የኢሜይል አድራሻው አስቀድሞ ተረጋግጧል"},
+	codeEmailNotVerified:         {http.StatusForbidden, "Verify your email address first", "መጀመሪያ የኢሜይል አድራሻዎን ያረጋግጡ"},
+	codeInvalidVerificationToken: {http.StatusBadRequest, "Verification link is invalid or has expired", "የማረጋገጫ አገናኙ ትክክል አይደለም ወይም ጊዜው አልፏል"},
+	codeWeakPassword:             {http.StatusBadRequest, "Password must be at least {min} characters", "የይለፍ ቃል ቢያንስ {min} ቁምፊዎች መሆን አለበት"},
+	codeInvalidPassword:          {http.StatusBadRequest, "Password is incorrect", "የይለፍ ቃሉ የተሳሳተ ነው"},
+	codeInvalidResetToken:        {http.StatusBadRequest, "Reset link is invalid or has expired", "የይለፍ ቃል መቀየሪያ አገናኙ ትክክል አይደለም ወይም ጊዜው አልፏል"},
+	codeInvalidName:              {http.StatusBadRequest, "Name must be between 1 and {max} characters", "ስም ከ1 እስከ {max} ቁምፊዎች መሆን አለበት"},
+	codeInvalidAvatarURL:         {http.StatusBadRequest, "Avatar must be an image uploaded through the upload action", "የመገለጫ ምስሉ በመጫኛው በኩል የተጫነ ምስል መሆን አለበት"},
+
+	codeInvalidRole:      {http.StatusBadRequest, "Role must be one of {roles}", "ሚናው ከሚከተሉት አንዱ መሆን አለበት፦ {roles}"},
+	codeUserNotFound:     {http.StatusNotFound, "User not found", "ተጠቃሚው አልተገኘም"},
+	codeLastAdmin:        {http.StatusConflict, "At least one admin must remain; grant the admin role to someone else first", "ቢያንስ አንድ አስተዳዳሪ መኖር አለበት፤ መጀመሪያ የአስተዳዳሪ ሚናን ለሌላ ሰው ይስጡ"},
+	codeInvalidTimeRange: {http.StatusBadRequest, "until must be after since", "until ከsince በኋላ መሆን አለበት"},
+
+	codeAPIKeyRequired:    {http.StatusUnauthorized, "API key required", "የAPI ቁልፍ ያስፈልጋል"},
+	codeInvalidAPIKey:     {http.StatusUnauthorized, "Invalid or revoked API key", "የAPI ቁልፉ ትክክል አይደለም ወይም ተሰርዟል"},
+	codeInsufficientScope: {http.StatusForbidden, "API key lacks the {scope} scope", "የAPI ቁልፉ የ{scope} ፈቃድ የለውም"},
+	codeInvalidScope:      {http.StatusBadRequest, "Scopes must be one or more of {scopes}", "ፈቃዶቹ ከሚከተሉት አንድ ወይም ከዚያ በላይ መሆን አለባቸው፦ {scopes}"},
+	codeInvalidRateLimit:  {http.StatusBadRequest, "rate_limit_per_minute must be between 1 and {max}", "rate_limit_per_minute ከ1 እስከ {max} መሆን አለበት"},
+	codeAPIKeyNotFound:    {http.StatusNotFound, "API key not found", "የAPI ቁልፉ አልተገኘም"},
+	codeRateLimited:       {http.StatusTooManyRequests, "API key rate limit exceeded", "የAPI ቁልፉ የጥያቄ ገደብ ታልፏል"},
+
+	codeDataRequestInProgress: {http.StatusConflict, "A request of this kind is already in progress", "ተመሳሳይ ጥያቄ በሂደት ላይ ነው"},
+	codeDataRequestNotFound:   {http.StatusNotFound, "Export not found or no longer available", "የተጠየቀው መረጃ አልተገኘም ወይም ከአሁን በኋላ አይገኝም"},
+	codeInvalidDownloadLink:   {http.StatusUnauthorized, "Download link is invalid or has expired", "የማውረጃ አገናኙ ትክክል አይደለም ወይም ጊዜው አልፏል"},
+
+	codeInvalidBase64:        {http.StatusBadRequest, "File content must be base64 encoded", "የፋይሉ ይዘት በbase64 የተቀመጠ መሆን አለበት"},
+	codeFileTooLarge:         {http.StatusRequestEntityTooLarge, "Each file must be at most {max}", "እያንዳንዱ ፋይል ከ{max} መብለጥ የለበትም"},
+	codeRequestTooLarge:      {http.StatusRequestEntityTooLarge, "The upload must be at most {max} in total", "የሚጫኑት ፋይሎች በአጠቃላይ ከ{max} መብለጥ የለባቸውም"},
+	codeUnsupportedMediaType: {http.StatusUnsupportedMediaType, "Send files as multipart/form-data", "ፋይሎችን በmultipart/form-data ይላኩ"},
+	codeUnsupportedImageType: {http.StatusUnsupportedMediaType, "Only JPEG, PNG, WebP and GIF images can be uploaded", "መጫን የሚቻለው JPEG፣ PNG፣ WebP እና GIF ምስሎችን ብቻ ነው"},
+	codeInvalidImage:         {http.StatusBadRequest, "The file is not a valid image", "ፋይሉ ትክክለኛ ምስል አይደለም"},
+	codeImageTooLarge:        {http.StatusBadRequest, "Images must be at most {max} pixels wide and tall", "የምስሉ ስፋትና ቁመት ከ{max} ፒክሰል መብለጥ የለበትም"},
+	codeImageTooManyPixels:   {http.StatusBadRequest, "Images can have at most {max} megapixels", "ምስሎች ከ{max} ሜጋፒክሰል በላይ ሊኖራቸው አይችልም"},
+	codeImageTooManyFrames:   {http.StatusBadRequest, "Animated GIFs can have at most {max} frames", "ተንቀሳቃሽ GIF ምስሎች ከ{max} ፍሬሞች በላይ ሊኖራቸው አይችልም"},
+	codeUploadFailed:         {http.StatusBadGateway, "Image upload failed, please try again", "ምስሉን መጫን አልተቻለም፣ እባክዎ እንደገና ይሞክሩ"},
+
+	codeDirectUploadUnavailable: {http.StatusNotImplemented, "Direct uploads are not available; use the upload action", "በቀጥታ መጫን አይቻልም፤ የመጫኛውን ተግባር ይጠቀሙ"},
+	codeUploadNotFound:          {http.StatusNotFound, "Upload not found", "የተጫነው ፋይል አልተገኘም"},
+	codeUploadExpired:           {http.StatusGone, "The upload has expired, please start again", "የመጫኛው ጊዜ አልፏል፣ እባክዎ እንደገና ይጀምሩ"},
+	codeUploadNotReceived:       {http.StatusConflict, "The file has not been uploaded yet", "ፋይሉ ገና አልተጫነም"},
+
+	codeInvalidAmount:        {http.StatusBadRequest, "Amount must be a positive number", "መጠኑ ከዜሮ በላይ የሆነ ቁጥር መሆን አለበት"},
+	codeRecipeNotFound:       {http.StatusNotFound, "Recipe not found", "የምግብ አዘገጃጀቱ አልተገኘም"},
+	codePurchaseNotFound:     {http.StatusNotFound, "Payment not found", "ክፍያው አልተገኘም"},
+	codePaymentProviderError: {http.StatusBadGateway, "The payment provider could not process the request, please try again", "የክፍያ አቅራቢው ጥያቄውን ማስተናገድ አልቻለም፣ እባክዎ እንደገና ይሞክሩ"},
+}
+
+// lookupError returns the catalog entry for code. Codes missing from the
+// catalog are reported as internal errors rather than with a blank message.
+func lookupError(code ErrorCode) errorSpec {
+	if spec, ok := errorCatalog[code]; ok {
+		return spec
+	}
+	return errorCatalog[codeInternal]
+}
+
+// requestLanguage picks the language of error messages from the
+// Accept-Language header, which Hasura passes on for actions that forward
+// client headers. Default: English
+func requestLanguage(r *http.Request) string {
+	if r == nil {
+		return langEnglish
+	}
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if primary != langEnglish && primary != langAmharic {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{primary, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return langEnglish
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", langEnglish},
+		{"am", langAmharic},
+		{"am-ET", langAmharic},
+		{"AM-et", langAmharic},
+		{"fr-FR, de", langEnglish},
+		{"fr, am;q=0.5", langAmharic},
+		{"en;q=0.4, am;q=0.8", langAmharic},
+		{"am;q=0.4, en;q=0.8", langEnglish},
+		{"am, en", langAmharic},
+		{"am;q=0", langEnglish},
+		{"am;q=abc", langAmharic},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/hasura/login", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Language", tt.header)
+		}
+		if got := requestLanguage(r); got != tt.want {
+			t.Errorf("requestLanguage(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+	if got := requestLanguage(nil); got != langEnglish {
+		t.Errorf("requestLanguage(nil) = %s, want %s", got, langEnglish)
+	}
+}
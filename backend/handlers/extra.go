@@ -1,136 +1,93 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
-	"strings"
+	"log"
 	"time"
 
-	"foodrecipes/utils"
+	"foodrecipes/models"
 )
 
 type HasuraUploadInput struct {
 	Filename string `json:"filename"`
 	Mimetype string `json:"mimetype"`
 	Content  string `json:"content"` // base64
+	Purpose  string `json:"purpose"` // optional; "avatar" also sets the caller's avatar
 }
 
-type HasuraUploadPayload struct {
-	Input struct {
-		Arg  *HasuraUploadInput `json:"arg"`
-		File *HasuraUploadInput `json:"file"`
-	} `json:"input"`
+// HasuraUploadRequest is the upload action input. The file fields may be
+// given directly or nested under "file".
+type HasuraUploadRequest struct {
+	HasuraUploadInput
+	File *HasuraUploadInput `json:"file"`
 }
 
 type HasuraUploadResponse struct {
-	URL string `json:"url"`
+	URL      string                `json:"url"`
+	Variants *models.ImageVariants `json:"variants,omitempty"`
 }
 
-type hasuraActionEnvelope struct {
-	Input            json.RawMessage        `json:"input"`
-	SessionVariables map[string]interface{} `json:"session_variables"`
-}
-
-// HasuraErrorResponse is already defined in auth.go; no need to redefine.
-func HasuraUploadHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	body, err := io.ReadAll(r.Body)
+// UploadAction handles the upload action from Hasura.
+func UploadAction(ctx context.Context, s Session, req HasuraUploadRequest) (HasuraUploadResponse, error) {
+	userID, _, err := s.ActiveUser()
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body", "invalid_body")
-		return
+		return HasuraUploadResponse{}, err
 	}
 
-	var envelope hasuraActionEnvelope
-	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Input) == 0 {
-		respondWithError(w, http.StatusBadRequest, "Invalid JSON body", "invalid_json")
-		return
+	input := &req.HasuraUploadInput
+	if req.File != nil {
+		input = req.File
 	}
-
-	rawUserID, ok := envelope.SessionVariables["x-hasura-user-id"]
-	if !ok {
-		respondWithError(w, http.StatusUnauthorized, "Missing session user id", "invalid_session")
-		return
-	}
-	if _, err := parseUserID(rawUserID); err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid session user id", "invalid_session")
-		return
-	}
-
-	var payload HasuraUploadPayload
-	if err := json.Unmarshal(body, &payload); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid upload payload", "invalid_input")
-		return
-	}
-
-	var input *HasuraUploadInput
-	if payload.Input.Arg != nil {
-		input = payload.Input.Arg
-	} else if payload.Input.File != nil {
-		input = payload.Input.File
-	}
-	if input == nil || input.Filename == "" || input.Mimetype == "" || input.Content == "" {
-		respondWithError(w, http.StatusBadRequest, "Missing upload input fields", "invalid_input")
-		return
+	if input.Filename == "" || input.Mimetype == "" || input.Content == "" {
+		return HasuraUploadResponse{}, missingFields("filename", "mimetype", "content")
 	}
 
 	// Decode base64 content
 	decoded, err := base64.StdEncoding.DecodeString(input.Content)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid base64 content", "invalid_base64")
-		return
+		return HasuraUploadResponse{}, newActionError(codeInvalidBase64)
 	}
 
-	// Create a unique filename (preserve extension)
-	ext := ""
-	if dot := strings.LastIndex(input.Filename, "."); dot != -1 {
-		ext = input.Filename[dot:]
+	if maxFile := UploadMaxFileBytes(); int64(len(decoded)) > maxFile {
+		return HasuraUploadResponse{}, newActionError(codeFileTooLarge).with("max", formatBytes(maxFile))
 	}
-	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-
-	// Upload to Cloudinary
-	url, err := utils.UploadToCloudinary(r.Context(), bytes.NewReader(decoded), filename)
+	release, err := acquireUploadSlot(ctx)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to upload image: "+err.Error(), "cloudinary_error")
-		return
+		return HasuraUploadResponse{}, err
+	}
+	defer release()
+	// The type comes from the content; input.Mimetype and the extension of
+	// input.Filename are not trusted
+	clean, info, actionErr := sanitizeUpload(decoded)
+	if actionErr != nil {
+		return HasuraUploadResponse{}, actionErr
 	}
 
-	// Return success
-	json.NewEncoder(w).Encode(HasuraUploadResponse{URL: url})
-}
+	url, variants, err := storeUploadedImage(ctx, userID, clean, info)
+	if err != nil {
+		return HasuraUploadResponse{}, err
+	}
 
-func parseUserID(raw interface{}) (int, error) {
-	switch v := raw.(type) {
-	case float64:
-		if v <= 0 {
-			return 0, fmt.Errorf("invalid user id")
+	if input.Purpose == "avatar" {
+		if _, err := DB.Exec(`UPDATE users SET avatar_url = $1 WHERE id = $2`, url, userID); err != nil {
+			log.Printf("avatar update failed for user_id=%d: %v", userID, err)
+			return HasuraUploadResponse{}, internalError()
 		}
-		return int(v), nil
-	case string:
-		id, err := strconv.Atoi(v)
-		if err != nil || id <= 0 {
-			return 0, fmt.Errorf("invalid user id")
-		}
-		return id, nil
-	case int:
-		if v <= 0 {
-			return 0, fmt.Errorf("invalid user id")
-		}
-		return v, nil
-	default:
-		return 0, fmt.Errorf("unsupported user id type")
 	}
+
+	logAuditEvent(s.Request, auditEntry{Action: auditUploadCreated, ActorID: userID, Metadata: auditMetadata{
+		"url":     url,
+		"purpose": input.Purpose,
+		"bytes":   len(clean),
+	}})
+
+	// Return success
+	return HasuraUploadResponse{URL: url, Variants: variants}, nil
 }
 
-func respondWithError(w http.ResponseWriter, status int, message, code string) {
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(HasuraErrorResponse{
-		Message: message,
-		Code:    code,
-	})
+// uploadFilename returns a unique name for a stored file with extension ext.
+func uploadFilename(ext string) string {
+	return fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
 }
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"foodrecipes/utils"
+)
+
+// JWKSHandler serves the public signing keys so Hasura can verify tokens
+// through jwk_url instead of sharing a secret with the backend.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jwks, err := utils.PublicJWKS()
+	if err != nil {
+		log.Printf("[JWKS] failed to load signing keys: %v", err)
+		http.Error(w, "signing keys unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	// Hasura refetches the key set when this expires, which bounds step 2 of key rotation.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks)
+}
@@ -0,0 +1,453 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LoginLimitPolicy configures progressive delays and lockout for one kind of key.
+type LoginLimitPolicy struct {
+	MaxFailures int           // failures that trigger a lockout
+	Lockout     time.Duration // how long a lockout lasts
+	BaseDelay   time.Duration // wait after the first failure, doubled on each further failure
+	MaxDelay    time.Duration // cap for the progressive delay
+	Window      time.Duration // failures older than this are forgotten
+}
+
+// LimitDecision tells the caller whether a login attempt may go ahead.
+type LimitDecision struct {
+	Allowed    bool
+	Locked     bool
+	Failures   int
+	RetryAfter time.Duration
+	// LocksOnFailure is set on an allowed attempt that locks the key if it
+	// fails: it is the last one before the lockout.
+	LocksOnFailure bool
+}
+
+// LoginLimiter stores login attempts per key (an email, a user or a client
+// IP). An attempt is reserved before the password or code is checked and
+// counts as a failure from then on, so parallel attempts cannot all get in
+// before the first failure is recorded.
+type LoginLimiter interface {
+	// Attempt reserves an attempt for key if the policy allows one.
+	Attempt(ctx context.Context, key string, policy LoginLimitPolicy) (LimitDecision, error)
+	// Release takes back a reserved attempt that succeeded. A lockout it
+	// triggered stays.
+	Release(ctx context.Context, key string) error
+	// Reset forgets every attempt of key.
+	Reset(ctx context.Context, key string) error
+	// Prune forgets keys that have been quiet for longer than maxAge.
+	Prune(ctx context.Context, maxAge time.Duration) error
+}
+
+type loginAttemptState struct {
+	Failures      int          `db:"failures"`
+	LastFailureAt time.Time    `db:"last_failure_at"`
+	LockedUntil   sql.NullTime `db:"locked_until"`
+}
+
+// decide applies the policy to the stored state of a key.
+func (p LoginLimitPolicy) decide(state loginAttemptState, now time.Time) LimitDecision {
+	if state.LockedUntil.Valid && now.Before(state.LockedUntil.Time) {
+		return LimitDecision{Locked: true, Failures: state.Failures, RetryAfter: state.LockedUntil.Time.Sub(now)}
+	}
+	if state.Failures == 0 || now.Sub(state.LastFailureAt) > p.Window {
+		return LimitDecision{Allowed: true}
+	}
+	if wait := state.LastFailureAt.Add(p.delay(state.Failures)).Sub(now); wait > 0 {
+		return LimitDecision{Failures: state.Failures, RetryAfter: wait}
+	}
+	return LimitDecision{Allowed: true, Failures: state.Failures}
+}
+
+// reserve counts an attempt against state when decide allows it.
+func (p LoginLimitPolicy) reserve(state *loginAttemptState, now time.Time) LimitDecision {
+	if d := p.decide(*state, now); !d.Allowed {
+		return d
+	}
+	if now.Sub(state.LastFailureAt) > p.Window {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailureAt = now
+	if state.Failures >= p.MaxFailures {
+		state.LockedUntil = sql.NullTime{Time: now.Add(p.Lockout), Valid: true}
+		state.Failures = 0
+		return LimitDecision{Allowed: true, LocksOnFailure: true}
+	}
+	return LimitDecision{Allowed: true, Failures: state.Failures}
+}
+
+func (p LoginLimitPolicy) delay(failures int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return d
+}
+
+// ==================== In-memory backend ====================
+
+// MemoryLoginLimiter keeps attempts in process memory. It is only correct
+// when a single backend replica handles all logins.
+type MemoryLoginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttemptState
+}
+
+func NewMemoryLoginLimiter() *MemoryLoginLimiter {
+	return &MemoryLoginLimiter{attempts: make(map[string]*loginAttemptState)}
+}
+
+func (m *MemoryLoginLimiter) Attempt(ctx context.Context, key string, policy LoginLimitPolicy) (LimitDecision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.attempts[key]
+	if !ok {
+		state = &loginAttemptState{}
+		m.attempts[key] = state
+	}
+	return policy.reserve(state, time.Now()), nil
+}
+
+func (m *MemoryLoginLimiter) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state, ok := m.attempts[key]; ok && state.Failures > 0 {
+		state.Failures--
+	}
+	return nil
+}
+
+func (m *MemoryLoginLimiter) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *MemoryLoginLimiter) Prune(ctx context.Context, maxAge time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, state := range m.attempts {
+		if now.Sub(state.LastFailureAt) > maxAge && (!state.LockedUntil.Valid || now.After(state.LockedUntil.Time)) {
+			delete(m.attempts, key)
+		}
+	}
+	return nil
+}
+
+// ==================== Postgres backend ====================
+
+// PostgresLoginLimiter keeps attempts in the login_attempts table so every
+// replica sees the same counters.
+type PostgresLoginLimiter struct {
+	db *sqlx.DB
+}
+
+func NewPostgresLoginLimiter(db *sqlx.DB) *PostgresLoginLimiter {
+	return &PostgresLoginLimiter{db: db}
+}
+
+// Attempt applies reserve in a single upsert, so the row lock serialises
+// parallel attempts. A refused attempt leaves the row alone and returns no
+// row; the state is then read to tell the caller how long to wait.
+func (p *PostgresLoginLimiter) Attempt(ctx context.Context, key string, policy LoginLimitPolicy) (LimitDecision, error) {
+	var state loginAttemptState
+	err := p.db.GetContext(ctx, &state, `
+		INSERT INTO login_attempts AS a (key, failures, last_failure_at, locked_until)
+		VALUES (
+			$1,
+			CASE WHEN $5 <= 1 THEN 0 ELSE 1 END,
+			CURRENT_TIMESTAMP,
+			CASE WHEN $5 <= 1 THEN CURRENT_TIMESTAMP + make_interval(secs => $6) END
+		)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+		        WHEN a.last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $2) THEN LEAST(1, $5 - 1)
+		        WHEN a.failures + 1 >= $5 THEN 0
+		        ELSE a.failures + 1
+		    END,
+		    locked_until = CASE
+		        WHEN a.last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $2) THEN
+		            CASE WHEN $5 <= 1 THEN CURRENT_TIMESTAMP + make_interval(secs => $6) END
+		        WHEN a.failures + 1 >= $5 THEN CURRENT_TIMESTAMP + make_interval(secs => $6)
+		        ELSE a.locked_until
+		    END,
+		    last_failure_at = CURRENT_TIMESTAMP
+		WHERE (a.locked_until IS NULL OR a.locked_until <= CURRENT_TIMESTAMP)
+		  AND (a.failures = 0
+		       OR a.last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+		       OR a.last_failure_at + make_interval(secs => LEAST($3 * power(2, a.failures - 1), $4)) <= CURRENT_TIMESTAMP)
+		RETURNING failures, last_failure_at, locked_until
+	`, key, policy.Window.Seconds(), policy.BaseDelay.Seconds(), policy.MaxDelay.Seconds(), policy.MaxFailures, policy.Lockout.Seconds())
+	if errors.Is(err, sql.ErrNoRows) {
+		err = p.db.GetContext(ctx, &state, `
+			SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = $1
+		`, key)
+		if err != nil {
+			return LimitDecision{}, err
+		}
+		d := policy.decide(state, time.Now())
+		// Allowed again in the meantime; refuse this one all the same
+		d.Allowed = false
+		return d, nil
+	}
+	if err != nil {
+		return LimitDecision{}, err
+	}
+	// The update only runs on an unlocked key, so a lock here was just set
+	if state.LockedUntil.Valid && state.LockedUntil.Time.After(time.Now()) {
+		return LimitDecision{Allowed: true, LocksOnFailure: true}, nil
+	}
+	return LimitDecision{Allowed: true, Failures: state.Failures}, nil
+}
+
+func (p *PostgresLoginLimiter) Release(ctx context.Context, key string) error {
+	_, err := p.db.ExecContext(ctx, `
+		UPDATE login_attempts SET failures = GREATEST(failures - 1, 0) WHERE key = $1
+	`, key)
+	return err
+}
+
+func (p *PostgresLoginLimiter) Reset(ctx context.Context, key string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
+
+func (p *PostgresLoginLimiter) Prune(ctx context.Context, maxAge time.Duration) error {
+	_, err := p.db.ExecContext(ctx, `
+		DELETE FROM login_attempts
+		WHERE last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		  AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+	`, maxAge.Seconds())
+	return err
+}
+
+// ==================== Login throttle ====================
+
+// LoginThrottle applies the limiter to both the submitted email and the client IP.
+type LoginThrottle struct {
+	limiter     LoginLimiter
+	emailPolicy LoginLimitPolicy
+	ipPolicy    LoginLimitPolicy
+	logger      *log.Logger
+}
+
+func NewLoginThrottle(limiter LoginLimiter, emailPolicy, ipPolicy LoginLimitPolicy, logger *log.Logger) *LoginThrottle {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &LoginThrottle{
+		limiter:     limiter,
+		emailPolicy: emailPolicy,
+		ipPolicy:    ipPolicy,
+		logger:      logger,
+	}
+}
+
+// NewLoginThrottleFromEnv builds the throttle from configuration
+// LOGIN_LIMITER_BACKEND: memory (default) or postgres
+// LOGIN_MAX_FAILURES: failures per email before lockout (default 5)
+// LOGIN_IP_MAX_FAILURES: failures per client IP before lockout (default 50)
+// LOGIN_LOCKOUT_MINUTES: lockout length (default 15)
+//
+// TRUSTED_PROXIES must be set: behind Hasura without it every request comes
+// from Hasura's address, and the per-IP counter would lock out everyone.
+func NewLoginThrottleFromEnv(db *sqlx.DB, logger *log.Logger) (*LoginThrottle, error) {
+	if strings.TrimSpace(getEnv("TRUSTED_PROXIES", "")) == "" {
+		return nil, errors.New(`TRUSTED_PROXIES is not set: list the networks of Hasura and any proxy in front of the backend, or set it to "none" if clients connect directly`)
+	}
+	var limiter LoginLimiter
+	switch strings.ToLower(getEnv("LOGIN_LIMITER_BACKEND", "memory")) {
+	case "memory":
+		limiter = NewMemoryLoginLimiter()
+	case "postgres":
+		limiter = NewPostgresLoginLimiter(db)
+	default:
+		return nil, fmt.Errorf("unknown LOGIN_LIMITER_BACKEND %q", getEnv("LOGIN_LIMITER_BACKEND", ""))
+	}
+
+	lockout := time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+	emailPolicy := LoginLimitPolicy{
+		MaxFailures: envInt("LOGIN_MAX_FAILURES", 5),
+		Lockout:     lockout,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		Window:      lockout,
+	}
+	ipPolicy := emailPolicy
+	ipPolicy.MaxFailures = envInt("LOGIN_IP_MAX_FAILURES", 50)
+	// An IP is shared by many users (NAT, campus Wi-Fi), so keep its delays short.
+	ipPolicy.MaxDelay = 5 * time.Second
+	return NewLoginThrottle(limiter, emailPolicy, ipPolicy, logger), nil
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(getEnv(key, "")); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+func emailLimitKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+func userLimitKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// LoginAttempt is an attempt reserved with LoginThrottle.Begin. Its
+// decision is the most restrictive of the account's and the IP's.
+type LoginAttempt struct {
+	LimitDecision
+	key, account, ip      string
+	locksAccount, locksIP bool
+}
+
+// Begin reserves a login attempt for the email and client IP. The caller
+// goes ahead only if the attempt is Allowed, and reports the outcome with
+// Success or Failure.
+func (t *LoginThrottle) Begin(ctx context.Context, email, ip string) (*LoginAttempt, error) {
+	return t.begin(ctx, emailLimitKey(email), "email="+maskEmail(email), ip)
+}
+
+// BeginForUser reserves a password check of a signed-in user, such as the
+// one before a password or email change. It shares the per-IP counter with
+// logins.
+func (t *LoginThrottle) BeginForUser(ctx context.Context, userID int, ip string) (*LoginAttempt, error) {
+	return t.begin(ctx, userLimitKey(userID), "user_id="+strconv.Itoa(userID), ip)
+}
+
+func (t *LoginThrottle) begin(ctx context.Context, key, account, ip string) (*LoginAttempt, error) {
+	accountDecision, err := t.limiter.Attempt(ctx, key, t.emailPolicy)
+	if err != nil {
+		return nil, err
+	}
+	attempt := &LoginAttempt{LimitDecision: accountDecision, key: key, account: account, ip: ip}
+	if !accountDecision.Allowed {
+		return attempt, nil
+	}
+	ipDecision, err := t.limiter.Attempt(ctx, ipLimitKey(ip), t.ipPolicy)
+	if err != nil || !ipDecision.Allowed {
+		// The attempt does not go ahead, so it must not count for the account
+		if releaseErr := t.limiter.Release(ctx, key); releaseErr != nil {
+			t.logger.Printf("[AUTH] failed to release login attempt: %v", releaseErr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	attempt.LimitDecision = stricterDecision(accountDecision, ipDecision)
+	attempt.locksAccount = accountDecision.LocksOnFailure
+	attempt.locksIP = ipDecision.LocksOnFailure
+	return attempt, nil
+}
+
+// Failure logs the lockouts a failed attempt triggers; the failure itself
+// was counted by Begin. A nil attempt (the limiter was unavailable) is
+// ignored.
+func (t *LoginThrottle) Failure(attempt *LoginAttempt) {
+	if attempt == nil {
+		return
+	}
+	if attempt.locksAccount {
+		t.logger.Printf("[AUTH] login lockout: %s ip=%s for %s", attempt.account, attempt.ip, t.emailPolicy.Lockout)
+	}
+	if attempt.locksIP {
+		t.logger.Printf("[AUTH] login lockout: ip=%s for %s", attempt.ip, t.ipPolicy.Lockout)
+	}
+}
+
+// Success clears the failure counter of the account. The IP counter only
+// gets the attempt back, so one valid account cannot be used to reset it.
+func (t *LoginThrottle) Success(ctx context.Context, attempt *LoginAttempt) {
+	if attempt == nil {
+		return
+	}
+	if err := t.limiter.Reset(ctx, attempt.key); err != nil {
+		t.logger.Printf("[AUTH] failed to reset login failures: %v", err)
+	}
+	if err := t.limiter.Release(ctx, ipLimitKey(attempt.ip)); err != nil {
+		t.logger.Printf("[AUTH] failed to release login attempt: %v", err)
+	}
+}
+
+// Cancel gives back an attempt that ended before the password was checked,
+// such as one refused for invalid input, so it counts for neither key.
+func (t *LoginThrottle) Cancel(ctx context.Context, attempt *LoginAttempt) {
+	if attempt == nil {
+		return
+	}
+	for _, key := range []string{attempt.key, ipLimitKey(attempt.ip)} {
+		if err := t.limiter.Release(ctx, key); err != nil {
+			t.logger.Printf("[AUTH] failed to release login attempt: %v", err)
+		}
+	}
+}
+
+// Run prunes counters that have been quiet for a full window and lockout
+// until ctx is cancelled.
+func (t *LoginThrottle) Run(ctx context.Context) {
+	maxAge := max(t.emailPolicy.Window+t.emailPolicy.Lockout, t.ipPolicy.Window+t.ipPolicy.Lockout)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := t.limiter.Prune(ctx, maxAge); err != nil {
+			t.logger.Printf("[AUTH] pruning login attempts failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func stricterDecision(a, b LimitDecision) LimitDecision {
+	if a.Allowed != b.Allowed {
+		if a.Allowed {
+			return b
+		}
+		return a
+	}
+	if a.Locked != b.Locked {
+		if a.Locked {
+			return a
+		}
+		return b
+	}
+	if b.RetryAfter > a.RetryAfter {
+		return b
+	}
+	return a
+}
+
+// maskEmail keeps enough of an address to correlate log lines without storing it.
+func maskEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
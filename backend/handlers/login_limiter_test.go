@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+var testPolicy = LoginLimitPolicy{
+	MaxFailures: 3,
+	Lockout:     15 * time.Minute,
+	BaseDelay:   time.Second,
+	MaxDelay:    4 * time.Second,
+	Window:      time.Hour,
+}
+
+func TestLoginLimitPolicyDecide(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state loginAttemptState
+		want  LimitDecision
+	}{
+		{"no failures", loginAttemptState{}, LimitDecision{Allowed: true}},
+		{"inside the delay", loginAttemptState{Failures: 1, LastFailureAt: now.Add(-400 * time.Millisecond)},
+			LimitDecision{Failures: 1, RetryAfter: 600 * time.Millisecond}},
+		{"after the delay", loginAttemptState{Failures: 1, LastFailureAt: now.Add(-time.Second)},
+			LimitDecision{Allowed: true, Failures: 1}},
+		{"delay doubles", loginAttemptState{Failures: 2, LastFailureAt: now.Add(-time.Second)},
+			LimitDecision{Failures: 2, RetryAfter: time.Second}},
+		{"delay is capped", loginAttemptState{Failures: 10, LastFailureAt: now.Add(-time.Second)},
+			LimitDecision{Failures: 10, RetryAfter: 3 * time.Second}},
+		{"failures outside the window", loginAttemptState{Failures: 2, LastFailureAt: now.Add(-2 * time.Hour)},
+			LimitDecision{Allowed: true}},
+		{"locked", loginAttemptState{LockedUntil: sql.NullTime{Time: now.Add(time.Minute), Valid: true}},
+			LimitDecision{Locked: true, RetryAfter: time.Minute}},
+		{"lockout over", loginAttemptState{LockedUntil: sql.NullTime{Time: now.Add(-time.Minute), Valid: true}},
+			LimitDecision{Allowed: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testPolicy.decide(tt.state, now); got != tt.want {
+				t.Errorf("decide = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginLimitPolicyReserve(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	var state loginAttemptState
+
+	// Each reserved attempt counts as a failure straight away.
+	steps := []struct {
+		after time.Duration
+		want  LimitDecision
+	}{
+		{0, LimitDecision{Allowed: true, Failures: 1}},
+		{0, LimitDecision{Failures: 1, RetryAfter: time.Second}}, // a parallel attempt is refused
+		{time.Second, LimitDecision{Allowed: true, Failures: 2}},
+		{2 * time.Second, LimitDecision{Allowed: true, LocksOnFailure: true}},
+		{time.Minute, LimitDecision{Locked: true, RetryAfter: 15*time.Minute - time.Minute}},
+		{15 * time.Minute, LimitDecision{Allowed: true, Failures: 1}},
+	}
+	elapsed := time.Duration(0)
+	for i, step := range steps {
+		elapsed += step.after
+		if got := testPolicy.reserve(&state, now.Add(elapsed)); got != step.want {
+			t.Errorf("attempt %d: reserve = %+v, want %+v", i+1, got, step.want)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ctx := context.Background()
+	quiet := log.New(io.Discard, "", 0)
+	noDelay := testPolicy
+	noDelay.BaseDelay, noDelay.MaxDelay = 0, 0
+
+	t.Run("success clears the account", func(t *testing.T) {
+		throttle := NewLoginThrottle(NewMemoryLoginLimiter(), noDelay, noDelay, quiet)
+		for i := 0; i < 2; i++ {
+			attempt, _ := throttle.Begin(ctx, "a@example.com", "192.0.2.1")
+			throttle.Failure(attempt)
+		}
+		attempt, _ := throttle.Begin(ctx, "A@example.com ", "192.0.2.1")
+		if !attempt.Allowed || !attempt.LocksOnFailure {
+			t.Fatalf("third attempt = %+v, want allowed and locking", attempt.LimitDecision)
+		}
+		throttle.Success(ctx, attempt)
+		// The lockout the third attempt set in advance is lifted too.
+		attempt, _ = throttle.Begin(ctx, "a@example.com", "192.0.2.2")
+		if want := (LimitDecision{Allowed: true, Failures: 1}); attempt.LimitDecision != want {
+			t.Errorf("attempt after success = %+v, want %+v", attempt.LimitDecision, want)
+		}
+	})
+
+	t.Run("lockout", func(t *testing.T) {
+		throttle := NewLoginThrottle(NewMemoryLoginLimiter(), noDelay, noDelay, quiet)
+		for i := 0; i < noDelay.MaxFailures; i++ {
+			attempt, _ := throttle.Begin(ctx, "b@example.com", "192.0.2.1")
+			if !attempt.Allowed {
+				t.Fatalf("attempt %d refused: %+v", i+1, attempt.LimitDecision)
+			}
+			throttle.Failure(attempt)
+		}
+		attempt, _ := throttle.Begin(ctx, "b@example.com", "192.0.2.9")
+		if attempt.Allowed || !attempt.Locked {
+			t.Errorf("attempt after lockout = %+v, want locked", attempt.LimitDecision)
+		}
+	})
+
+	t.Run("cancel gives the attempt back", func(t *testing.T) {
+		throttle := NewLoginThrottle(NewMemoryLoginLimiter(), noDelay, noDelay, quiet)
+		for i := 0; i < noDelay.MaxFailures+2; i++ {
+			attempt, _ := throttle.BeginForUser(ctx, 7, "192.0.2.1")
+			if !attempt.Allowed {
+				t.Fatalf("attempt %d refused: %+v", i+1, attempt.LimitDecision)
+			}
+			throttle.Cancel(ctx, attempt)
+		}
+	})
+
+	t.Run("refused IP does not count for the account", func(t *testing.T) {
+		strictIP := noDelay
+		strictIP.MaxFailures = 1
+		throttle := NewLoginThrottle(NewMemoryLoginLimiter(), noDelay, strictIP, quiet)
+		attempt, _ := throttle.Begin(ctx, "c@example.com", "192.0.2.1")
+		throttle.Failure(attempt)
+		for i := 0; i < noDelay.MaxFailures; i++ {
+			if attempt, _ := throttle.Begin(ctx, "c@example.com", "192.0.2.1"); attempt.Allowed {
+				t.Fatalf("attempt from locked IP allowed")
+			}
+		}
+		// One failure so far, so two more attempts from elsewhere are allowed.
+		attempt, _ = throttle.Begin(ctx, "c@example.com", "192.0.2.2")
+		if !attempt.Allowed || attempt.LocksOnFailure {
+			t.Errorf("attempt from another IP = %+v, want allowed without lockout", attempt.LimitDecision)
+		}
+	})
+}
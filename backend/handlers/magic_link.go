@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+)
+
+var errMagicLinkInvalid = errors.New("login link is invalid or expired")
+
+// magicLinkInterval is the minimum gap between login links for one account.
+const magicLinkInterval = time.Minute
+
+// magicLinkTTL returns how long a login link stays valid
+// Default: 10 minutes
+// Can be overridden with MAGIC_LINK_TOKEN_MINUTES environment variable
+func magicLinkTTL() time.Duration {
+	return time.Duration(envInt("MAGIC_LINK_TOKEN_MINUTES", 10)) * time.Minute
+}
+
+// RequestMagicLink mails a one-time login link when the email belongs to an
+// account. Like RequestPasswordReset it reports success either way.
+func (s *AccountService) RequestMagicLink(email, requestIP string) error {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return nil
+	}
+
+	var user struct {
+		ID         int          `db:"id"`
+		Name       string       `db:"name"`
+		Email      string       `db:"email"`
+		LastSentAt sql.NullTime `db:"last_sent_at"`
+	}
+	err := s.db.Get(&user, `
+		SELECT u.id, u.name, u.email,
+		       (SELECT MAX(created_at) FROM magic_link_tokens t WHERE t.user_id = u.id) AS last_sent_at
+		FROM users u WHERE u.email = $1
+	`, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Quietly drop repeats so the action cannot be used to flood an inbox.
+	if user.LastSentAt.Valid && time.Since(user.LastSentAt.Time) < magicLinkInterval {
+		return nil
+	}
+
+	token, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return err
+	}
+	link, err := s.emailLink("/magic-login", token)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the newest link is valid.
+	if _, err := tx.Exec(`DELETE FROM magic_link_tokens WHERE user_id = $1 AND used_at IS NULL`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO magic_link_tokens (user_id, email, token_hash, expires_at, requested_ip)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+	`, user.ID, user.Email, utils.HashToken(token), time.Now().Add(magicLinkTTL()), requestIP); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	msg := utils.MailMessage{
+		To:      user.Email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nOpen the link below to sign in:\n\n%s\n\nThe link works once and expires in %d minutes. If you did not ask for it, you can ignore this email.\n",
+			firstNameFromUserName(user.Name),
+			link,
+			int(magicLinkTTL().Minutes()),
+		),
+	}
+	// Send in the background so response timing does not reveal whether the email exists.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			s.logger.Printf("failed to send login link to user_id=%d: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ConsumeMagicLink burns a login link and returns the user it signs in. The
+// link only works while the account still has the address it was sent to.
+func (s *AccountService) ConsumeMagicLink(token string) (models.User, error) {
+	var user models.User
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return user, errMagicLinkInvalid
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	var row struct {
+		ID     int64  `db:"id"`
+		UserID int    `db:"user_id"`
+		Email  string `db:"email"`
+	}
+	err = tx.Get(&row, `
+		UPDATE magic_link_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING id, user_id, email
+	`, utils.HashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, errMagicLinkInvalid
+	}
+	if err != nil {
+		return user, err
+	}
+
+	// Opening the link proves control of the address, so it also verifies it.
+	err = tx.Get(&user, `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND email = $2
+		RETURNING id, name, email, COALESCE(avatar_url, '') AS avatar_url, email_verified_at
+	`, row.UserID, row.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, errMagicLinkInvalid
+	}
+	if err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+// ==================== Request/Response Types ====================
+
+type RequestMagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type ConsumeMagicLinkRequest struct {
+	Token       string `json:"token"`
+	DeviceLabel string `json:"device_label"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// RequestMagicLinkAction handles the request_magic_link action from Hasura.
+func RequestMagicLinkAction(svc *AccountService) ActionFunc[RequestMagicLinkRequest, AccountActionResponse] {
+	return func(ctx context.Context, s Session, req RequestMagicLinkRequest) (AccountActionResponse, error) {
+		if err := svc.RequestMagicLink(req.Email, clientIP(s.Request)); err != nil {
+			svc.logger.Printf("login link request failed: %v", err)
+		}
+
+		return AccountActionResponse{
+			Success: true,
+			Message: "If an account exists for this email, a sign-in link has been sent",
+		}, nil
+	}
+}
+
+// ConsumeMagicLinkAction handles the consume_magic_link action from Hasura.
+// It answers like the login action, including the 2FA challenge.
+func ConsumeMagicLinkAction(svc *AccountService) ActionFunc[ConsumeMagicLinkRequest, *HasuraLoginResponse] {
+	return func(ctx context.Context, s Session, req ConsumeMagicLinkRequest) (*HasuraLoginResponse, error) {
+		user, err := svc.ConsumeMagicLink(req.Token)
+		switch {
+		case errors.Is(err, errMagicLinkInvalid):
+			logAuditEvent(s.Request, auditEntry{Action: auditLoginFailed, Metadata: auditMetadata{"method": "magic_link", "reason": "invalid_link"}})
+			return nil, newActionError(codeInvalidMagicLink)
+		case err != nil:
+			svc.logger.Printf("login link failed: %v", err)
+			return nil, internalError()
+		}
+		return completeLogin(s, user, req.DeviceLabel, "magic_link")
+	}
+}
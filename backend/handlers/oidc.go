@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// oidcStateTTL is how long a user has to finish signing in at the provider.
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	errUnknownProvider    = errors.New("unknown identity provider")
+	errOIDCStateInvalid   = errors.New("login state is invalid or expired")
+	errOIDCEmailMissing   = errors.New("identity provider did not return an email address")
+	errOIDCExchangeFailed = errors.New("identity provider rejected the login")
+)
+
+// ==================== Service Layer ====================
+
+// OIDCService runs the authorization-code flow with PKCE against the
+// configured OpenID Connect providers.
+type OIDCService struct {
+	db        *sqlx.DB
+	providers map[string]*utils.OIDCProvider
+	logger    *log.Logger
+}
+
+func NewOIDCService(db *sqlx.DB, providers map[string]*utils.OIDCProvider, logger *log.Logger) *OIDCService {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &OIDCService{db: db, providers: providers, logger: logger}
+}
+
+func (s *OIDCService) redirectURL(p *utils.OIDCProvider, urlBuilder *URLBuilder) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	return urlBuilder.FrontendURL("/auth/callback/"+p.Name, nil)
+}
+
+// Start records a new login attempt and returns the provider URL to send
+// the browser to, and the binding the same browser must present to Finish.
+// The state in the URL comes back through the browser's address bar, where
+// anyone can plant one; the binding never leaves the browser that started.
+func (s *OIDCService) Start(ctx context.Context, providerName, deviceLabel string, urlBuilder *URLBuilder) (authURL, binding string, err error) {
+	p, ok := s.providers[strings.ToLower(strings.TrimSpace(providerName))]
+	if !ok {
+		return "", "", errUnknownProvider
+	}
+	state, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err = utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, challenge, err := utils.NewPKCEVerifier()
+	if err != nil {
+		return "", "", err
+	}
+	redirectURL := s.redirectURL(p, urlBuilder)
+
+	authURL, err = p.AuthCodeURL(ctx, redirectURL, state, nonce, challenge)
+	if err != nil {
+		return "", "", err
+	}
+	// Drop abandoned attempts while we are here.
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		s.logger.Printf("[AUTH] pruning oidc states failed: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO oidc_login_states (state_hash, binding_hash, provider, code_verifier, nonce, redirect_url, device_label, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)
+	`, utils.HashToken(state), utils.HashToken(binding), p.Name, verifier, nonce, redirectURL, truncate(deviceLabel, 255), time.Now().Add(oidcStateTTL))
+	if err != nil {
+		return "", "", err
+	}
+	return authURL, binding, nil
+}
+
+// Finish redeems the code returned to the redirect page and resolves the
+// local user, creating or linking one when needed. binding must be the one
+// Start returned for this state.
+func (s *OIDCService) Finish(ctx context.Context, state, binding, code string) (models.User, string, error) {
+	var row struct {
+		Provider     string         `db:"provider"`
+		CodeVerifier string         `db:"code_verifier"`
+		Nonce        string         `db:"nonce"`
+		RedirectURL  string         `db:"redirect_url"`
+		DeviceLabel  sql.NullString `db:"device_label"`
+	}
+	// Deleting the row makes each state single-use.
+	err := s.db.GetContext(ctx, &row, `
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND binding_hash = $2 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING provider, code_verifier, nonce, redirect_url, device_label
+	`, utils.HashToken(strings.TrimSpace(state)), utils.HashToken(strings.TrimSpace(binding)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, "", errOIDCStateInvalid
+	}
+	if err != nil {
+		return models.User{}, "", err
+	}
+	p, ok := s.providers[row.Provider]
+	if !ok {
+		return models.User{}, "", errUnknownProvider
+	}
+
+	identity, err := p.Exchange(ctx, row.RedirectURL, code, row.CodeVerifier, row.Nonce)
+	if err != nil {
+		s.logger.Printf("[AUTH] oidc exchange with %s failed: %v", p.Name, err)
+		return models.User{}, "", errOIDCExchangeFailed
+	}
+	user, err := s.resolveUser(ctx, p, identity)
+	return user, row.DeviceLabel.String, err
+}
+
+// resolveUser maps a provider identity to a local account:
+//  1. an identity linked before signs in to its account;
+//  2. otherwise, if the provider has LinkByEmail, a verified email matching
+//     an account links to it;
+//  3. otherwise a new account is created, unless the email is taken.
+func (s *OIDCService) resolveUser(ctx context.Context, p *utils.OIDCProvider, id *utils.OIDCIdentity) (models.User, error) {
+	provider := p.Name
+	var user models.User
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	const userColumns = `id, name, email, COALESCE(avatar_url, '') AS avatar_url, email_verified_at`
+
+	err = tx.Get(&user, `
+		SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)
+	`, provider, id.Subject)
+	switch {
+	case err == nil:
+		// Known identity.
+	case !errors.Is(err, sql.ErrNoRows):
+		return user, err
+	case id.Email == "":
+		return user, errOIDCEmailMissing
+	default:
+		var existing struct {
+			models.User
+			Verified bool `db:"verified"`
+		}
+		err = tx.Get(&existing, `
+			SELECT `+userColumns+`, email_verified_at IS NOT NULL AS verified
+			FROM users WHERE LOWER(email) = LOWER($1)
+			FOR UPDATE
+		`, id.Email)
+		switch {
+		case err == nil && id.EmailVerified && p.LinkByEmail:
+			user = existing.User
+			if !existing.Verified {
+				// Whoever registered this unverified account may not own the
+				// address: drop their password and sessions before linking.
+				if _, err := tx.Exec(`UPDATE users SET password = '', email_verified_at = CURRENT_TIMESTAMP WHERE id = $1`, user.ID); err != nil {
+					return user, err
+				}
+				if _, err := revokeOtherSessions(tx, user.ID, ""); err != nil {
+					return user, err
+				}
+				now := time.Now()
+				user.EmailVerifiedAt = &now
+			}
+			s.logger.Printf("[AUTH] linked %s identity to user_id=%d", provider, user.ID)
+		case err == nil:
+			// The address is taken and the provider does not vouch for it,
+			// or is not trusted to.
+			return user, errEmailTaken
+		case !errors.Is(err, sql.ErrNoRows):
+			return user, err
+		default:
+			name := strings.TrimSpace(id.Name)
+			if name == "" {
+				name = id.Email[:strings.Index(id.Email+"@", "@")]
+			}
+			// Accounts created here have no password; the password reset
+			// flow can add one later.
+			err = tx.Get(&user, `
+				INSERT INTO users (name, email, password, email_verified_at)
+				VALUES ($1, $2, '', CASE WHEN $3 THEN CURRENT_TIMESTAMP END)
+				RETURNING `+userColumns, truncate(name, maxNameLength), id.Email, id.EmailVerified)
+			if isUniqueViolation(err) {
+				return user, errEmailTaken
+			}
+			if err != nil {
+				return user, err
+			}
+			s.logger.Printf("[AUTH] created user_id=%d from %s identity", user.ID, provider)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, NULLIF($4, ''))
+		`, provider, id.Subject, user.ID, id.Email); err != nil {
+			return user, err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP WHERE provider = $1 AND subject = $2
+	`, provider, id.Subject); err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+// ==================== Request/Response Types ====================
+
+type OIDCStartRequest struct {
+	Provider    string `json:"provider"`
+	DeviceLabel string `json:"device_label"`
+}
+
+// OIDCStartResponse carries the provider URL and a browser binding. The
+// frontend keeps the binding in sessionStorage and sends it back with the
+// callback; a callback without the matching binding is refused.
+type OIDCStartResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	BrowserBinding   string `json:"browser_binding"`
+}
+
+type OIDCCallbackRequest struct {
+	State          string `json:"state"`
+	Code           string `json:"code"`
+	BrowserBinding string `json:"browser_binding"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// OIDCStartAction handles the oidc_start action from Hasura.
+func OIDCStartAction(svc *OIDCService) ActionFunc[OIDCStartRequest, OIDCStartResponse] {
+	return func(ctx context.Context, s Session, req OIDCStartRequest) (OIDCStartResponse, error) {
+		if req.Provider == "" {
+			return OIDCStartResponse{}, missingFields("provider")
+		}
+
+		authURL, binding, err := svc.Start(ctx, req.Provider, req.DeviceLabel, NewURLBuilder(s.Request))
+		switch {
+		case errors.Is(err, errUnknownProvider):
+			return OIDCStartResponse{}, newActionError(codeUnknownProvider)
+		case err != nil:
+			svc.logger.Printf("[AUTH] oidc start failed: %v", err)
+			return OIDCStartResponse{}, newActionError(codeProviderUnavailable)
+		}
+		return OIDCStartResponse{AuthorizationURL: authURL, BrowserBinding: binding}, nil
+	}
+}
+
+// OIDCCallbackAction handles the oidc_callback action from Hasura. The
+// frontend calls it with the state and code from the redirect and the
+// binding it kept from oidc_start; it answers like the login action.
+func OIDCCallbackAction(svc *OIDCService) ActionFunc[OIDCCallbackRequest, *HasuraLoginResponse] {
+	return func(ctx context.Context, s Session, req OIDCCallbackRequest) (*HasuraLoginResponse, error) {
+		if req.State == "" || req.Code == "" || req.BrowserBinding == "" {
+			return nil, missingFields("state", "code", "browser_binding")
+		}
+
+		user, deviceLabel, err := svc.Finish(ctx, req.State, req.BrowserBinding, req.Code)
+		switch {
+		case errors.Is(err, errOIDCStateInvalid), errors.Is(err, errUnknownProvider):
+			return nil, newActionError(codeInvalidOIDCState)
+		case errors.Is(err, errOIDCExchangeFailed):
+			logAuditEvent(s.Request, auditEntry{Action: auditLoginFailed, Metadata: auditMetadata{"method": "oidc", "reason": "provider_rejected"}})
+			return nil, newActionError(codeOIDCLoginFailed)
+		case errors.Is(err, errOIDCEmailMissing):
+			return nil, newActionError(codeOIDCEmailRequired)
+		case errors.Is(err, errEmailTaken):
+			return nil, newActionError(codeEmailExists)
+		case err != nil:
+			svc.logger.Printf("[AUTH] oidc login failed: %v", err)
+			return nil, internalError()
+		}
+		return completeLogin(s, user, deviceLabel, "oidc")
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"foodrecipes/models"
+)
+
+// Partner API (/api/v1). Every route is wrapped in APIKeyService.RequireAPIKey,
+// which puts the authenticated key in the request context.
+
+const (
+	partnerPageSize    = 20
+	partnerMaxPageSize = 100
+)
+
+type PartnerRecipe struct {
+	ID                   int       `db:"id" json:"id"`
+	CategoryID           int       `db:"category_id" json:"category_id"`
+	Title                string    `db:"title" json:"title"`
+	Description          string    `db:"description" json:"description"`
+	PreparationTime      int       `db:"preparation_time" json:"preparation_time"`
+	Price                float64   `db:"price" json:"price"`
+	ThumbnailURL         string    `db:"thumbnail_url" json:"thumbnail_url"`
+	ThumbnailCardURL     string    `db:"thumbnail_card_url" json:"thumbnail_card_url"`
+	ThumbnailPlaceholder string    `db:"thumbnail_placeholder" json:"thumbnail_placeholder"`
+	CreatedAt            time.Time `db:"created_at" json:"created_at"`
+}
+
+type PartnerRecipesResponse struct {
+	Recipes []PartnerRecipe `json:"recipes"`
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+}
+
+func queryInt(r *http.Request, name string, fallback int) int {
+	if v, err := strconv.Atoi(r.URL.Query().Get(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+// PartnerRecipesHandler serves GET /api/v1/recipes. It lists recipe summaries;
+// paid recipe content stays behind purchases. While
+// require_verified_email_for_publish is on (V14), recipes whose owner has not
+// verified their address are left out, the same rule that gates publishing.
+func PartnerRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeActionError(w, r, newActionError(codeMethodNotAllowed))
+		return
+	}
+	limit := queryInt(r, "limit", partnerPageSize)
+	if limit == 0 || limit > partnerMaxPageSize {
+		limit = partnerMaxPageSize
+	}
+	offset := queryInt(r, "offset", 0)
+	categoryID := queryInt(r, "category_id", 0)
+
+	recipes := []PartnerRecipe{}
+	err := DB.Select(&recipes, `
+		SELECT id, COALESCE(category_id, 0) AS category_id, title, COALESCE(description, '') AS description,
+		       COALESCE(preparation_time, 0) AS preparation_time, COALESCE(price, 0) AS price,
+		       COALESCE(thumbnail_url, '') AS thumbnail_url,
+		       COALESCE(thumbnail_card_url, thumbnail_url, '') AS thumbnail_card_url,
+		       COALESCE(thumbnail_placeholder, '') AS thumbnail_placeholder, created_at
+		FROM recipes
+		WHERE ($1 = 0 OR category_id = $1)
+		  AND (NOT app_setting_enabled('require_verified_email_for_publish') OR EXISTS (
+		      SELECT 1 FROM users u WHERE u.id = recipes.user_id AND u.email_verified_at IS NOT NULL
+		  ))
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`, categoryID, limit, offset)
+	if err != nil {
+		log.Printf("partner recipes query failed: %v", err)
+		writeActionError(w, r, internalError())
+		return
+	}
+	json.NewEncoder(w).Encode(PartnerRecipesResponse{Recipes: recipes, Limit: limit, Offset: offset})
+}
+
+// PartnerCategoriesHandler serves GET /api/v1/categories.
+func PartnerCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeActionError(w, r, newActionError(codeMethodNotAllowed))
+		return
+	}
+	categories := []models.Category{}
+	if err := DB.Select(&categories, `SELECT id, name, COALESCE(image_url, '') AS image_url FROM categories ORDER BY name`); err != nil {
+		log.Printf("partner categories query failed: %v", err)
+		writeActionError(w, r, internalError())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"categories": categories})
+}
+
+// PartnerPurchasesHandler serves POST /api/v1/purchases. The purchase is made
+// on behalf of the key's owner, through the same flow as the Hasura action.
+func PartnerPurchasesHandler(svc *PaymentService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeActionError(w, r, newActionError(codeMethodNotAllowed))
+			return
+		}
+		key := apiKeyFromContext(r.Context())
+		if key == nil {
+			writeActionError(w, r, newActionError(codeAPIKeyRequired))
+			return
+		}
+
+		var req InitializePaymentRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeActionError(w, r, newActionError(codeInvalidJSON))
+			return
+		}
+		result, err := svc.InitializePayment(key.UserID, &req, NewURLBuilder(r))
+		if err != nil {
+			writeActionError(w, r, paymentError(svc.logger, err))
+			return
+		}
+		metadata := paymentAuditMetadata(req.RecipeID, result.TxRef, result.Status)
+		metadata["api_key_id"] = key.ID
+		logAuditEvent(r, auditEntry{Action: auditPaymentInitialized, ActorID: key.UserID, Metadata: metadata})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -20,7 +22,19 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound                = errors.New("not found")
+	errPaymentFieldsMissing    = errors.New("amount and recipe_id are required")
+	errPaymentReferenceMissing = errors.New("tx_ref or recipe_id is required")
+	errInvalidAmount           = errors.New("invalid amount")
+	errUserNotFound            = errors.New("user not found")
+	errRecipeNotFound          = errors.New("recipe not found")
+	// errPaymentProvider wraps failures talking to Chapa.
+	errPaymentProvider = errors.New("payment provider error")
+	// Webhook rejections, recorded in the audit log by reason only.
+	errWebhookSignature = errors.New("invalid signature")
+	errWebhookPayload   = errors.New("invalid callback data")
+)
 
 // ==================== Configuration & Helpers ====================
 
@@ -97,6 +111,22 @@ func (b *URLBuilder) ConfirmRedirectURL(recipeID int, txRef, status, message str
 	return fmt.Sprintf("%s/payment/success?%s", b.frontendURL, q.Encode())
 }
 
+// FrontendURL builds a link to a frontend page, e.g. for emails.
+func (b *URLBuilder) FrontendURL(path string, q url.Values) string {
+	if len(q) == 0 {
+		return b.frontendURL + path
+	}
+	return fmt.Sprintf("%s%s?%s", b.frontendURL, path, q.Encode())
+}
+
+// APIURL builds a link to a backend endpoint.
+func (b *URLBuilder) APIURL(path string, q url.Values) string {
+	if len(q) == 0 {
+		return b.apiURL + path
+	}
+	return fmt.Sprintf("%s%s?%s", b.apiURL, path, q.Encode())
+}
+
 func getRequestBaseURL(r *http.Request) string {
 	if r == nil {
 		return ""
@@ -139,38 +169,6 @@ func normalizePurchaseStatus(s string) string {
 	}
 }
 
-// parseHasuraInput extracts the action input from a Hasura Action request.
-// It supports both direct {"input": {...}} and wrapped {"input": {"arg": {...}}} formats.
-func parseHasuraInput[T any](body []byte) (T, map[string]interface{}, error) {
-	var zero T
-	var envelope struct {
-		Input            json.RawMessage        `json:"input"`
-		SessionVariables map[string]interface{} `json:"session_variables"`
-	}
-	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Input) == 0 {
-		return zero, nil, fmt.Errorf("invalid hasura action payload")
-	}
-
-	// Try wrapped format: {"arg": {...}}
-	var argWrapper struct {
-		Arg json.RawMessage `json:"arg"`
-	}
-	if err := json.Unmarshal(envelope.Input, &argWrapper); err == nil && len(argWrapper.Arg) > 0 && string(argWrapper.Arg) != "null" {
-		var fromArg T
-		if err := json.Unmarshal(argWrapper.Arg, &fromArg); err == nil {
-			return fromArg, envelope.SessionVariables, nil
-		}
-	}
-
-	// Try direct format
-	var direct T
-	if err := json.Unmarshal(envelope.Input, &direct); err == nil {
-		return direct, envelope.SessionVariables, nil
-	}
-
-	return zero, nil, fmt.Errorf("invalid hasura action input")
-}
-
 // getUserIDFromSession extracts the user ID from Hasura session variables.
 func getUserIDFromSession(session map[string]interface{}) (int, error) {
 	raw, ok := session["x-hasura-user-id"]
@@ -213,7 +211,8 @@ func NewPaymentService(db *sqlx.DB, chapaCfg ChapaConfig, logger *log.Logger) *P
 // InitializePayment starts a new payment or resumes an existing pending one.
 func (s *PaymentService) InitializePayment(userID int, req *InitializePaymentRequest, urlBuilder *URLBuilder) (*InitializeResult, error) {
 	// Validate input
-	if err := s.validateInitializeRequest(userID, req); err != nil {
+	payerEmail, err := s.validateInitializeRequest(userID, req)
+	if err != nil {
 		return nil, err
 	}
 
@@ -247,7 +246,7 @@ func (s *PaymentService) InitializePayment(userID int, req *InitializePaymentReq
 	chapaReq := &ChapaInitializeRequest{
 		Amount:    req.Amount,
 		Currency:  "ETB",
-		Email:     req.Email,
+		Email:     payerEmail,
 		FirstName: firstNameFromUserName(req.UserName),
 		LastName:  "",
 		TxRef:     txRef,
@@ -301,13 +300,13 @@ func (s *PaymentService) VerifyPayment(userID int, txRef string, recipeID int) (
 		}
 	}
 	if txRef == "" {
-		return nil, fmt.Errorf("tx_ref or recipe_id is required")
+		return nil, errPaymentReferenceMissing
 	}
 
 	// Verify with Chapa
 	status, amount, message, err := s.verifyChapaTransaction(txRef)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %v", errPaymentProvider, message, err)
 	}
 	s.logger.Printf("[PAYMENT VERIFY] tx_ref=%s recipe_id=%d chapa_status=%s amount=%.2f", txRef, recipeID, status, amount)
 
@@ -318,7 +317,7 @@ func (s *PaymentService) VerifyPayment(userID int, txRef string, recipeID int) (
 		}
 	}
 	if recipeID == 0 {
-		return nil, fmt.Errorf("unable to determine recipe_id")
+		return nil, errPaymentReferenceMissing
 	}
 
 	// Update or insert purchase record
@@ -373,7 +372,7 @@ func (s *PaymentService) ConfirmPayment(txRef string, urlBuilder *URLBuilder) (r
 func (s *PaymentService) HandleWebhook(body []byte, signature string) error {
 	// Verify signature
 	if !s.verifyWebhookSignature(body, signature) {
-		return fmt.Errorf("invalid signature")
+		return errWebhookSignature
 	}
 
 	var callback struct {
@@ -385,7 +384,7 @@ func (s *PaymentService) HandleWebhook(body []byte, signature string) error {
 		} `json:"data"`
 	}
 	if err := json.Unmarshal(body, &callback); err != nil {
-		return fmt.Errorf("invalid callback data: %v", err)
+		return fmt.Errorf("%w: %v", errWebhookPayload, err)
 	}
 	if callback.TxRef == "" {
 		return nil // ignore if no tx_ref
@@ -409,32 +408,39 @@ func (s *PaymentService) HandleWebhook(body []byte, signature string) error {
 
 // ==================== Internal helpers ====================
 
-func (s *PaymentService) validateInitializeRequest(userID int, req *InitializePaymentRequest) error {
-	if req.Amount == "" || req.Email == "" || req.RecipeID == 0 {
-		return fmt.Errorf("missing required fields")
-	}
-	if !strings.Contains(req.Email, "@") {
-		return fmt.Errorf("invalid email")
+// validateInitializeRequest checks the request and returns the account's
+// email, which is the one sent to Chapa; the email in the request is ignored
+// so a payment cannot be made out to an address the user has not verified.
+func (s *PaymentService) validateInitializeRequest(userID int, req *InitializePaymentRequest) (string, error) {
+	if req.Amount == "" || req.RecipeID == 0 {
+		return "", errPaymentFieldsMissing
 	}
 	amount, err := strconv.ParseFloat(req.Amount, 64)
 	if err != nil || amount <= 0 {
-		return fmt.Errorf("invalid amount")
+		return "", errInvalidAmount
 	}
-	// Check user exists
-	var exists bool
-	if err := s.db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID); err != nil {
-		return fmt.Errorf("failed to validate user: %v", err)
+	var email string
+	err = s.db.Get(&email, `SELECT email FROM users WHERE id = $1`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errUserNotFound
 	}
-	if !exists {
-		return fmt.Errorf("user not found")
+	if err != nil {
+		return "", fmt.Errorf("failed to validate user: %w", err)
 	}
+	if err := requireVerifiedEmail(s.db, userID, settingVerifiedEmailForCheckout); err != nil {
+		if errors.Is(err, ErrEmailNotVerified) {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to validate user: %w", err)
+	}
+	var exists bool
 	if err := s.db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM recipes WHERE id = $1)`, req.RecipeID); err != nil {
-		return fmt.Errorf("failed to validate recipe: %v", err)
+		return "", fmt.Errorf("failed to validate recipe: %w", err)
 	}
 	if !exists {
-		return fmt.Errorf("recipe not found")
+		return "", errRecipeNotFound
 	}
-	return nil
+	return email, nil
 }
 
 type purchaseInfo struct {
@@ -514,25 +520,25 @@ func (s *PaymentService) callChapaInitialize(req *ChapaInitializeRequest) (*Chap
 	data, _ := json.Marshal(req)
 	httpReq, err := http.NewRequest("POST", s.chapaCfg.BaseURL+"/transaction/initialize", bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return nil, fmt.Errorf("%w: failed to create request: %v", errPaymentProvider, err)
 	}
 	httpReq.Header.Set("Authorization", "Bearer "+s.chapaCfg.SecretKey)
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	resp, err := s.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call Chapa: %v", err)
+		return nil, fmt.Errorf("%w: failed to call Chapa: %v", errPaymentProvider, err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 	var chapaResp ChapaInitializeResponse
 	if err := json.Unmarshal(body, &chapaResp); err != nil {
-		return nil, fmt.Errorf("failed to parse Chapa response: %v", err)
+		return nil, fmt.Errorf("%w: failed to parse Chapa response: %v", errPaymentProvider, err)
 	}
 	if chapaResp.Status != "success" || chapaResp.Data.CheckoutURL == "" {
 		msg := stringFromAny(chapaResp.Message)
-		return nil, fmt.Errorf("Chapa initialization failed: %s", msg)
+		return nil, fmt.Errorf("%w: Chapa initialization failed: %s", errPaymentProvider, msg)
 	}
 	return &chapaResp, nil
 }
@@ -598,7 +604,9 @@ func (s *PaymentService) verifyWebhookSignature(body []byte, signatureHeader str
 // ==================== Request/Response Types ====================
 
 type InitializePaymentRequest struct {
-	Amount   string `json:"amount"`
+	Amount string `json:"amount"`
+	// Email is accepted for older clients but ignored; Chapa gets the
+	// account's verified address.
 	Email    string `json:"email"`
 	UserName string `json:"user_name"`
 	RecipeID int    `json:"recipe_id"`
@@ -668,76 +676,66 @@ func withRecovery(next http.HandlerFunc, logger *log.Logger) http.HandlerFunc {
 	}
 }
 
-// writeError sends a JSON error response in Hasura Action format.
-func writeError(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"message": message})
+// paymentError maps a PaymentService error to its catalog code. Provider
+// and database failures are logged and reported without their details.
+func paymentError(logger *log.Logger, err error) *ActionError {
+	switch {
+	case errors.Is(err, errPaymentFieldsMissing):
+		return missingFields("amount", "recipe_id")
+	case errors.Is(err, errPaymentReferenceMissing):
+		return missingFields("tx_ref", "recipe_id")
+	case errors.Is(err, errInvalidAmount):
+		return newActionError(codeInvalidAmount)
+	case errors.Is(err, errUserNotFound):
+		return newActionError(codeUserNotFound)
+	case errors.Is(err, ErrEmailNotVerified):
+		return newActionError(codeEmailNotVerified)
+	case errors.Is(err, errRecipeNotFound):
+		return newActionError(codeRecipeNotFound)
+	case errors.Is(err, ErrNotFound):
+		return newActionError(codePurchaseNotFound)
+	case errors.Is(err, errPaymentProvider):
+		logger.Printf("payment provider error: %v", err)
+		return newActionError(codePaymentProviderError)
+	default:
+		logger.Printf("payment request failed: %v", err)
+		return internalError()
+	}
 }
 
-// InitializePaymentHandler handles Hasura Action for initializing payment.
-func InitializePaymentHandler(svc *PaymentService) http.HandlerFunc {
-	return withRecovery(func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid request body")
-			return
-		}
-
-		req, session, err := parseHasuraInput[InitializePaymentRequest](body)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid hasura action payload")
-			return
-		}
-
-		userID, err := getUserIDFromSession(session)
+// InitializePaymentAction handles the Hasura action for initializing payment.
+func InitializePaymentAction(svc *PaymentService) ActionFunc[InitializePaymentRequest, *InitializeResult] {
+	return func(ctx context.Context, s Session, req InitializePaymentRequest) (*InitializeResult, error) {
+		userID, _, err := s.ActiveUser()
 		if err != nil {
-			writeError(w, http.StatusUnauthorized, "unauthorized")
-			return
+			return nil, err
 		}
 
-		urlBuilder := NewURLBuilder(r)
+		urlBuilder := NewURLBuilder(s.Request)
 		result, err := svc.InitializePayment(userID, &req, urlBuilder)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err.Error())
-			return
+			return nil, paymentError(svc.logger, err)
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(result)
-	}, svc.logger)
+		logAuditEvent(s.Request, auditEntry{Action: auditPaymentInitialized, ActorID: userID, Metadata: paymentAuditMetadata(req.RecipeID, result.TxRef, result.Status)})
+		return result, nil
+	}
 }
 
-// VerifyPaymentHandler handles Hasura Action for verifying payment.
-func VerifyPaymentHandler(svc *PaymentService) http.HandlerFunc {
-	return withRecovery(func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
+// VerifyPaymentAction handles the Hasura action for verifying payment.
+func VerifyPaymentAction(svc *PaymentService) ActionFunc[VerifyPaymentRequest, *VerifyResult] {
+	return func(ctx context.Context, s Session, req VerifyPaymentRequest) (*VerifyResult, error) {
+		userID, _, err := s.ActiveUser()
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid request body")
-			return
-		}
-
-		req, session, err := parseHasuraInput[VerifyPaymentRequest](body)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid hasura action payload")
-			return
-		}
-
-		userID, err := getUserIDFromSession(session)
-		if err != nil {
-			writeError(w, http.StatusUnauthorized, "unauthorized")
-			return
+			return nil, err
 		}
 
 		result, err := svc.VerifyPayment(userID, req.TxRef, req.RecipeID)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err.Error())
-			return
+			return nil, paymentError(svc.logger, err)
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(result)
-	}, svc.logger)
+		logAuditEvent(s.Request, auditEntry{Action: auditPaymentVerified, ActorID: userID, Metadata: paymentAuditMetadata(req.RecipeID, result.TxRef, result.Status)})
+		return result, nil
+	}
 }
 
 // PaymentCallbackHandler handles Chapa webhook callbacks.
@@ -748,7 +746,8 @@ func PaymentCallbackHandler(svc *PaymentService) http.HandlerFunc {
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
+		// Unauthenticated until the signature is checked, so bound the read.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
 		if err != nil {
 			http.Error(w, "failed to read body", http.StatusBadRequest)
 			return
@@ -757,10 +756,12 @@ func PaymentCallbackHandler(svc *PaymentService) http.HandlerFunc {
 		signature := r.Header.Get("x-chapa-signature")
 		if err := svc.HandleWebhook(body, signature); err != nil {
 			svc.logger.Printf("webhook processing error: %v", err)
+			logAuditEvent(r, auditEntry{Action: auditPaymentWebhookRejected, Metadata: auditMetadata{"reason": webhookRejectReason(err)}})
 			http.Error(w, "invalid signature or data", http.StatusBadRequest)
 			return
 		}
 
+		logAuditEvent(r, auditEntry{Action: auditPaymentWebhook, Metadata: webhookAuditMetadata(body)})
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "received"})
 	}, svc.logger)
@@ -788,7 +789,7 @@ func ConfirmPaymentHandler(svc *PaymentService) http.HandlerFunc {
 		urlBuilder := NewURLBuilder(r)
 		redirectURL, err := svc.ConfirmPayment(txRef, urlBuilder)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			writeActionError(w, r, paymentError(svc.logger, err))
 			return
 		}
 		http.Redirect(w, r, redirectURL, http.StatusFound)
@@ -797,6 +798,42 @@ func ConfirmPaymentHandler(svc *PaymentService) http.HandlerFunc {
 
 // ==================== Utility Functions ====================
 
+func paymentAuditMetadata(recipeID int, txRef, status string) auditMetadata {
+	return auditMetadata{"recipe_id": recipeID, "tx_ref": txRef, "status": status}
+}
+
+// webhookRejectReason maps a HandleWebhook error to a fixed reason code, so
+// anonymous callers cannot put arbitrary or internal error text in the
+// append-only audit log.
+func webhookRejectReason(err error) string {
+	switch {
+	case errors.Is(err, errWebhookSignature):
+		return "invalid_signature"
+	case errors.Is(err, errWebhookPayload):
+		return "invalid_payload"
+	default:
+		return "processing_failed"
+	}
+}
+
+// webhookAuditMetadata keeps the reference and status of a verified callback,
+// not the payer details it also carries.
+func webhookAuditMetadata(body []byte) auditMetadata {
+	var callback struct {
+		TxRef  string `json:"tx_ref"`
+		Status string `json:"status"`
+		Data   struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	json.Unmarshal(body, &callback)
+	status := callback.Data.Status
+	if status == "" {
+		status = callback.Status
+	}
+	return auditMetadata{"tx_ref": callback.TxRef, "status": normalizePurchaseStatus(status)}
+}
+
 func stringFromAny(v interface{}) string {
 	if v == nil {
 		return ""
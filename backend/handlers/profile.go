@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const maxNameLength = 100
+
+var (
+	errInvalidName      = errors.New("name must be between 1 and 100 characters")
+	errInvalidAvatarURL = errors.New("avatar must be an image uploaded through the upload action")
+	errInvalidEmail     = errors.New("invalid email address")
+	errEmailTaken       = errors.New("email address is already registered")
+	errEmailUnchanged   = errors.New("new email is the same as the current one")
+)
+
+// ProfileResponse is the profile returned by the profile actions.
+type ProfileResponse struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	AvatarURL     string `json:"avatar_url"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func newProfileResponse(user models.User) ProfileResponse {
+	return ProfileResponse{
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		AvatarURL:     user.AvatarURL,
+		EmailVerified: user.EmailVerifiedAt != nil,
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// UpdateProfile changes the display name and/or avatar. A nil field is left
+// as is; an empty avatar removes it.
+func (s *AccountService) UpdateProfile(userID int, name, avatarURL *string) (*models.User, error) {
+	if name != nil {
+		trimmed := strings.TrimSpace(*name)
+		if trimmed == "" || len([]rune(trimmed)) > maxNameLength {
+			return nil, errInvalidName
+		}
+		name = &trimmed
+	}
+	if avatarURL != nil {
+		trimmed := strings.TrimSpace(*avatarURL)
+		if trimmed != "" {
+			// Only uploads that passed the image checks are recorded there;
+			// a direct upload that was never completed is not
+			var checked bool
+			if err := s.db.Get(&checked, `SELECT EXISTS(SELECT 1 FROM image_variants WHERE url = $1)`, trimmed); err != nil {
+				return nil, err
+			}
+			if !checked {
+				return nil, errInvalidAvatarURL
+			}
+		}
+		avatarURL = &trimmed
+	}
+
+	var user models.User
+	err := s.db.Get(&user, `
+		UPDATE users
+		SET name = COALESCE($2, name),
+		    avatar_url = CASE WHEN $3::TEXT IS NULL THEN avatar_url ELSE NULLIF($3, '') END
+		WHERE id = $1
+		RETURNING id, name, email, COALESCE(avatar_url, '') AS avatar_url, email_verified_at
+	`, userID, name, avatarURL)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ChangePassword replaces the password after checking the current one and
+// signs out every other session of the user. Pending email changes are
+// cancelled.
+func (s *AccountService) ChangePassword(userID int, keepSessionID, currentPassword, newPassword string) (int, error) {
+	if err := validatePassword(newPassword); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	if err := tx.Get(&hash, `SELECT password FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return 0, err
+	}
+	if !passwordMatches(currentPassword, hash) {
+		return 0, errInvalidPassword
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password = $1 WHERE id = $2`, hashedPassword, userID); err != nil {
+		return 0, err
+	}
+	revoked, err := revokeOtherSessions(tx, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	if err := deleteOpenVerificationTokens(tx, userID); err != nil {
+		return 0, err
+	}
+	return revoked, tx.Commit()
+}
+
+// RequestEmailChange mails a confirmation link to the new address. The
+// account keeps its current email until the link is opened (see VerifyEmail).
+func (s *AccountService) RequestEmailChange(userID int, password, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if !strings.Contains(newEmail, "@") || len(newEmail) > 255 {
+		return errInvalidEmail
+	}
+
+	var user struct {
+		Name     string `db:"name"`
+		Email    string `db:"email"`
+		Password string `db:"password"`
+	}
+	if err := s.db.Get(&user, `SELECT name, email, password FROM users WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if !passwordMatches(password, user.Password) {
+		return errInvalidPassword
+	}
+	if strings.EqualFold(user.Email, newEmail) {
+		return errEmailUnchanged
+	}
+	var taken bool
+	if err := s.db.Get(&taken, `SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))`, newEmail); err != nil {
+		return err
+	}
+	if taken {
+		return errEmailTaken
+	}
+	return s.SendVerificationEmail(userID, user.Name, newEmail)
+}
+
+// applyEmailChange moves the account to the address a verification token was
+// sent to, inside the VerifyEmail transaction.
+func (s *AccountService) applyEmailChange(tx *sqlx.Tx, userID int, newEmail string) error {
+	var taken bool
+	if err := tx.Get(&taken, `SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND id <> $2)`, newEmail, userID); err != nil {
+		return err
+	}
+	if taken {
+		return errEmailTaken
+	}
+	_, err := tx.Exec(`
+		UPDATE users SET email = $2, email_verified_at = CURRENT_TIMESTAMP WHERE id = $1
+	`, userID, newEmail)
+	if isUniqueViolation(err) {
+		return errEmailTaken
+	}
+	return err
+}
+
+// notifyEmailChanged tells the previous address about the change so a
+// hijacked account does not go unnoticed.
+func (s *AccountService) notifyEmailChanged(name, oldEmail, newEmail string) {
+	msg := utils.MailMessage{
+		To:      oldEmail,
+		Subject: "Your email address was changed",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nThe email address of your account was changed to %s. If you did not do this, reset your password right away and contact support.\n",
+			firstNameFromUserName(name), maskEmail(newEmail),
+		),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		s.logger.Printf("failed to send email change notice: %v", err)
+	}
+}
+
+// ==================== Request/Response Types ====================
+
+type UpdateProfileRequest struct {
+	Name      *string `json:"name"`
+	AvatarURL *string `json:"avatar_url"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ChangePasswordResponse struct {
+	Success         bool `json:"success"`
+	RevokedSessions int  `json:"revoked_sessions"`
+}
+
+type ChangeEmailRequest struct {
+	NewEmail string `json:"new_email"`
+	Password string `json:"password"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// UpdateProfileAction handles the update_profile action from Hasura. The
+// avatar_url must come from the upload action.
+func UpdateProfileAction(svc *AccountService) ActionFunc[UpdateProfileRequest, ProfileResponse] {
+	return func(ctx context.Context, s Session, req UpdateProfileRequest) (ProfileResponse, error) {
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return ProfileResponse{}, err
+		}
+
+		user, err := svc.UpdateProfile(userID, req.Name, req.AvatarURL)
+		switch {
+		case errors.Is(err, errInvalidName):
+			return ProfileResponse{}, newActionError(codeInvalidName).with("max", strconv.Itoa(maxNameLength))
+		case errors.Is(err, errInvalidAvatarURL):
+			return ProfileResponse{}, newActionError(codeInvalidAvatarURL)
+		case err != nil:
+			svc.logger.Printf("profile update failed for user_id=%d: %v", userID, err)
+			return ProfileResponse{}, internalError()
+		}
+
+		return newProfileResponse(*user), nil
+	}
+}
+
+// beginPasswordCheck reserves a throttled check of a signed-in user's
+// current password. It returns an error to send back when the user or the
+// client IP has failed too often.
+func beginPasswordCheck(ctx context.Context, throttle *LoginThrottle, s Session, userID int) (*LoginAttempt, error) {
+	attempt, err := throttle.BeginForUser(ctx, userID, clientIP(s.Request))
+	if err != nil {
+		throttle.logger.Printf("[AUTH] login limiter unavailable: %v", err)
+		return nil, nil
+	}
+	if !attempt.Allowed {
+		logAuditEvent(s.Request, auditEntry{Action: auditLoginThrottled, ActorID: userID, Metadata: auditMetadata{"method": "password_check"}})
+		return nil, limitError(attempt.LimitDecision)
+	}
+	return attempt, nil
+}
+
+// finishPasswordCheck reports the outcome of a check begun with
+// beginPasswordCheck: a wrong password counts as a failure, success and the
+// refusals that follow a correct password reset the counters, and any other
+// error gives the attempt back.
+func finishPasswordCheck(ctx context.Context, throttle *LoginThrottle, attempt *LoginAttempt, err error) {
+	switch {
+	case errors.Is(err, errInvalidPassword):
+		throttle.Failure(attempt)
+	case err == nil, errors.Is(err, errEmailUnchanged), errors.Is(err, errEmailTaken),
+		errors.Is(err, errLastAdmin), errors.Is(err, errDataRequestOpen):
+		throttle.Success(ctx, attempt)
+	default:
+		throttle.Cancel(ctx, attempt)
+	}
+}
+
+// ChangePasswordAction handles the change_password action from Hasura.
+// The calling session stays signed in; all others are revoked. Wrong
+// current passwords are throttled like failed logins.
+func ChangePasswordAction(svc *AccountService, throttle *LoginThrottle) ActionFunc[ChangePasswordRequest, ChangePasswordResponse] {
+	return func(ctx context.Context, s Session, req ChangePasswordRequest) (ChangePasswordResponse, error) {
+		if req.CurrentPassword == "" {
+			return ChangePasswordResponse{}, missingFields("current_password", "new_password")
+		}
+		userID, sessionID, err := s.ActiveUser()
+		if err != nil {
+			return ChangePasswordResponse{}, err
+		}
+
+		attempt, err := beginPasswordCheck(ctx, throttle, s, userID)
+		if err != nil {
+			return ChangePasswordResponse{}, err
+		}
+		revoked, err := svc.ChangePassword(userID, sessionID, req.CurrentPassword, req.NewPassword)
+		finishPasswordCheck(ctx, throttle, attempt, err)
+		switch {
+		case errors.Is(err, errWeakPassword):
+			return ChangePasswordResponse{}, newActionError(codeWeakPassword).with("min", strconv.Itoa(minPasswordLength))
+		case errors.Is(err, errInvalidPassword):
+			return ChangePasswordResponse{}, newActionError(codeInvalidPassword)
+		case err != nil:
+			svc.logger.Printf("password change failed for user_id=%d: %v", userID, err)
+			return ChangePasswordResponse{}, internalError()
+		}
+
+		svc.logger.Printf("password changed: user_id=%d revoked_sessions=%d", userID, revoked)
+		logAuditEvent(s.Request, auditEntry{Action: auditPasswordChanged, ActorID: userID, Metadata: auditMetadata{"revoked_sessions": revoked}})
+		return ChangePasswordResponse{Success: true, RevokedSessions: revoked}, nil
+	}
+}
+
+// ChangeEmailAction handles the change_email action from Hasura. Wrong
+// passwords are throttled like failed logins.
+func ChangeEmailAction(svc *AccountService, throttle *LoginThrottle) ActionFunc[ChangeEmailRequest, AccountActionResponse] {
+	return func(ctx context.Context, s Session, req ChangeEmailRequest) (AccountActionResponse, error) {
+		if req.NewEmail == "" || req.Password == "" {
+			return AccountActionResponse{}, missingFields("new_email", "password")
+		}
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return AccountActionResponse{}, err
+		}
+
+		attempt, err := beginPasswordCheck(ctx, throttle, s, userID)
+		if err != nil {
+			return AccountActionResponse{}, err
+		}
+		err = svc.RequestEmailChange(userID, req.Password, req.NewEmail)
+		finishPasswordCheck(ctx, throttle, attempt, err)
+		switch {
+		case errors.Is(err, errInvalidEmail):
+			return AccountActionResponse{}, newActionError(codeInvalidEmail)
+		case errors.Is(err, errInvalidPassword):
+			return AccountActionResponse{}, newActionError(codeInvalidPassword)
+		case errors.Is(err, errEmailUnchanged):
+			return AccountActionResponse{}, newActionError(codeEmailUnchanged)
+		case errors.Is(err, errEmailTaken):
+			return AccountActionResponse{}, newActionError(codeEmailExists)
+		case err != nil:
+			svc.logger.Printf("email change failed for user_id=%d: %v", userID, err)
+			return AccountActionResponse{}, internalError()
+		}
+		logAuditEvent(s.Request, auditEntry{Action: auditEmailChangeRequested, ActorID: userID, Metadata: auditMetadata{"new_email": maskEmail(req.NewEmail)}})
+
+		return AccountActionResponse{
+			Success: true,
+			Message: "Open the link sent to " + req.NewEmail + " to confirm the new address",
+		}, nil
+	}
+}
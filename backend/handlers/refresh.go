@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token is invalid")
+	errRefreshTokenExpired = errors.New("refresh token has expired")
+	errRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+type HasuraRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshTokenRow struct {
+	ID        int64        `db:"id"`
+	UserID    int          `db:"user_id"`
+	FamilyID  string       `db:"family_id"`
+	ExpiresAt time.Time    `db:"expires_at"`
+	UsedAt    sql.NullTime `db:"used_at"`
+	RevokedAt sql.NullTime `db:"revoked_at"`
+}
+
+// issueLoginTokens builds the login response for a user: it opens a new
+// session, a short-lived access token and a refresh token for that session.
+func issueLoginTokens(user models.User, meta sessionMetadata) (*HasuraLoginResponse, error) {
+	sessionID, err := utils.GenerateOpaqueToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := createSession(tx, sessionID, user.ID, meta); err != nil {
+		return nil, err
+	}
+	refreshToken, err := insertRefreshToken(tx, user.ID, sessionID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := buildLoginResponse(tx, user, sessionID, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new access/refresh pair.
+// The presented token is marked used; presenting it again revokes its family.
+func rotateRefreshToken(rawToken string) (*HasuraLoginResponse, error) {
+	rawToken = strings.TrimSpace(rawToken)
+	if rawToken == "" {
+		return nil, errRefreshTokenInvalid
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var row refreshTokenRow
+	err = tx.Get(&row, `
+		SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`, utils.HashToken(rawToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if row.UsedAt.Valid {
+		// A rotated token came back: assume it was stolen and kill the family.
+		if err := revokeSessions(tx, row.UserID, row.FamilyID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		log.Printf("[AUTH] refresh token reuse detected: user_id=%d family=%s, family revoked", row.UserID, row.FamilyID)
+		return nil, errRefreshTokenReused
+	}
+	if row.RevokedAt.Valid {
+		return nil, errRefreshTokenInvalid
+	}
+	if time.Now().After(row.ExpiresAt) {
+		return nil, errRefreshTokenExpired
+	}
+
+	var user models.User
+	if err := tx.Get(&user, `SELECT id, name, email, email_verified_at FROM users WHERE id = $1`, row.UserID); err != nil {
+		return nil, errRefreshTokenInvalid
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1`, row.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE user_sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = $1`, row.FamilyID); err != nil {
+		return nil, err
+	}
+	refreshToken, err := insertRefreshToken(tx, row.UserID, row.FamilyID, &row.ID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := buildLoginResponse(tx, user, row.FamilyID, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func insertRefreshToken(tx *sqlx.Tx, userID int, familyID string, parentID *int64) (string, error) {
+	token, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (user_id, family_id, parent_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, userID, familyID, parentID, utils.HashToken(token), time.Now().Add(utils.RefreshTokenTTL()))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func buildLoginResponse(q sqlx.Queryer, user models.User, sessionID, refreshToken string) (*HasuraLoginResponse, error) {
+	roles, err := loadUserRoles(q, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := utils.GenerateJWT(user.ID, user.Email, user.Name, sessionID, roles)
+	if err != nil {
+		return nil, err
+	}
+	return &HasuraLoginResponse{
+		Token:         token,
+		RefreshToken:  refreshToken,
+		ExpiresIn:     int(utils.AccessTokenTTL().Seconds()),
+		UserID:        user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+	}, nil
+}
+
+// RefreshAction handles the refresh action from Hasura
+func RefreshAction(ctx context.Context, s Session, req HasuraRefreshRequest) (*HasuraLoginResponse, error) {
+	resp, err := rotateRefreshToken(req.RefreshToken)
+	switch {
+	case errors.Is(err, errRefreshTokenInvalid):
+		return nil, newActionError(codeInvalidRefreshToken)
+	case errors.Is(err, errRefreshTokenExpired):
+		return nil, newActionError(codeRefreshTokenExpired)
+	case errors.Is(err, errRefreshTokenReused):
+		return nil, newActionError(codeRefreshTokenReused)
+	case err != nil:
+		log.Printf("[AUTH] refresh failed: %v", err)
+		return nil, internalError()
+	}
+	return resp, nil
+}
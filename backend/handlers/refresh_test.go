@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"foodrecipes/utils"
+)
+
+func TestRefreshRotation(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+
+	login, err := issueLoginTokens(user, sessionMetadata{DeviceLabel: "Pixel", IPAddress: "203.0.113.7", UserAgent: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := utils.ParseJWT(login.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID, _ := claims["jti"].(string)
+	if sessionID == "" {
+		t.Fatal("access token has no session id")
+	}
+
+	rotated, err := rotateRefreshToken(login.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshToken == login.RefreshToken || rotated.RefreshToken == "" {
+		t.Fatal("rotation did not issue a new refresh token")
+	}
+	claims, err = utils.ParseJWT(rotated.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["jti"] != sessionID {
+		t.Errorf("rotated access token is for session %v, want %s", claims["jti"], sessionID)
+	}
+
+	var rows []struct {
+		TokenHash string `db:"token_hash"`
+		Used      bool   `db:"used"`
+		HasParent bool   `db:"has_parent"`
+	}
+	if err := db.Select(&rows, `
+		SELECT token_hash, used_at IS NOT NULL AS used, parent_id IS NOT NULL AS has_parent
+		FROM refresh_tokens WHERE family_id = $1 ORDER BY id
+	`, sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("family has %d tokens, want 2", len(rows))
+	}
+	if rows[0].TokenHash != utils.HashToken(login.RefreshToken) || !rows[0].Used || rows[0].HasParent {
+		t.Errorf("first token = %+v, want used without a parent", rows[0])
+	}
+	if rows[1].TokenHash != utils.HashToken(rotated.RefreshToken) || rows[1].Used || !rows[1].HasParent {
+		t.Errorf("second token = %+v, want unused with a parent", rows[1])
+	}
+	if rows[0].TokenHash == login.RefreshToken {
+		t.Error("refresh token is stored in plain text")
+	}
+
+	if _, err := rotateRefreshToken(rotated.RefreshToken); err != nil {
+		t.Errorf("rotating the newest token: %v", err)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+
+	login, err := issueLoginTokens(user, sessionMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := issueLoginTokens(user, sessionMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rotateRefreshToken(login.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old token comes back, e.g. from whoever stole it.
+	if _, err := rotateRefreshToken(login.RefreshToken); !errors.Is(err, errRefreshTokenReused) {
+		t.Fatalf("replaying a used token: err = %v, want errRefreshTokenReused", err)
+	}
+	if _, err := rotateRefreshToken(rotated.RefreshToken); !errors.Is(err, errRefreshTokenInvalid) {
+		t.Errorf("newest token after reuse: err = %v, want errRefreshTokenInvalid", err)
+	}
+
+	claims, err := utils.ParseJWT(rotated.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID, _ := claims["jti"].(string)
+	if _, _, err := requireActiveSession(sessionFor(user.ID, sessionID).Variables); !errors.Is(err, errSessionRevoked) {
+		t.Errorf("session after reuse: err = %v, want errSessionRevoked", err)
+	}
+
+	// Other devices stay signed in.
+	if _, err := rotateRefreshToken(other.RefreshToken); err != nil {
+		t.Errorf("another session's token after reuse: %v", err)
+	}
+}
+
+func TestRefreshConcurrentRotation(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+	login, err := issueLoginTokens(user, sessionMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two tabs refresh with the same token at once: the row lock lets one
+	// rotate, and the other is treated as reuse.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = rotateRefreshToken(login.RefreshToken)
+		}(i)
+	}
+	wg.Wait()
+	var ok, reused int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case errors.Is(err, errRefreshTokenReused):
+			reused++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if ok != 1 || reused != 1 {
+		t.Errorf("%d rotations succeeded and %d were reuse, want 1 and 1", ok, reused)
+	}
+}
+
+func TestRefreshAction(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+	ctx := context.Background()
+	s := Session{Request: sessionFor(0, "").Request}
+
+	_, err := RefreshAction(ctx, s, HasuraRefreshRequest{RefreshToken: ""})
+	wantActionError(t, err, codeInvalidRefreshToken)
+	_, err = RefreshAction(ctx, s, HasuraRefreshRequest{RefreshToken: "not-a-token"})
+	wantActionError(t, err, codeInvalidRefreshToken)
+
+	expired, err := issueLoginTokens(user, sessionMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE refresh_tokens SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 minute' WHERE token_hash = $1`,
+		utils.HashToken(expired.RefreshToken)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = RefreshAction(ctx, s, HasuraRefreshRequest{RefreshToken: expired.RefreshToken})
+	wantActionError(t, err, codeRefreshTokenExpired)
+
+	login, err := issueLoginTokens(user, sessionMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := RefreshAction(ctx, s, HasuraRefreshRequest{RefreshToken: " " + login.RefreshToken + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UserID != user.ID || resp.Email != user.Email || !resp.EmailVerified || resp.ExpiresIn != int(utils.AccessTokenTTL().Seconds()) {
+		t.Errorf("response = %+v", resp)
+	}
+	_, err = RefreshAction(ctx, s, HasuraRefreshRequest{RefreshToken: login.RefreshToken})
+	wantActionError(t, err, codeRefreshTokenReused)
+}
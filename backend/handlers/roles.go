@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Staff roles that can be stored in user_roles. Every account also has the
+// implicit "user" role.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleCreator   = "creator"
+)
+
+var (
+	errUnknownRole    = errors.New("unknown role")
+	errLastAdmin      = errors.New("cannot revoke the last admin")
+	errTargetNotFound = errors.New("user not found")
+)
+
+func isStaffRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleModerator, RoleCreator:
+		return true
+	}
+	return false
+}
+
+// loadUserRoles returns the stored staff roles of a user.
+func loadUserRoles(q sqlx.Queryer, userID int) ([]string, error) {
+	roles := []string{}
+	err := sqlx.Select(q, &roles, `SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`, userID)
+	return roles, err
+}
+
+// hasRole checks the database, not the token, so revoked roles stop working
+// before the caller's access token expires.
+func hasRole(q sqlx.Queryer, userID int, role string) (bool, error) {
+	var ok bool
+	err := sqlx.Get(q, &ok, `SELECT EXISTS(SELECT 1 FROM user_roles WHERE user_id = $1 AND role = $2)`, userID, role)
+	return ok, err
+}
+
+// changeUserRole grants or revokes a role and records who did it.
+func changeUserRole(r *http.Request, actorID, targetID int, role string, grant bool) ([]string, error) {
+	role = strings.ToLower(strings.TrimSpace(role))
+	if !isStaffRole(role) {
+		return nil, errUnknownRole
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, targetID); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errTargetNotFound
+	}
+
+	var res sql.Result
+	action, auditAction := "grant", auditRoleGranted
+	if grant {
+		res, err = tx.Exec(`
+			INSERT INTO user_roles (user_id, role, granted_by)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, role) DO NOTHING
+		`, targetID, role, actorID)
+	} else {
+		action, auditAction = "revoke", auditRoleRevoked
+		if role == RoleAdmin {
+			// Serialize admin revocations so two admins cannot remove each other.
+			if _, err := tx.Exec(`LOCK TABLE user_roles IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+				return nil, err
+			}
+			var admins int
+			if err := tx.Get(&admins, `SELECT COUNT(*) FROM user_roles WHERE role = $1 AND user_id <> $2`, RoleAdmin, targetID); err != nil {
+				return nil, err
+			}
+			if admins == 0 {
+				return nil, errLastAdmin
+			}
+		}
+		res, err = tx.Exec(`DELETE FROM user_roles WHERE user_id = $1 AND role = $2`, targetID, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only record changes that actually happened.
+	if n, _ := res.RowsAffected(); n > 0 {
+		if _, err := tx.Exec(`
+			INSERT INTO role_changes (actor_user_id, target_user_id, role, action)
+			VALUES ($1, $2, $3, $4)
+		`, actorID, targetID, role, action); err != nil {
+			return nil, err
+		}
+		if err := recordAuditEvent(tx, r, auditEntry{
+			Action:    auditAction,
+			ActorID:   actorID,
+			SubjectID: targetID,
+			Metadata:  auditMetadata{"role": role},
+		}); err != nil {
+			return nil, err
+		}
+		log.Printf("[AUTH] role %s: actor_id=%d target_id=%d role=%s", action, actorID, targetID, role)
+	}
+
+	roles, err := loadUserRoles(tx, targetID)
+	if err != nil {
+		return nil, err
+	}
+	return roles, tx.Commit()
+}
+
+// ==================== Request/Response Types ====================
+
+type ChangeRoleRequest struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type UserRolesResponse struct {
+	UserID int      `json:"user_id"`
+	Roles  []string `json:"roles"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// GrantRoleAction handles the admin-only grant_role action from Hasura
+func GrantRoleAction(ctx context.Context, s Session, req ChangeRoleRequest) (UserRolesResponse, error) {
+	return handleRoleChange(s, req, true)
+}
+
+// RevokeRoleAction handles the admin-only revoke_role action from Hasura
+func RevokeRoleAction(ctx context.Context, s Session, req ChangeRoleRequest) (UserRolesResponse, error) {
+	return handleRoleChange(s, req, false)
+}
+
+// requireAdmin returns the calling user if they have the admin role.
+func requireAdmin(s Session) (int, error) {
+	actorID, _, err := s.ActiveUser()
+	if err != nil {
+		return 0, err
+	}
+	isAdmin, err := hasRole(DB, actorID, RoleAdmin)
+	if err != nil {
+		log.Printf("[AUTH] role check failed: %v", err)
+		return 0, internalError()
+	}
+	if !isAdmin {
+		return 0, newActionError(codeForbidden)
+	}
+	return actorID, nil
+}
+
+func handleRoleChange(s Session, req ChangeRoleRequest, grant bool) (UserRolesResponse, error) {
+	if req.UserID <= 0 || req.Role == "" {
+		return UserRolesResponse{}, missingFields("user_id", "role")
+	}
+	actorID, err := requireAdmin(s)
+	if err != nil {
+		return UserRolesResponse{}, err
+	}
+
+	roles, err := changeUserRole(s.Request, actorID, req.UserID, req.Role, grant)
+	switch {
+	case errors.Is(err, errUnknownRole):
+		return UserRolesResponse{}, newActionError(codeInvalidRole).with("roles", strings.Join([]string{RoleAdmin, RoleModerator, RoleCreator}, ", "))
+	case errors.Is(err, errTargetNotFound):
+		return UserRolesResponse{}, newActionError(codeUserNotFound)
+	case errors.Is(err, errLastAdmin):
+		return UserRolesResponse{}, newActionError(codeLastAdmin)
+	case err != nil:
+		log.Printf("[AUTH] role change failed: %v", err)
+		return UserRolesResponse{}, internalError()
+	}
+
+	return UserRolesResponse{UserID: req.UserID, Roles: roles}, nil
+}
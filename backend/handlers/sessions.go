@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var errSessionRevoked = errors.New("session has been revoked")
+
+// sessionMetadata describes the device a login came from.
+type sessionMetadata struct {
+	DeviceLabel string
+	IPAddress   string
+	UserAgent   string
+}
+
+type SessionInfo struct {
+	ID          string    `db:"id" json:"id"`
+	DeviceLabel string    `db:"device_label" json:"device_label"`
+	IPAddress   string    `db:"ip_address" json:"ip_address"`
+	UserAgent   string    `db:"user_agent" json:"user_agent"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	LastSeenAt  time.Time `db:"last_seen_at" json:"last_seen_at"`
+	Current     bool      `db:"-" json:"current"`
+}
+
+type RevokeSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+type RevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// newSessionMetadata collects device details for a login request. Hasura only
+// passes the client's User-Agent and IP headers when the action is configured
+// with forward_client_headers.
+func newSessionMetadata(r *http.Request, deviceLabel string) sessionMetadata {
+	return sessionMetadata{
+		DeviceLabel: truncate(strings.TrimSpace(deviceLabel), 255),
+		IPAddress:   clientIP(r),
+		UserAgent:   r.UserAgent(),
+	}
+}
+
+// trustedProxies returns the networks of the proxies in front of the
+// backend, usually Hasura and the load balancer before it, whose
+// X-Forwarded-For entries are believed
+// Default: none; the login throttle refuses to start until it is set (see
+// NewLoginThrottleFromEnv)
+// Can be overridden with TRUSTED_PROXIES environment variable, a
+// comma-separated list of IPs and CIDR ranges, or "none" when clients
+// connect to the backend directly
+var trustedProxies = sync.OnceValue(func() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(getEnv("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.EqualFold(entry, "none") {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				log.Printf("ignoring invalid TRUSTED_PROXIES entry %q", entry)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+})
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from, for rate limits, sessions
+// and the audit log. Forwarding headers are only read when the connection
+// comes from a trusted proxy, and X-Forwarded-For is walked from the right
+// to the first address that is not a trusted proxy: entries further left
+// were written by the client and can be anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr.Unmap()) {
+		return host
+	}
+	addr = addr.Unmap()
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	if len(hops) == 1 && strings.TrimSpace(hops[0]) == "" {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap().String()
+		}
+		return addr.String()
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		hop = hop.Unmap()
+		if !isTrustedProxy(hop) {
+			return hop.String()
+		}
+		addr = hop
+	}
+	return addr.String()
+}
+
+// truncate cuts s to at most max bytes without splitting a UTF-8 sequence,
+// so device labels and user agents stay valid text for Postgres.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+func createSession(tx *sqlx.Tx, sessionID string, userID int, meta sessionMetadata) error {
+	_, err := tx.Exec(`
+		INSERT INTO user_sessions (id, user_id, device_label, ip_address, user_agent)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''))
+	`, sessionID, userID, meta.DeviceLabel, meta.IPAddress, meta.UserAgent)
+	return err
+}
+
+// revokeSessions signs out the given sessions of a user and revokes the
+// refresh tokens issued for them.
+func revokeSessions(tx *sqlx.Tx, userID int, sessionIDs ...string) error {
+	for _, id := range sessionIDs {
+		if _, err := tx.Exec(`
+			UPDATE user_sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		`, id, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+			WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL
+		`, id, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeOtherSessions signs out every session of a user except keepSessionID
+// and returns how many sessions were revoked.
+func revokeOtherSessions(tx *sqlx.Tx, userID int, keepSessionID string) (int, error) {
+	var ids []string
+	if err := tx.Select(&ids, `
+		SELECT id FROM user_sessions
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+	`, userID, keepSessionID); err != nil {
+		return 0, err
+	}
+	if err := revokeSessions(tx, userID, ids...); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// requireActiveSession resolves the calling user from Hasura session
+// variables and refuses tokens whose session was signed out. Tokens issued
+// before sessions existed carry no session id and are accepted until expiry.
+func requireActiveSession(session map[string]interface{}) (int, string, error) {
+	userID, err := getUserIDFromSession(session)
+	if err != nil {
+		return 0, "", err
+	}
+	sessionID, _ := session["x-hasura-session-id"].(string)
+	if sessionID == "" {
+		return userID, "", nil
+	}
+
+	res, err := DB.Exec(`
+		UPDATE user_sessions SET last_seen_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, "", errSessionRevoked
+	}
+	return userID, sessionID, nil
+}
+
+// sessionFromBearer authenticates a request that does not come through
+// Hasura by its access token, with the same revocation check as actions.
+func sessionFromBearer(r *http.Request) (int, string, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(raw) == "" {
+		return 0, "", newActionError(codeAuthenticationRequired)
+	}
+	claims, err := utils.ParseJWT(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, "", newActionError(codeInvalidSession)
+	}
+	// Challenge tokens carry no Hasura claims and are refused here.
+	variables, ok := claims["https://hasura.io/jwt/claims"].(map[string]interface{})
+	if !ok {
+		return 0, "", newActionError(codeInvalidSession)
+	}
+	return Session{Variables: variables, Request: r}.ActiveUser()
+}
+
+// ListSessionsAction handles the list_sessions action from Hasura
+func ListSessionsAction(ctx context.Context, s Session, _ struct{}) ([]SessionInfo, error) {
+	userID, sessionID, err := s.ActiveUser()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []SessionInfo{}
+	err = DB.Select(&sessions, `
+		SELECT id, COALESCE(device_label, '') AS device_label, COALESCE(ip_address, '') AS ip_address,
+		       COALESCE(user_agent, '') AS user_agent, created_at, last_seen_at
+		FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		log.Printf("[AUTH] list sessions failed: %v", err)
+		return nil, internalError()
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sessionID
+	}
+	return sessions, nil
+}
+
+// RevokeSessionAction handles the revoke_session action from Hasura
+func RevokeSessionAction(ctx context.Context, s Session, req RevokeSessionRequest) (RevokeSessionsResponse, error) {
+	if strings.TrimSpace(req.SessionID) == "" {
+		return RevokeSessionsResponse{}, missingFields("session_id")
+	}
+	userID, _, err := s.ActiveUser()
+	if err != nil {
+		return RevokeSessionsResponse{}, err
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return RevokeSessionsResponse{}, fmt.Errorf("begin revoke session: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.Get(&exists, `
+		SELECT EXISTS(SELECT 1 FROM user_sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)
+	`, req.SessionID, userID); err != nil || !exists {
+		return RevokeSessionsResponse{}, newActionError(codeSessionNotFound)
+	}
+	err = revokeSessions(tx, userID, req.SessionID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[AUTH] revoke session failed: %v", err)
+		return RevokeSessionsResponse{}, internalError()
+	}
+
+	logAuditEvent(s.Request, auditEntry{Action: auditSessionRevoked, ActorID: userID, Metadata: auditMetadata{"session_id": req.SessionID}})
+	return RevokeSessionsResponse{Revoked: 1}, nil
+}
+
+// RevokeOtherSessionsAction handles the revoke_other_sessions action from Hasura
+func RevokeOtherSessionsAction(ctx context.Context, s Session, _ struct{}) (RevokeSessionsResponse, error) {
+	userID, sessionID, err := s.ActiveUser()
+	if err != nil {
+		return RevokeSessionsResponse{}, err
+	}
+
+	tx, err := DB.Beginx()
+	if err != nil {
+		return RevokeSessionsResponse{}, fmt.Errorf("begin revoke sessions: %w", err)
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokeOtherSessions(tx, userID, sessionID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[AUTH] revoke other sessions failed: %v", err)
+		return RevokeSessionsResponse{}, internalError()
+	}
+
+	logAuditEvent(s.Request, auditEntry{Action: auditSessionRevoked, ActorID: userID, Metadata: auditMetadata{"revoked_sessions": revoked, "kept_session_id": sessionID}})
+	return RevokeSessionsResponse{Revoked: revoked}, nil
+}
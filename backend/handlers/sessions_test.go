@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"Firefox", 20, "Firefox"},
+		{"Firefox", 4, "Fire"},
+		{"ሰላም", 9, "ሰላም"},
+		{"ሰላም", 8, "ሰላ"},
+		{"ሰላም", 4, "ሰ"},
+		{"ሰላም", 2, ""},
+		{"", 0, ""},
+	}
+	for _, tt := range tests {
+		got := truncate(tt.in, tt.max)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q is not valid UTF-8", tt.in, tt.max, got)
+		}
+	}
+}
+
+// signIn opens a session for user and returns its id with the tokens.
+func signIn(t *testing.T, user models.User, device string) (string, *HasuraLoginResponse) {
+	t.Helper()
+	login, err := issueLoginTokens(user, sessionMetadata{DeviceLabel: device})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := utils.ParseJWT(login.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID, _ := claims["jti"].(string)
+	return sessionID, login
+}
+
+func TestRevokeSession(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+	stranger := createTestUser(t, db, "correct horse battery")
+	ctx := context.Background()
+
+	phone, _ := signIn(t, user, "phone")
+	laptop, laptopLogin := signIn(t, user, "laptop")
+	strangers, _ := signIn(t, stranger, "")
+
+	sessions, err := ListSessionsAction(ctx, sessionFor(user.ID, phone), struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == phone) {
+			t.Errorf("session %s (%s) current = %v", s.ID, s.DeviceLabel, s.Current)
+		}
+	}
+
+	_, err = RevokeSessionAction(ctx, sessionFor(user.ID, phone), RevokeSessionRequest{SessionID: strangers})
+	wantActionError(t, err, codeSessionNotFound)
+	_, err = RevokeSessionAction(ctx, sessionFor(user.ID, phone), RevokeSessionRequest{SessionID: " "})
+	wantActionError(t, err, codeInvalidInput)
+	if _, _, err := sessionFor(stranger.ID, strangers).ActiveUser(); err != nil {
+		t.Errorf("another user's session was affected: %v", err)
+	}
+
+	resp, err := RevokeSessionAction(ctx, sessionFor(user.ID, phone), RevokeSessionRequest{SessionID: laptop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Revoked != 1 {
+		t.Errorf("revoked = %d, want 1", resp.Revoked)
+	}
+
+	// The laptop's access token stops working at once, and its refresh
+	// token cannot bring the session back.
+	_, _, err = sessionFor(user.ID, laptop).ActiveUser()
+	wantActionError(t, err, codeSessionRevoked)
+	r := httptest.NewRequest("GET", "/api/uploads", nil)
+	r.Header.Set("Authorization", "Bearer "+laptopLogin.Token)
+	_, _, err = sessionFromBearer(r)
+	wantActionError(t, err, codeSessionRevoked)
+	if _, err := rotateRefreshToken(laptopLogin.RefreshToken); !errors.Is(err, errRefreshTokenInvalid) {
+		t.Errorf("refresh after revoke: err = %v, want errRefreshTokenInvalid", err)
+	}
+	_, err = RevokeSessionAction(ctx, sessionFor(user.ID, phone), RevokeSessionRequest{SessionID: laptop})
+	wantActionError(t, err, codeSessionNotFound)
+
+	if _, _, err := sessionFor(user.ID, phone).ActiveUser(); err != nil {
+		t.Errorf("the calling session was revoked too: %v", err)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+	ctx := context.Background()
+
+	current, currentLogin := signIn(t, user, "phone")
+	var others []string
+	for _, device := range []string{"laptop", "tablet"} {
+		id, _ := signIn(t, user, device)
+		others = append(others, id)
+	}
+
+	resp, err := RevokeOtherSessionsAction(ctx, sessionFor(user.ID, current), struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Revoked != 2 {
+		t.Errorf("revoked = %d, want 2", resp.Revoked)
+	}
+	for _, id := range others {
+		_, _, err := sessionFor(user.ID, id).ActiveUser()
+		wantActionError(t, err, codeSessionRevoked)
+	}
+	if _, _, err := sessionFor(user.ID, current).ActiveUser(); err != nil {
+		t.Errorf("current session: %v", err)
+	}
+	if _, err := rotateRefreshToken(currentLogin.RefreshToken); err != nil {
+		t.Errorf("current session's refresh token: %v", err)
+	}
+
+	resp, err = RevokeOtherSessionsAction(ctx, sessionFor(user.ID, current), struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Revoked != 0 {
+		t.Errorf("second call revoked %d sessions", resp.Revoked)
+	}
+}
+
+func TestSessionChecks(t *testing.T) {
+	db := testDB(t)
+	user := createTestUser(t, db, "correct horse battery")
+
+	// Tokens from before sessions existed have no session id.
+	if id, sessionID, err := sessionFor(user.ID, "").ActiveUser(); err != nil || id != user.ID || sessionID != "" {
+		t.Errorf("legacy token: user %d session %q err %v", id, sessionID, err)
+	}
+	_, _, err := sessionFor(user.ID, "no-such-session").ActiveUser()
+	wantActionError(t, err, codeSessionRevoked)
+	_, _, err = Session{Variables: map[string]interface{}{}}.ActiveUser()
+	wantActionError(t, err, codeInvalidSession)
+
+	// Another user's session id does not vouch for this user.
+	other := createTestUser(t, db, "correct horse battery")
+	othersSession, _ := signIn(t, other, "")
+	_, _, err = sessionFor(user.ID, othersSession).ActiveUser()
+	wantActionError(t, err, codeSessionRevoked)
+
+	_, login := signIn(t, user, "")
+	bearer := func(value string) error {
+		r := httptest.NewRequest("GET", "/api/uploads", nil)
+		if value != "" {
+			r.Header.Set("Authorization", value)
+		}
+		_, _, err := sessionFromBearer(r)
+		return err
+	}
+	if err := bearer("Bearer " + login.Token); err != nil {
+		t.Errorf("valid bearer token: %v", err)
+	}
+	wantActionError(t, bearer(""), codeAuthenticationRequired)
+	wantActionError(t, bearer("Basic "+login.Token), codeAuthenticationRequired)
+	wantActionError(t, bearer("Bearer not-a-jwt"), codeInvalidSession)
+	challenge, err := utils.GenerateChallengeToken(user.ID, "2fa", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantActionError(t, bearer("Bearer "+challenge), codeInvalidSession)
+}
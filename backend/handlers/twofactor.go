@@ -0,0 +1,478 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// twoFactorChallengePurpose is the audience of the token returned by
+	// login when a second factor is still required.
+	twoFactorChallengePurpose = "2fa-challenge"
+	twoFactorChallengeTTL     = 5 * time.Minute
+	// twoFactorChallengeAttempts is how many codes one challenge accepts;
+	// after that the user has to log in again.
+	twoFactorChallengeAttempts = 5
+	recoveryCodeCount          = 10
+)
+
+var (
+	errTwoFactorNotEnrolled   = errors.New("two-factor authentication is not set up")
+	errTwoFactorAlreadyActive = errors.New("two-factor authentication is already enabled")
+	errInvalidSecondFactor    = errors.New("invalid authentication code")
+	errChallengeUsedUp        = errors.New("login challenge is used up or expired")
+)
+
+// totpIssuer is the name authenticator apps show next to the account
+// Default: Food Recipes
+// Can be overridden with TOTP_ISSUER environment variable
+func totpIssuer() string {
+	return getEnv("TOTP_ISSUER", "Food Recipes")
+}
+
+type userTOTP struct {
+	SecretEncrypted string       `db:"secret_encrypted"`
+	ConfirmedAt     sql.NullTime `db:"confirmed_at"`
+	LastUsedStep    int64        `db:"last_used_step"`
+}
+
+// twoFactorEnabled reports whether the user has a confirmed TOTP secret.
+func twoFactorEnabled(q sqlx.Queryer, userID int) (bool, error) {
+	var ok bool
+	err := sqlx.Get(q, &ok, `SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)`, userID)
+	return ok, err
+}
+
+// issueTwoFactorChallenge returns the login response for an account with 2FA:
+// a challenge token that proves the password step, instead of a session.
+// The token's jti names a two_factor_challenges row that limits how often
+// it can be tried (see useTwoFactorChallenge).
+func issueTwoFactorChallenge(user models.User, deviceLabel string) (*HasuraLoginResponse, error) {
+	jti, err := utils.GenerateOpaqueToken(16)
+	if err != nil {
+		return nil, err
+	}
+	// Drop expired challenges while we are here.
+	if _, err := DB.Exec(`DELETE FROM two_factor_challenges WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		log.Printf("[AUTH] pruning 2fa challenges failed: %v", err)
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO two_factor_challenges (jti, user_id, expires_at) VALUES ($1, $2, $3)
+	`, jti, user.ID, time.Now().Add(twoFactorChallengeTTL)); err != nil {
+		return nil, err
+	}
+	challenge, err := utils.GenerateChallengeToken(user.ID, twoFactorChallengePurpose, twoFactorChallengeTTL, map[string]interface{}{
+		"jti":          jti,
+		"device_label": deviceLabel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &HasuraLoginResponse{
+		RequiresTwoFactor: true,
+		ChallengeToken:    challenge,
+		ExpiresIn:         int(twoFactorChallengeTTL.Seconds()),
+		UserID:            user.ID,
+	}, nil
+}
+
+// useTwoFactorChallenge spends one attempt of a challenge before its code is
+// checked, so concurrent guesses cannot exceed twoFactorChallengeAttempts.
+// It returns errChallengeUsedUp when no attempt is left, the challenge has
+// expired or a login already completed with it.
+func useTwoFactorChallenge(jti string, userID int) error {
+	var attempts int
+	err := DB.Get(&attempts, `
+		UPDATE two_factor_challenges SET attempts = attempts + 1
+		WHERE jti = $1 AND user_id = $2 AND expires_at > CURRENT_TIMESTAMP AND attempts < $3
+		RETURNING attempts
+	`, jti, userID, twoFactorChallengeAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errChallengeUsedUp
+	}
+	return err
+}
+
+// completeLogin finishes a passwordless login: accounts with 2FA get a
+// challenge, others a session.
+func completeLogin(s Session, user models.User, deviceLabel, method string) (*HasuraLoginResponse, error) {
+	hasTwoFactor, err := twoFactorEnabled(DB, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("check 2fa: %w", err)
+	}
+	if hasTwoFactor {
+		resp, err := issueTwoFactorChallenge(user, deviceLabel)
+		if err != nil {
+			return nil, fmt.Errorf("issue 2fa challenge: %w", err)
+		}
+		return resp, nil
+	}
+	resp, err := issueLoginTokens(user, newSessionMetadata(s.Request, deviceLabel))
+	if err != nil {
+		return nil, fmt.Errorf("issue login tokens: %w", err)
+	}
+	logAuditEvent(s.Request, auditEntry{Action: auditLoginSucceeded, ActorID: user.ID, Metadata: auditMetadata{"method": method}})
+	return resp, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. A TOTP code is bound to its time step so it cannot be replayed, and a
+// recovery code is burned on use.
+func verifySecondFactor(tx *sqlx.Tx, userID int, code string) error {
+	var totp userTOTP
+	err := tx.Get(&totp, `
+		SELECT secret_encrypted, confirmed_at, last_used_step
+		FROM user_totp WHERE user_id = $1
+		FOR UPDATE
+	`, userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !totp.ConfirmedAt.Valid) {
+		return errTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+
+	secret, err := utils.OpenSecret(totp.SecretEncrypted)
+	if err != nil {
+		return err
+	}
+	if step, ok := utils.ValidateTOTP(secret, code, time.Now()); ok {
+		if step <= totp.LastUsedStep {
+			return errInvalidSecondFactor
+		}
+		_, err := tx.Exec(`UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1`, userID, step)
+		return err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, utils.HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidSecondFactor
+	}
+	log.Printf("[AUTH] recovery code used: user_id=%d", userID)
+	return nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the plain
+// codes. They are shown once; only their hashes are kept.
+func newRecoveryCodes(tx *sqlx.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secret[:5] + "-" + secret[5:10])
+		if _, err := tx.Exec(`
+			INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+			ON CONFLICT (user_id, code_hash) DO NOTHING
+		`, userID, utils.HashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// ==================== Request/Response Types ====================
+
+type EnrollTwoFactorResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type ConfirmTwoFactorResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type VerifyTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// EnrollTwoFactorAction handles the enroll_2fa action from Hasura. It stores a
+// new, unconfirmed secret; 2FA is only enforced after confirm_2fa.
+func EnrollTwoFactorAction(ctx context.Context, s Session, _ struct{}) (EnrollTwoFactorResponse, error) {
+	var resp EnrollTwoFactorResponse
+	userID, _, err := s.ActiveUser()
+	if err != nil {
+		return resp, err
+	}
+
+	enabled, err := twoFactorEnabled(DB, userID)
+	if err != nil {
+		log.Printf("[AUTH] 2fa lookup failed: %v", err)
+		return resp, internalError()
+	}
+	if enabled {
+		return resp, newActionError(codeTwoFactorEnabled)
+	}
+
+	var email string
+	if err := DB.Get(&email, `SELECT email FROM users WHERE id = $1`, userID); err != nil {
+		return resp, newActionError(codeSessionRevoked)
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return resp, fmt.Errorf("generate totp secret: %w", err)
+	}
+	sealed, err := utils.SealSecret(secret)
+	if err != nil {
+		log.Printf("[AUTH] 2fa secret encryption failed: %v", err)
+		return resp, internalError()
+	}
+	// Restarting enrollment replaces a secret that was never confirmed.
+	if _, err := DB.Exec(`
+		INSERT INTO user_totp (user_id, secret_encrypted) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret_encrypted = EXCLUDED.secret_encrypted, last_used_step = 0, created_at = CURRENT_TIMESTAMP
+		WHERE user_totp.confirmed_at IS NULL
+	`, userID, sealed); err != nil {
+		log.Printf("[AUTH] 2fa enrollment failed: %v", err)
+		return resp, internalError()
+	}
+
+	return EnrollTwoFactorResponse{
+		Secret:     secret,
+		OtpauthURI: utils.TOTPURI(totpIssuer(), email, secret),
+	}, nil
+}
+
+// ConfirmTwoFactorAction handles the confirm_2fa action from Hasura. A valid
+// code from the authenticator turns 2FA on and returns the recovery codes.
+func ConfirmTwoFactorAction(ctx context.Context, s Session, req TwoFactorCodeRequest) (ConfirmTwoFactorResponse, error) {
+	if strings.TrimSpace(req.Code) == "" {
+		return ConfirmTwoFactorResponse{}, missingFields("code")
+	}
+	userID, _, err := s.ActiveUser()
+	if err != nil {
+		return ConfirmTwoFactorResponse{}, err
+	}
+
+	codes, err := confirmTwoFactor(userID, req.Code)
+	switch {
+	case errors.Is(err, errTwoFactorNotEnrolled):
+		return ConfirmTwoFactorResponse{}, newActionError(codeTwoFactorNotEnrolled)
+	case errors.Is(err, errTwoFactorAlreadyActive):
+		return ConfirmTwoFactorResponse{}, newActionError(codeTwoFactorEnabled)
+	case errors.Is(err, errInvalidSecondFactor):
+		return ConfirmTwoFactorResponse{}, newActionError(codeInvalidTwoFactorCode)
+	case err != nil:
+		log.Printf("[AUTH] 2fa confirmation failed: %v", err)
+		return ConfirmTwoFactorResponse{}, internalError()
+	}
+
+	log.Printf("[AUTH] 2fa enabled: user_id=%d", userID)
+	logAuditEvent(s.Request, auditEntry{Action: auditTwoFactorEnabled, ActorID: userID})
+	return ConfirmTwoFactorResponse{RecoveryCodes: codes}, nil
+}
+
+func confirmTwoFactor(userID int, code string) ([]string, error) {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var totp userTOTP
+	err = tx.Get(&totp, `
+		SELECT secret_encrypted, confirmed_at, last_used_step
+		FROM user_totp WHERE user_id = $1
+		FOR UPDATE
+	`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if totp.ConfirmedAt.Valid {
+		return nil, errTwoFactorAlreadyActive
+	}
+
+	secret, err := utils.OpenSecret(totp.SecretEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := utils.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, errInvalidSecondFactor
+	}
+	if _, err := tx.Exec(`
+		UPDATE user_totp SET confirmed_at = CURRENT_TIMESTAMP, last_used_step = $2 WHERE user_id = $1
+	`, userID, step); err != nil {
+		return nil, err
+	}
+	codes, err := newRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTwoFactorAction handles the disable_2fa action from Hasura. It needs
+// a current code (or recovery code) so a stolen session cannot turn 2FA off.
+func DisableTwoFactorAction(ctx context.Context, s Session, req TwoFactorCodeRequest) (AccountActionResponse, error) {
+	if strings.TrimSpace(req.Code) == "" {
+		return AccountActionResponse{}, missingFields("code")
+	}
+	userID, _, err := s.ActiveUser()
+	if err != nil {
+		return AccountActionResponse{}, err
+	}
+
+	err = disableTwoFactor(userID, req.Code)
+	switch {
+	case errors.Is(err, errTwoFactorNotEnrolled):
+		return AccountActionResponse{}, newActionError(codeTwoFactorNotEnrolled)
+	case errors.Is(err, errInvalidSecondFactor):
+		return AccountActionResponse{}, newActionError(codeInvalidTwoFactorCode)
+	case err != nil:
+		log.Printf("[AUTH] 2fa disable failed: %v", err)
+		return AccountActionResponse{}, internalError()
+	}
+
+	log.Printf("[AUTH] 2fa disabled: user_id=%d", userID)
+	logAuditEvent(s.Request, auditEntry{Action: auditTwoFactorDisabled, ActorID: userID})
+	return AccountActionResponse{
+		Success: true,
+		Message: "Two-factor authentication disabled",
+	}, nil
+}
+
+func disableTwoFactor(userID int, code string) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := verifySecondFactor(tx, userID, code); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyTwoFactorAction handles the verify_2fa action from Hasura. It trades
+// the login challenge and a code for the session tokens. Wrong codes count
+// as failed logins for the account.
+func VerifyTwoFactorAction(throttle *LoginThrottle) ActionFunc[VerifyTwoFactorRequest, *HasuraLoginResponse] {
+	return func(ctx context.Context, s Session, req VerifyTwoFactorRequest) (*HasuraLoginResponse, error) {
+		if req.ChallengeToken == "" || strings.TrimSpace(req.Code) == "" {
+			return nil, missingFields("challenge_token", "code")
+		}
+		r := s.Request
+		errInvalidChallenge := newActionError(codeInvalidChallenge)
+
+		userID, claims, err := utils.ParseChallengeToken(req.ChallengeToken, twoFactorChallengePurpose)
+		if err != nil {
+			return nil, errInvalidChallenge
+		}
+
+		var user models.User
+		if err := DB.Get(&user, `SELECT id, name, email, email_verified_at FROM users WHERE id = $1`, userID); err != nil {
+			return nil, errInvalidChallenge
+		}
+
+		ip := clientIP(r)
+		attempt, err := throttle.Begin(ctx, user.Email, ip)
+		if err != nil {
+			log.Printf("[AUTH] login limiter unavailable: %v", err)
+		} else if !attempt.Allowed {
+			logAuditEvent(r, auditEntry{Action: auditLoginThrottled, SubjectID: user.ID, Metadata: auditMetadata{"method": "2fa"}})
+			return nil, limitError(attempt.LimitDecision)
+		}
+
+		jti, _ := claims["jti"].(string)
+		if err := useTwoFactorChallenge(jti, user.ID); err != nil {
+			throttle.Cancel(ctx, attempt)
+			if !errors.Is(err, errChallengeUsedUp) {
+				log.Printf("[AUTH] 2fa challenge lookup failed: %v", err)
+				return nil, internalError()
+			}
+			return nil, errInvalidChallenge
+		}
+
+		tx, err := DB.Beginx()
+		if err != nil {
+			throttle.Cancel(ctx, attempt)
+			return nil, fmt.Errorf("begin 2fa verification: %w", err)
+		}
+		defer tx.Rollback()
+
+		err = verifySecondFactor(tx, user.ID, req.Code)
+		if err == nil {
+			// The challenge is single-use; a concurrent request that also
+			// got this far finds it gone.
+			var used sql.Result
+			if used, err = tx.Exec(`DELETE FROM two_factor_challenges WHERE jti = $1`, jti); err == nil {
+				if n, _ := used.RowsAffected(); n == 0 {
+					err = errChallengeUsedUp
+				}
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		switch {
+		case errors.Is(err, errInvalidSecondFactor):
+			throttle.Failure(attempt)
+			logAuditEvent(r, auditEntry{Action: auditLoginFailed, SubjectID: user.ID, Metadata: auditMetadata{"method": "2fa", "reason": "wrong_code"}})
+			return nil, newActionError(codeInvalidTwoFactorCode)
+		case errors.Is(err, errTwoFactorNotEnrolled), errors.Is(err, errChallengeUsedUp):
+			// 2FA was switched off after the challenge was issued, or another
+			// request completed it first; log in again.
+			throttle.Cancel(ctx, attempt)
+			return nil, errInvalidChallenge
+		case err != nil:
+			throttle.Cancel(ctx, attempt)
+			log.Printf("[AUTH] 2fa verification failed: %v", err)
+			return nil, internalError()
+		}
+
+		throttle.Success(ctx, attempt)
+
+		deviceLabel, _ := claims["device_label"].(string)
+		resp, err := issueLoginTokens(user, newSessionMetadata(r, deviceLabel))
+		if err != nil {
+			return nil, fmt.Errorf("issue login tokens: %w", err)
+		}
+		logAuditEvent(r, auditEntry{Action: auditLoginSucceeded, ActorID: user.ID, Metadata: auditMetadata{"method": "2fa"}})
+		return resp, nil
+	}
+}
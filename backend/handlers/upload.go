@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+
+	"github.com/lib/pq"
+)
+
+// UploadMaxFileBytes returns the largest single file the upload endpoint accepts
+// Default: 10 MiB
+// Can be overridden with UPLOAD_MAX_FILE_BYTES environment variable
+func UploadMaxFileBytes() int64 {
+	return int64(envInt("UPLOAD_MAX_FILE_BYTES", 10<<20))
+}
+
+// UploadMaxRequestBytes returns the largest upload request body, all files included
+// Default: 25 MiB
+// Can be overridden with UPLOAD_MAX_REQUEST_BYTES environment variable
+func UploadMaxRequestBytes() int64 {
+	return int64(envInt("UPLOAD_MAX_REQUEST_BYTES", 25<<20))
+}
+
+// UploadMaxImageDimension returns the largest width or height, in pixels, of an uploaded image
+// Default: 8192
+// Can be overridden with UPLOAD_MAX_IMAGE_DIMENSION environment variable
+func UploadMaxImageDimension() int {
+	return envInt("UPLOAD_MAX_IMAGE_DIMENSION", 8192)
+}
+
+// UploadMaxImagePixels returns the largest pixel count (width × height) of an
+// uploaded image; an animated GIF counts the pixels of all its frames
+// Default: 50 megapixels
+// Can be overridden with UPLOAD_MAX_IMAGE_PIXELS environment variable
+func UploadMaxImagePixels() int {
+	return envInt("UPLOAD_MAX_IMAGE_PIXELS", 50_000_000)
+}
+
+// UploadMaxGIFFrames returns the most frames an uploaded GIF may have
+// Default: 500
+// Can be overridden with UPLOAD_MAX_GIF_FRAMES environment variable
+func UploadMaxGIFFrames() int {
+	return envInt("UPLOAD_MAX_GIF_FRAMES", 500)
+}
+
+// UploadMaxConcurrent returns how many uploaded images this process checks
+// and resizes at once. Each one holds the file, its decoded pixels and its
+// variants in memory, up to a few hundred MB for an image at the pixel
+// limit; further uploads wait for a slot
+// Default: 4
+// Can be overridden with UPLOAD_MAX_CONCURRENT environment variable
+func UploadMaxConcurrent() int {
+	return envInt("UPLOAD_MAX_CONCURRENT", 4)
+}
+
+var uploadSlots = sync.OnceValue(func() chan struct{} {
+	return make(chan struct{}, UploadMaxConcurrent())
+})
+
+// acquireUploadSlot waits until fewer than UploadMaxConcurrent uploads are
+// being processed, and returns the function that frees the slot.
+func acquireUploadSlot(ctx context.Context) (func(), error) {
+	slots := uploadSlots()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// maxUploadFieldBytes bounds the non-file form fields.
+const maxUploadFieldBytes = 64
+
+// UploadedFile is one stored file.
+type UploadedFile struct {
+	URL      string                `json:"url"`
+	Filename string                `json:"filename"`
+	Bytes    int64                 `json:"bytes"`
+	Variants *models.ImageVariants `json:"variants,omitempty"`
+}
+
+type UploadFilesResponse struct {
+	Files []UploadedFile `json:"files"`
+}
+
+var errFileTooLarge = errors.New("file exceeds the size limit")
+
+// sizeLimitedReader passes through at most limit bytes and remembers
+// whether the source had more.
+type sizeLimitedReader struct {
+	r        io.Reader
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	// Read at most one byte past the limit, so a file of exactly limit
+	// bytes still passes.
+	if max := l.limit + 1 - l.n; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		l.exceeded = true
+		return 0, errFileTooLarge
+	}
+	return n, err
+}
+
+// formatBytes renders a size limit for error messages.
+func formatBytes(n int64) string {
+	if n >= 1<<20 && n%(1<<20) == 0 {
+		return strconv.FormatInt(n>>20, 10) + " MB"
+	}
+	if n >= 1<<10 && n%(1<<10) == 0 {
+		return strconv.FormatInt(n>>10, 10) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}
+
+// sanitizeUpload checks that data is an allowed image and strips its
+// metadata; see utils.SanitizeImage.
+func sanitizeUpload(data []byte) ([]byte, utils.ImageInfo, *ActionError) {
+	limits := utils.ImageLimits{
+		MaxDimension: UploadMaxImageDimension(),
+		MaxPixels:    UploadMaxImagePixels(),
+		MaxFrames:    UploadMaxGIFFrames(),
+	}
+	clean, info, err := utils.SanitizeImage(data, limits)
+	switch {
+	case errors.Is(err, utils.ErrUnsupportedImage):
+		return nil, info, newActionError(codeUnsupportedImageType)
+	case errors.Is(err, utils.ErrImageDimensions):
+		return nil, info, newActionError(codeImageTooLarge).with("max", strconv.Itoa(limits.MaxDimension))
+	case errors.Is(err, utils.ErrImagePixels):
+		return nil, info, newActionError(codeImageTooManyPixels).with("max", strconv.Itoa(limits.MaxPixels/1_000_000))
+	case errors.Is(err, utils.ErrImageFrames):
+		return nil, info, newActionError(codeImageTooManyFrames).with("max", strconv.Itoa(limits.MaxFrames))
+	case err != nil:
+		return nil, info, newActionError(codeInvalidImage)
+	}
+	return clean, info, nil
+}
+
+// storeUploadedImage stores an image that passed sanitizeUpload for userID
+// and records it. When the user already stored the same content, the
+// existing upload's URL and variants are returned and nothing is stored.
+// Storage failures are logged and returned as an *ActionError.
+func storeUploadedImage(ctx context.Context, userID int, data []byte, info utils.ImageInfo) (string, *models.ImageVariants, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	url, variants, err := findUploadedImage(ctx, userID, hash)
+	if err != nil {
+		return "", nil, err
+	}
+	if variants != nil {
+		return url, variants, nil
+	}
+
+	key := uploadFilename(info.Ext)
+	url, err = Blobs.Put(ctx, key, bytes.NewReader(data), info.ContentType)
+	if err != nil {
+		log.Printf("upload failed for user_id=%d: %v", userID, err)
+		return "", nil, newActionError(codeUploadFailed)
+	}
+	variants, err = recordUploadedImage(ctx, userID, key, url, hash, data, info)
+	if err != nil {
+		return "", nil, err
+	}
+	return url, variants, nil
+}
+
+// findUploadedImage returns the URL and variants of an upload of userID with
+// content hash, if there is one. A match that nothing references yet gets a
+// fresh grace period, so the sweeper does not delete it before the caller
+// can attach it; the row lock also makes a concurrent sweep wait.
+func findUploadedImage(ctx context.Context, userID int, hash string) (string, *models.ImageVariants, error) {
+	var found struct {
+		URL string `db:"url"`
+		models.ImageVariants
+	}
+	err := DB.GetContext(ctx, &found, `
+		UPDATE uploads u
+		SET unreferenced_since = CASE WHEN u.ref_count = 0 THEN CURRENT_TIMESTAMP END
+		FROM image_variants v
+		WHERE v.url = u.url AND u.id = (
+			SELECT id FROM uploads WHERE user_id = $1 AND sha256 = $2 ORDER BY id LIMIT 1
+		)
+		RETURNING u.url, v.thumbnail_url, v.card_url, v.full_url, COALESCE(v.placeholder, '') AS placeholder
+	`, userID, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("find uploaded image: %w", err)
+	}
+	return found.URL, &found.ImageVariants, nil
+}
+
+// recordUploadedImage stores the variants of an image stored under key and
+// records the upload for userID: in uploads, with its content hash, for the
+// sweeper (V25) and for reuse, and in image_variants, where recipe_images
+// rows and recipe thumbnails pick up the variants by URL. Only recorded URLs
+// can be attached to a recipe (V24). When variants cannot be generated or
+// stored, the original stands in for every variant.
+func recordUploadedImage(ctx context.Context, userID int, key, url, hash string, data []byte, info utils.ImageInfo) (*models.ImageVariants, error) {
+	variants, variantKeys, err := putImageVariants(ctx, key, data, info)
+	if err != nil {
+		log.Printf("image variants of %s failed: %v", key, err)
+		variants = &models.ImageVariants{ThumbnailURL: url, CardURL: url, FullURL: url}
+		variantKeys = nil
+	}
+
+	tx, err := DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("record uploaded image: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO uploads (user_id, storage_key, url, variant_keys, content_type, bytes, sha256)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (url) DO NOTHING
+	`, userID, key, url, pq.StringArray(variantKeys), info.ContentType, len(data), hash); err != nil {
+		return nil, fmt.Errorf("record upload: %w", err)
+	}
+	width, height := info.DisplaySize()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO image_variants (url, thumbnail_url, card_url, full_url, placeholder, width, height)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+		ON CONFLICT (url) DO NOTHING
+	`, url, variants.ThumbnailURL, variants.CardURL, variants.FullURL, variants.Placeholder, width, height); err != nil {
+		return nil, fmt.Errorf("record image variants: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("record uploaded image: %w", err)
+	}
+	return variants, nil
+}
+
+// putImageVariants generates the variants of an image and stores them next
+// to it, named <key without extension>_<variant><ext>. It returns their URLs
+// and storage keys.
+func putImageVariants(ctx context.Context, key string, data []byte, info utils.ImageInfo) (*models.ImageVariants, []string, error) {
+	generated, placeholder, err := utils.GenerateImageVariants(data, info, UploadMaxImagePixels())
+	if err != nil {
+		return nil, nil, err
+	}
+	variants := &models.ImageVariants{Placeholder: placeholder}
+	keys := make([]string, 0, len(generated))
+	base := strings.TrimSuffix(key, path.Ext(key))
+	for _, v := range generated {
+		variantKey := base + "_" + v.Name + v.Ext
+		variantURL, err := Blobs.Put(ctx, variantKey, bytes.NewReader(v.Data), v.ContentType)
+		if err != nil {
+			// Variants stored so far are not recorded anywhere; remove them
+			for _, stored := range keys {
+				Blobs.Delete(ctx, stored)
+			}
+			return nil, nil, fmt.Errorf("store %s variant: %w", v.Name, err)
+		}
+		keys = append(keys, variantKey)
+		switch v.Name {
+		case "thumbnail":
+			variants.ThumbnailURL = variantURL
+		case "card":
+			variants.CardURL = variantURL
+		case "full":
+			variants.FullURL = variantURL
+		}
+	}
+	return variants, keys, nil
+}
+
+// errUploadRead wraps a failure reading a file part from the request body.
+var errUploadRead = errors.New("reading upload")
+
+// storeUploadPart reads one file part while holding an upload slot, then
+// checks and stores it like storeUploadedImage.
+func storeUploadPart(ctx context.Context, userID int, part *multipart.Part, maxFile int64) (UploadedFile, error) {
+	release, err := acquireUploadSlot(ctx)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	defer release()
+
+	src := &sizeLimitedReader{r: part, limit: maxFile}
+	data, err := io.ReadAll(src)
+	switch {
+	case src.exceeded:
+		return UploadedFile{}, errFileTooLarge
+	case err != nil:
+		return UploadedFile{}, fmt.Errorf("%w: %w", errUploadRead, err)
+	}
+	clean, info, actionErr := sanitizeUpload(data)
+	if actionErr != nil {
+		return UploadedFile{}, actionErr
+	}
+	url, variants, err := storeUploadedImage(ctx, userID, clean, info)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	return UploadedFile{
+		URL:      url,
+		Filename: part.FileName(),
+		Bytes:    int64(len(clean)),
+		Variants: variants,
+	}, nil
+}
+
+// uploadReadError maps a failure reading the request body.
+func uploadReadError(err error, maxRequest int64) *ActionError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newActionError(codeRequestTooLarge).with("max", formatBytes(maxRequest))
+	}
+	return newActionError(codeInvalidBody)
+}
+
+// UploadHandler serves POST /uploads, a multipart/form-data alternative to
+// the base64 upload action for large files. The files are handled one at a
+// time: each "file" part is read into memory, up to the file size limit,
+// because it has to be decoded and stripped of metadata by sanitizeUpload
+// before the cleaned copy is stored. So at most one file of a request is
+// held at once, and only while it holds an upload slot (see
+// UploadMaxConcurrent); the rest of the body stays unread until then. An
+// optional "purpose" field of "avatar", sent before the files, makes the
+// first file the caller's avatar. The caller authenticates with its access
+// token as a Bearer token.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeActionError(w, r, newActionError(codeMethodNotAllowed))
+		return
+	}
+	userID, _, err := sessionFromBearer(r)
+	if err != nil {
+		var actionErr *ActionError
+		if !errors.As(err, &actionErr) {
+			actionErr = internalError()
+		}
+		writeActionError(w, r, actionErr)
+		return
+	}
+
+	maxFile, maxRequest := UploadMaxFileBytes(), UploadMaxRequestBytes()
+	// Refuse oversized requests up front when the client declares a length;
+	// MaxBytesReader enforces the limit on chunked bodies as they stream.
+	if r.ContentLength > maxRequest {
+		writeActionError(w, r, newActionError(codeRequestTooLarge).with("max", formatBytes(maxRequest)))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequest)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeActionError(w, r, newActionError(codeUnsupportedMediaType))
+		return
+	}
+
+	var purpose string
+	uploaded := []UploadedFile{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeActionError(w, r, uploadReadError(err, maxRequest))
+			return
+		}
+
+		switch part.FormName() {
+		case "purpose":
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			if err != nil {
+				writeActionError(w, r, uploadReadError(err, maxRequest))
+				return
+			}
+			purpose = strings.TrimSpace(string(value))
+		case "file":
+			if part.FileName() == "" {
+				writeActionError(w, r, missingFields("file"))
+				return
+			}
+			if declared, err := strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64); err == nil && declared > maxFile {
+				writeActionError(w, r, newActionError(codeFileTooLarge).with("max", formatBytes(maxFile)))
+				return
+			}
+
+			file, err := storeUploadPart(r.Context(), userID, part, maxFile)
+			if err != nil {
+				var actionErr *ActionError
+				switch {
+				case errors.As(err, &actionErr):
+				case errors.Is(err, errFileTooLarge):
+					actionErr = newActionError(codeFileTooLarge).with("max", formatBytes(maxFile))
+				case errors.Is(err, errUploadRead):
+					actionErr = uploadReadError(err, maxRequest)
+				default:
+					log.Printf("upload failed for user_id=%d: %v", userID, err)
+					actionErr = internalError()
+				}
+				writeActionError(w, r, actionErr)
+				return
+			}
+
+			uploaded = append(uploaded, file)
+			logAuditEvent(r, auditEntry{Action: auditUploadCreated, ActorID: userID, Metadata: auditMetadata{
+				"url":     file.URL,
+				"purpose": purpose,
+				"bytes":   file.Bytes,
+			}})
+		}
+		part.Close()
+	}
+	if len(uploaded) == 0 {
+		writeActionError(w, r, missingFields("file"))
+		return
+	}
+
+	if purpose == "avatar" {
+		if _, err := DB.Exec(`UPDATE users SET avatar_url = $1 WHERE id = $2`, uploaded[0].URL, userID); err != nil {
+			log.Printf("avatar update failed for user_id=%d: %v", userID, err)
+			writeActionError(w, r, internalError())
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(UploadFilesResponse{Files: uploaded})
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// uploadSweepBatch bounds the uploads deleted in one transaction.
+const uploadSweepBatch = 100
+
+// uploadGracePeriod returns how long an upload may stay unreferenced before
+// it is deleted, and how long an expired direct upload is kept
+// Default: 24 hours
+// Can be overridden with UPLOAD_GC_GRACE_HOURS environment variable
+func uploadGracePeriod() time.Duration {
+	return time.Duration(envInt("UPLOAD_GC_GRACE_HOURS", 24)) * time.Hour
+}
+
+// uploadSweepInterval returns how often the sweeper runs
+// Default: 1 hour
+// Can be overridden with UPLOAD_GC_INTERVAL_MINUTES environment variable
+func uploadSweepInterval() time.Duration {
+	return time.Duration(envInt("UPLOAD_GC_INTERVAL_MINUTES", 60)) * time.Minute
+}
+
+// ==================== Service Layer ====================
+
+// UploadSweeper deletes uploaded files nothing uses any more: uploads whose
+// reference count has been zero for the grace period (see V25 and V26), and
+// the client's copy of direct uploads whose signed parameters expired (V31).
+type UploadSweeper struct {
+	db       *sqlx.DB
+	store    utils.BlobStore
+	logger   *log.Logger
+	grace    time.Duration
+	interval time.Duration
+}
+
+func NewUploadSweeper(db *sqlx.DB, store utils.BlobStore, logger *log.Logger) *UploadSweeper {
+	if logger == nil {
+		logger = log.New(os.Stderr, "[upload-gc] ", log.LstdFlags)
+	}
+	return &UploadSweeper{
+		db:       db,
+		store:    store,
+		logger:   logger,
+		grace:    uploadGracePeriod(),
+		interval: uploadSweepInterval(),
+	}
+}
+
+// Run sweeps until ctx is cancelled. Several replicas can run it at once;
+// uploads are claimed with FOR UPDATE SKIP LOCKED.
+func (s *UploadSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			s.logger.Printf("upload sweep failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep runs one pass: it deletes uploads unreferenced past the grace period
+// and expired direct uploads.
+func (s *UploadSweeper) Sweep(ctx context.Context) error {
+	for {
+		n, err := s.deleteUnreferenced(ctx)
+		if err != nil {
+			return err
+		}
+		if n < uploadSweepBatch {
+			break
+		}
+	}
+	return s.deleteExpiredDirectUploads(ctx)
+}
+
+type sweptUpload struct {
+	ID          int64          `db:"id"`
+	StorageKey  string         `db:"storage_key"`
+	URL         string         `db:"url"`
+	VariantKeys pq.StringArray `db:"variant_keys"`
+}
+
+// deleteUnreferenced deletes one batch of uploads unreferenced past the grace
+// period and returns how many it claimed. The rows go first, so a URL is
+// never left pointing at a deleted file; a file whose deletion fails is only
+// logged.
+func (s *UploadSweeper) deleteUnreferenced(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var ids []int64
+	if err := tx.SelectContext(ctx, &ids, `
+		SELECT id FROM uploads
+		WHERE ref_count = 0 AND unreferenced_since < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, s.grace.Seconds(), uploadSweepBatch); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Linking an upload or reusing it for identical content updates its row,
+	// so one attempted from now on waits for this transaction; a link then
+	// fails its foreign key check and a reuse stores the content afresh.
+	var swept []sweptUpload
+	if err := tx.SelectContext(ctx, &swept, `
+		DELETE FROM uploads
+		WHERE id = ANY($1) AND ref_count = 0
+		RETURNING id, storage_key, url, variant_keys
+	`, pq.Array(ids)); err != nil {
+		return 0, err
+	}
+	urls := make([]string, len(swept))
+	for i, upload := range swept {
+		urls[i] = upload.URL
+	}
+	// Without its image_variants row the URL can no longer be attached (V24)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM image_variants WHERE url = ANY($1)`, pq.Array(urls)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, upload := range swept {
+		for _, key := range append([]string{upload.StorageKey}, upload.VariantKeys...) {
+			if err := s.store.Delete(ctx, key); err != nil {
+				s.logger.Printf("deleting %s of upload %d failed: %v", key, upload.ID, err)
+			}
+		}
+	}
+	if len(swept) > 0 {
+		s.logger.Printf("deleted %d unreferenced uploads", len(swept))
+	}
+	return len(ids), nil
+}
+
+// deleteExpiredDirectUploads deletes the client's copy of direct uploads
+// whose signed parameters have expired, and rejects those never completed.
+// Completed and rejected uploads are included: the client could write to
+// the key again until the parameters expired.
+func (s *UploadSweeper) deleteExpiredDirectUploads(ctx context.Context) error {
+	var expired []directUpload
+	if err := s.db.SelectContext(ctx, &expired, `
+		UPDATE direct_uploads
+		SET status = CASE WHEN status = 'pending' THEN 'rejected' ELSE status END,
+			storage_cleared_at = CURRENT_TIMESTAMP
+		WHERE storage_cleared_at IS NULL AND expires_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		RETURNING id, storage_key, purpose, max_bytes, status, url, expires_at
+	`, s.grace.Seconds()); err != nil {
+		return err
+	}
+	for _, upload := range expired {
+		if err := s.store.Delete(ctx, upload.StorageKey); err != nil {
+			s.logger.Printf("deleting expired direct upload %d failed: %v", upload.ID, err)
+		}
+	}
+	return nil
+}
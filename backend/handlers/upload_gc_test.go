@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// testBlobStore points Blobs at a LocalStore in a temporary directory for
+// the duration of the test.
+func testBlobStore(t *testing.T) *utils.LocalStore {
+	t.Helper()
+	store := &utils.LocalStore{Dir: t.TempDir(), BaseURL: "http://localhost:8081/files"}
+	previous := Blobs
+	Blobs = store
+	t.Cleanup(func() { Blobs = previous })
+	return store
+}
+
+// testSweeper sweeps store with a one-hour grace period.
+func testSweeper(db *sqlx.DB, store utils.BlobStore) *UploadSweeper {
+	return &UploadSweeper{db: db, store: store, logger: log.New(io.Discard, "", 0), grace: time.Hour, interval: time.Hour}
+}
+
+// testPNG encodes a small image of one colour; different colours give
+// different content hashes.
+func testPNG(t *testing.T, c color.RGBA) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type testUpload struct {
+	ID                int64          `db:"id"`
+	StorageKey        string         `db:"storage_key"`
+	URL               string         `db:"url"`
+	VariantKeys       pq.StringArray `db:"variant_keys"`
+	RefCount          int            `db:"ref_count"`
+	Unreferenced      bool           `db:"unreferenced"`
+	UnreferencedSince *time.Time     `db:"unreferenced_since"`
+}
+
+// uploadImage stores data for userID the way the upload endpoints do and
+// returns its URL. The user's uploads are deleted after the test.
+func uploadImage(t *testing.T, db *sqlx.DB, userID int, data []byte) string {
+	t.Helper()
+	clean, info, actionErr := sanitizeUpload(data)
+	if actionErr != nil {
+		t.Fatalf("sanitize: %v", actionErr)
+	}
+	url, _, err := storeUploadedImage(context.Background(), userID, clean, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM image_variants WHERE url IN (SELECT url FROM uploads WHERE user_id = $1)`, userID)
+		db.Exec(`DELETE FROM uploads WHERE user_id = $1`, userID)
+	})
+	return url
+}
+
+// findUpload returns the upload recorded for url, or nil.
+func findUpload(t *testing.T, db *sqlx.DB, url string) *testUpload {
+	t.Helper()
+	var uploads []testUpload
+	if err := db.Select(&uploads, `
+		SELECT id, storage_key, url, variant_keys, ref_count, unreferenced_since IS NOT NULL AS unreferenced, unreferenced_since
+		FROM uploads WHERE url = $1
+	`, url); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) == 0 {
+		return nil
+	}
+	return &uploads[0]
+}
+
+// backdate moves an upload's unreferenced_since past the grace period.
+func backdate(t *testing.T, db *sqlx.DB, url string) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE uploads SET unreferenced_since = unreferenced_since - INTERVAL '2 hours' WHERE url = $1`, url); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storedFile(store *utils.LocalStore, key string) bool {
+	_, err := os.Stat(filepath.Join(store.Dir, filepath.FromSlash(key)))
+	return err == nil
+}
+
+func setAvatar(t *testing.T, db *sqlx.DB, userID int, url string) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE users SET avatar_url = NULLIF($1, '') WHERE id = $2`, url, userID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadSweeper(t *testing.T) {
+	db := testDB(t)
+	store := testBlobStore(t)
+	user := createTestUser(t, db, "correct horse battery")
+	sweeper := testSweeper(db, store)
+	ctx := context.Background()
+
+	abandoned := uploadImage(t, db, user.ID, testPNG(t, color.RGBA{200, 40, 40, 255}))
+	avatar := uploadImage(t, db, user.ID, testPNG(t, color.RGBA{40, 200, 40, 255}))
+	fresh := uploadImage(t, db, user.ID, testPNG(t, color.RGBA{40, 40, 200, 255}))
+	setAvatar(t, db, user.ID, avatar)
+	backdate(t, db, abandoned)
+
+	gone := findUpload(t, db, abandoned)
+	if gone == nil || len(gone.VariantKeys) == 0 {
+		t.Fatalf("upload = %+v, want a row with variants", gone)
+	}
+	if err := sweeper.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if findUpload(t, db, abandoned) != nil {
+		t.Error("upload unreferenced past the grace period was kept")
+	}
+	for _, key := range append([]string{gone.StorageKey}, gone.VariantKeys...) {
+		if storedFile(store, key) {
+			t.Errorf("%s of the swept upload is still stored", key)
+		}
+	}
+	var variants int
+	if err := db.Get(&variants, `SELECT COUNT(*) FROM image_variants WHERE url = $1`, abandoned); err != nil {
+		t.Fatal(err)
+	}
+	if variants != 0 {
+		t.Error("swept upload can still be attached through image_variants")
+	}
+
+	for name, url := range map[string]string{"referenced": avatar, "within the grace period": fresh} {
+		kept := findUpload(t, db, url)
+		if kept == nil {
+			t.Errorf("%s upload was swept", name)
+			continue
+		}
+		if !storedFile(store, kept.StorageKey) {
+			t.Errorf("%s upload lost its file", name)
+		}
+	}
+
+	// Once the avatar is replaced, the old one is swept after the grace
+	// period like any other.
+	setAvatar(t, db, user.ID, "")
+	if err := sweeper.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if findUpload(t, db, avatar) == nil {
+		t.Fatal("upload was swept as soon as it became unreferenced")
+	}
+	backdate(t, db, avatar)
+	if err := sweeper.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if findUpload(t, db, avatar) != nil {
+		t.Error("former avatar was kept past the grace period")
+	}
+}
+
+func TestUploadRefCounts(t *testing.T) {
+	db := testDB(t)
+	store := testBlobStore(t)
+	owner := createTestUser(t, db, "correct horse battery")
+	other := createTestUser(t, db, "correct horse battery")
+	data := testPNG(t, color.RGBA{120, 90, 30, 255})
+
+	url := uploadImage(t, db, owner.ID, data)
+	if again := uploadImage(t, db, owner.ID, data); again != url {
+		t.Errorf("the same content was stored twice: %s and %s", url, again)
+	}
+	var count int
+	if err := db.Get(&count, `SELECT COUNT(*) FROM uploads WHERE user_id = $1`, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d uploads recorded for identical content, want 1", count)
+	}
+	if theirs := uploadImage(t, db, other.ID, data); theirs == url {
+		t.Error("another user's upload was reused")
+	}
+
+	refs := func(want int) *testUpload {
+		t.Helper()
+		u := findUpload(t, db, url)
+		if u == nil {
+			t.Fatal("upload is gone")
+		}
+		if u.RefCount != want || u.Unreferenced != (want == 0) {
+			t.Errorf("ref_count %d unreferenced %v, want %d", u.RefCount, u.Unreferenced, want)
+		}
+		return u
+	}
+	refs(0)
+	setAvatar(t, db, owner.ID, url)
+	refs(1)
+	setAvatar(t, db, other.ID, url)
+	refs(2)
+	setAvatar(t, db, owner.ID, url) // unchanged, not counted again
+	refs(2)
+	setAvatar(t, db, owner.ID, "")
+	refs(1)
+	setAvatar(t, db, other.ID, "")
+	refs(0)
+
+	// Storing the content again while it waits to be swept restarts the
+	// grace period, so the caller can still attach it.
+	backdate(t, db, url)
+	if again := uploadImage(t, db, owner.ID, data); again != url {
+		t.Fatalf("reuse returned %s, want %s", again, url)
+	}
+	u := refs(0)
+	if u.UnreferencedSince == nil || time.Since(*u.UnreferencedSince) > time.Minute {
+		t.Errorf("reuse did not restart the grace period: unreferenced since %v", u.UnreferencedSince)
+	}
+	if err := testSweeper(db, store).Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	refs(0)
+}
+
+func TestSweepExpiredDirectUploads(t *testing.T) {
+	db := testDB(t)
+	store := testBlobStore(t)
+	user := createTestUser(t, db, "correct horse battery")
+	ctx := context.Background()
+
+	// Each direct upload has a file in the store, as if the client had
+	// used its signed parameters.
+	direct := func(name, status string, expiredFor time.Duration) string {
+		t.Helper()
+		key := "direct/" + name + "-" + time.Now().Format("150405.000000000") + ".jpg"
+		if _, err := store.Put(ctx, key, bytes.NewReader([]byte("client bytes")), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`
+			INSERT INTO direct_uploads (user_id, storage_key, purpose, max_bytes, status, expires_at)
+			VALUES ($1, $2, 'recipe', 1024, $3, CURRENT_TIMESTAMP - make_interval(secs => $4))
+		`, user.ID, key, status, expiredFor.Seconds()); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	abandoned := direct("abandoned", "pending", 2*time.Hour)
+	completed := direct("completed", "completed", 2*time.Hour)
+	recent := direct("recent", "pending", time.Minute)
+	open := direct("open", "pending", -time.Hour)
+
+	if err := testSweeper(db, store).Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	state := func(key string) (status string, cleared bool) {
+		t.Helper()
+		var row struct {
+			Status  string `db:"status"`
+			Cleared bool   `db:"cleared"`
+		}
+		if err := db.Get(&row, `SELECT status, storage_cleared_at IS NOT NULL AS cleared FROM direct_uploads WHERE storage_key = $1`, key); err != nil {
+			t.Fatal(err)
+		}
+		return row.Status, row.Cleared
+	}
+	tests := []struct {
+		key     string
+		status  string
+		cleared bool
+	}{
+		{abandoned, "rejected", true},
+		{completed, "completed", true},
+		{recent, "pending", false},
+		{open, "pending", false},
+	}
+	for _, tt := range tests {
+		status, cleared := state(tt.key)
+		if status != tt.status || cleared != tt.cleared {
+			t.Errorf("%s: status %s cleared %v, want %s cleared %v", tt.key, status, cleared, tt.status, tt.cleared)
+		}
+		if storedFile(store, tt.key) == tt.cleared {
+			t.Errorf("%s: file stored = %v after the sweep", tt.key, !tt.cleared)
+		}
+	}
+}
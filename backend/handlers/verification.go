@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"foodrecipes/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrEmailNotVerified         = errors.New("email address must be verified first")
+	errVerificationTokenInvalid = errors.New("verification token is invalid or expired")
+	errAlreadyVerified          = errors.New("email address is already verified")
+	errVerificationThrottled    = errors.New("a verification email was sent recently")
+)
+
+// settingVerifiedEmailForCheckout is the app_settings key that blocks paid
+// checkout for unverified accounts. Publishing is guarded by the
+// require_verified_email_for_publish key inside a recipes trigger (V14).
+const settingVerifiedEmailForCheckout = "require_verified_email_for_checkout"
+
+// resendVerificationInterval is the minimum gap between verification emails.
+const resendVerificationInterval = time.Minute
+
+// emailVerificationTTL returns how long a verification link stays valid
+// Default: 48 hours
+// Can be overridden with EMAIL_VERIFICATION_TOKEN_HOURS environment variable
+func emailVerificationTTL() time.Duration {
+	if v := getEnv("EMAIL_VERIFICATION_TOKEN_HOURS", ""); v != "" {
+		if hours, err := strconv.Atoi(v); err == nil && hours > 0 {
+			return time.Duration(hours) * time.Hour
+		}
+	}
+	return 48 * time.Hour
+}
+
+// requireVerifiedEmail returns ErrEmailNotVerified when the rule stored under
+// settingKey is on and the user has not confirmed their address.
+func requireVerifiedEmail(db sqlx.Queryer, userID int, settingKey string) error {
+	var allowed bool
+	err := sqlx.Get(db, &allowed, `
+		SELECT NOT app_setting_enabled($2) OR email_verified_at IS NOT NULL
+		FROM users WHERE id = $1
+	`, userID, settingKey)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// SendVerificationEmail issues a new verification token for the address and mails the link.
+func (s *AccountService) SendVerificationEmail(userID int, name, email string) error {
+	token, err := utils.GenerateOpaqueToken(32)
+	if err != nil {
+		return err
+	}
+	link, err := s.emailLink("/verify-email", token)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the newest link for this address is valid. Links for another
+	// address, such as a pending email change, stay usable.
+	if _, err := tx.Exec(`
+		DELETE FROM email_verification_tokens
+		WHERE user_id = $1 AND LOWER(email) = LOWER($2) AND used_at IS NULL
+	`, userID, email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, email, utils.HashToken(token), time.Now().Add(emailVerificationTTL())); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	msg := utils.MailMessage{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours.\n",
+			firstNameFromUserName(name),
+			link,
+			int(emailVerificationTTL().Hours()),
+		),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.mailer.Send(ctx, msg)
+}
+
+// ResendVerificationEmail mails a fresh link to a signed-in user who has not verified yet.
+func (s *AccountService) ResendVerificationEmail(userID int) error {
+	var user struct {
+		Name       string       `db:"name"`
+		Email      string       `db:"email"`
+		VerifiedAt sql.NullTime `db:"email_verified_at"`
+		LastSentAt sql.NullTime `db:"last_sent_at"`
+	}
+	err := s.db.Get(&user, `
+		SELECT u.name, u.email, u.email_verified_at,
+		       (SELECT MAX(created_at) FROM email_verification_tokens t WHERE t.user_id = u.id) AS last_sent_at
+		FROM users u WHERE u.id = $1
+	`, userID)
+	if err != nil {
+		return err
+	}
+	if user.VerifiedAt.Valid {
+		return errAlreadyVerified
+	}
+	if user.LastSentAt.Valid && time.Since(user.LastSentAt.Time) < resendVerificationInterval {
+		return errVerificationThrottled
+	}
+	return s.SendVerificationEmail(userID, user.Name, user.Email)
+}
+
+// deleteOpenVerificationTokens drops the user's unused verification links,
+// including pending email changes. Call it wherever the account is secured
+// again (password change or reset), so a change started by someone else
+// cannot be completed afterwards.
+func deleteOpenVerificationTokens(tx *sqlx.Tx, userID int) error {
+	_, err := tx.Exec(`DELETE FROM email_verification_tokens WHERE user_id = $1 AND used_at IS NULL`, userID)
+	return err
+}
+
+// VerifyEmail consumes a verification token and marks the address verified,
+// completing an email change when the token was sent to a new address.
+func (s *AccountService) VerifyEmail(token string) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return errVerificationTokenInvalid
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var row struct {
+		ID     int64  `db:"id"`
+		UserID int    `db:"user_id"`
+		Email  string `db:"email"`
+	}
+	err = tx.Get(&row, `
+		SELECT id, user_id, email
+		FROM email_verification_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		FOR UPDATE
+	`, utils.HashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return errVerificationTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	var user struct {
+		Name  string `db:"name"`
+		Email string `db:"email"`
+	}
+	if err := tx.Get(&user, `SELECT name, email FROM users WHERE id = $1 FOR UPDATE`, row.UserID); err != nil {
+		return errVerificationTokenInvalid
+	}
+
+	// The link only confirms the address it was sent to. A link sent to a
+	// different address comes from change_email and moves the account there.
+	changed := !strings.EqualFold(user.Email, row.Email)
+	if changed {
+		if err := s.applyEmailChange(tx, row.UserID, row.Email); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP) WHERE id = $1
+	`, row.UserID); err != nil {
+		return err
+	}
+	// Spend this link and every other open one of the user: a link to an
+	// earlier, possibly mistyped, change target or to the previous address
+	// must not move the account again later.
+	if _, err := tx.Exec(`
+		UPDATE email_verification_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND used_at IS NULL
+	`, row.UserID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if changed {
+		s.logger.Printf("email changed: user_id=%d", row.UserID)
+		logAuditEvent(nil, auditEntry{Action: auditEmailChanged, SubjectID: row.UserID, Metadata: auditMetadata{
+			"old_email": maskEmail(user.Email),
+			"new_email": maskEmail(row.Email),
+		}})
+		go s.notifyEmailChanged(user.Name, user.Email, row.Email)
+	}
+	return nil
+}
+
+// ==================== Request/Response Types ====================
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ==================== HTTP Handlers ====================
+
+// VerifyEmailAction handles the verify_email action from Hasura.
+func VerifyEmailAction(svc *AccountService) ActionFunc[VerifyEmailRequest, AccountActionResponse] {
+	return func(ctx context.Context, s Session, req VerifyEmailRequest) (AccountActionResponse, error) {
+		err := svc.VerifyEmail(req.Token)
+		switch {
+		case errors.Is(err, errVerificationTokenInvalid):
+			return AccountActionResponse{}, newActionError(codeInvalidVerificationToken)
+		case errors.Is(err, errEmailTaken):
+			return AccountActionResponse{}, newActionError(codeEmailExists)
+		case err != nil:
+			svc.logger.Printf("email verification failed: %v", err)
+			return AccountActionResponse{}, internalError()
+		}
+
+		return AccountActionResponse{
+			Success: true,
+			Message: "Email address verified",
+		}, nil
+	}
+}
+
+// ResendVerificationAction handles the resend_verification_email action from Hasura.
+func ResendVerificationAction(svc *AccountService) ActionFunc[struct{}, AccountActionResponse] {
+	return func(ctx context.Context, s Session, _ struct{}) (AccountActionResponse, error) {
+		userID, _, err := s.ActiveUser()
+		if err != nil {
+			return AccountActionResponse{}, err
+		}
+
+		err = svc.ResendVerificationEmail(userID)
+		switch {
+		case errors.Is(err, errAlreadyVerified):
+			return AccountActionResponse{}, newActionError(codeEmailAlreadyVerified)
+		case errors.Is(err, errVerificationThrottled):
+			return AccountActionResponse{}, newActionError(codeTooManyRequests)
+		case err != nil:
+			svc.logger.Printf("resend verification failed for user_id=%d: %v", userID, err)
+			return AccountActionResponse{}, internalError()
+		}
+
+		return AccountActionResponse{
+			Success: true,
+			Message: "Verification email sent",
+		}, nil
+	}
+}
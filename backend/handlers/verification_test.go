@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"foodrecipes/models"
+	"foodrecipes/utils"
+)
+
+// createUnverifiedUser is createTestUser for an account that has not
+// confirmed its address yet.
+func createUnverifiedUser(t *testing.T, svc *AccountService) models.User {
+	t.Helper()
+	user := createTestUser(t, svc.db, "correct horse battery")
+	if _, err := svc.db.Exec(`UPDATE users SET email_verified_at = NULL WHERE id = $1`, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	user.EmailVerifiedAt = nil
+	return user
+}
+
+func emailState(t *testing.T, svc *AccountService, userID int) (email string, verified bool) {
+	t.Helper()
+	var row struct {
+		Email    string `db:"email"`
+		Verified bool   `db:"verified"`
+	}
+	if err := svc.db.Get(&row, `SELECT email, email_verified_at IS NOT NULL AS verified FROM users WHERE id = $1`, userID); err != nil {
+		t.Fatal(err)
+	}
+	return row.Email, row.Verified
+}
+
+// backdateVerificationMail lets the next resend through the one-minute gap.
+func backdateVerificationMail(t *testing.T, svc *AccountService, userID int) {
+	t.Helper()
+	if _, err := svc.db.Exec(`
+		UPDATE email_verification_tokens SET created_at = created_at - INTERVAL '2 minutes' WHERE user_id = $1
+	`, userID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	svc, mailer := testAccountService(t)
+	user := createUnverifiedUser(t, svc)
+
+	if err := svc.SendVerificationEmail(user.ID, user.Name, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	msg := mailer.next(t)
+	if msg.To != user.Email {
+		t.Errorf("verification mailed to %s, want %s", msg.To, user.Email)
+	}
+	token := linkToken(t, msg, "/verify-email")
+
+	if err := svc.VerifyEmail(" " + token + " "); err != nil {
+		t.Fatal(err)
+	}
+	if email, verified := emailState(t, svc, user.ID); email != user.Email || !verified {
+		t.Errorf("after verifying: email %s verified %v", email, verified)
+	}
+	if err := svc.VerifyEmail(token); !errors.Is(err, errVerificationTokenInvalid) {
+		t.Errorf("reusing the link: err = %v, want errVerificationTokenInvalid", err)
+	}
+	if err := svc.ResendVerificationEmail(user.ID); !errors.Is(err, errAlreadyVerified) {
+		t.Errorf("resend when verified: err = %v, want errAlreadyVerified", err)
+	}
+	for _, guess := range []string{"", " ", "not-a-token"} {
+		if err := svc.VerifyEmail(guess); !errors.Is(err, errVerificationTokenInvalid) {
+			t.Errorf("VerifyEmail(%q): err = %v, want errVerificationTokenInvalid", guess, err)
+		}
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	svc, mailer := testAccountService(t)
+	user := createUnverifiedUser(t, svc)
+
+	if err := svc.SendVerificationEmail(user.ID, user.Name, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	first := linkToken(t, mailer.next(t), "/verify-email")
+	if err := svc.ResendVerificationEmail(user.ID); !errors.Is(err, errVerificationThrottled) {
+		t.Fatalf("immediate resend: err = %v, want errVerificationThrottled", err)
+	}
+	mailer.none(t)
+
+	backdateVerificationMail(t, svc, user.ID)
+	if err := svc.ResendVerificationEmail(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	second := linkToken(t, mailer.next(t), "/verify-email")
+	if err := svc.VerifyEmail(first); !errors.Is(err, errVerificationTokenInvalid) {
+		t.Errorf("replaced link: err = %v, want errVerificationTokenInvalid", err)
+	}
+
+	// An expired link does nothing, the current one still works.
+	if _, err := svc.db.Exec(`UPDATE email_verification_tokens SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 second' WHERE token_hash = $1`,
+		utils.HashToken(second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.VerifyEmail(second); !errors.Is(err, errVerificationTokenInvalid) {
+		t.Errorf("expired link: err = %v, want errVerificationTokenInvalid", err)
+	}
+	if _, verified := emailState(t, svc, user.ID); verified {
+		t.Error("an expired link verified the address")
+	}
+}
+
+func TestEmailChangeVerification(t *testing.T) {
+	svc, mailer := testAccountService(t)
+	user := createUnverifiedUser(t, svc)
+	newEmail := "moved-" + user.Email
+	typo := "moevd-" + user.Email
+
+	if err := svc.SendVerificationEmail(user.ID, user.Name, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	current := linkToken(t, mailer.next(t), "/verify-email")
+
+	if err := svc.RequestEmailChange(user.ID, "wrong password", newEmail); !errors.Is(err, errInvalidPassword) {
+		t.Fatalf("wrong password: err = %v, want errInvalidPassword", err)
+	}
+	if err := svc.RequestEmailChange(user.ID, "correct horse battery", typo); err != nil {
+		t.Fatal(err)
+	}
+	mistyped := linkToken(t, mailer.next(t), "/verify-email")
+	if err := svc.RequestEmailChange(user.ID, "correct horse battery", newEmail); err != nil {
+		t.Fatal(err)
+	}
+	msg := mailer.next(t)
+	if msg.To != newEmail {
+		t.Fatalf("change confirmation mailed to %s, want %s", msg.To, newEmail)
+	}
+	change := linkToken(t, msg, "/verify-email")
+
+	// Resending for the current address leaves the pending change alone.
+	backdateVerificationMail(t, svc, user.ID)
+	if err := svc.ResendVerificationEmail(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	current = linkToken(t, mailer.next(t), "/verify-email")
+	if email, _ := emailState(t, svc, user.ID); email != user.Email {
+		t.Fatalf("email changed to %s before confirmation", email)
+	}
+
+	if err := svc.VerifyEmail(change); err != nil {
+		t.Fatal(err)
+	}
+	if email, verified := emailState(t, svc, user.ID); email != newEmail || !verified {
+		t.Errorf("after confirming: email %s verified %v, want %s verified", email, verified, newEmail)
+	}
+	if notice := mailer.next(t); notice.To != user.Email {
+		t.Errorf("change notice mailed to %s, want the old address %s", notice.To, user.Email)
+	}
+
+	// Every other open link is spent: neither the old address nor the
+	// mistyped one can take the account back.
+	for name, token := range map[string]string{"old address": current, "mistyped address": mistyped} {
+		if err := svc.VerifyEmail(token); !errors.Is(err, errVerificationTokenInvalid) {
+			t.Errorf("%s link after the change: err = %v, want errVerificationTokenInvalid", name, err)
+		}
+	}
+	if email, _ := emailState(t, svc, user.ID); email != newEmail {
+		t.Errorf("email moved on to %s", email)
+	}
+}
+
+func TestEmailChangeToTakenAddress(t *testing.T) {
+	svc, mailer := testAccountService(t)
+	user := createTestUser(t, svc.db, "correct horse battery")
+	other := createTestUser(t, svc.db, "correct horse battery")
+
+	if err := svc.RequestEmailChange(user.ID, "correct horse battery", other.Email); !errors.Is(err, errEmailTaken) {
+		t.Errorf("change to a registered address: err = %v, want errEmailTaken", err)
+	}
+	if err := svc.RequestEmailChange(user.ID, "correct horse battery", user.Email); !errors.Is(err, errEmailUnchanged) {
+		t.Errorf("change to the same address: err = %v, want errEmailUnchanged", err)
+	}
+
+	// The address is registered by someone else between request and link.
+	target := "taken-" + user.Email
+	if err := svc.RequestEmailChange(user.ID, "correct horse battery", target); err != nil {
+		t.Fatal(err)
+	}
+	token := linkToken(t, mailer.next(t), "/verify-email")
+	if _, err := svc.db.Exec(`UPDATE users SET email = $1 WHERE id = $2`, target, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.VerifyEmail(token); !errors.Is(err, errEmailTaken) {
+		t.Errorf("confirming a taken address: err = %v, want errEmailTaken", err)
+	}
+	if email, _ := emailState(t, svc, user.ID); email != user.Email {
+		t.Errorf("email changed to %s", email)
+	}
+}
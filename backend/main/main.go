@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 
 	"foodrecipes/handlers"
+	"foodrecipes/utils"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
@@ -31,22 +33,112 @@ func main() {
 	}
 	log.Println("Connected to database")
 
+	// Fail fast on unreadable signing keys instead of on the first login
+	if err := utils.CheckTokenConfig(); err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+	if _, err := utils.PublicJWKS(); err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+
+	// Action handlers trust the session variables in the body, so only Hasura may call them
+	actionSecret := handlers.ActionSecret()
+	if actionSecret == "" {
+		log.Fatal("HASURA_ACTION_SECRET must be set")
+	}
+
 	// Pass the database connection to the handlers package
 	handlers.SetDB(db)
+
+	blobs, err := utils.NewBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure storage: %v", err)
+	}
+	handlers.SetBlobStore(blobs)
+	// Uploaded files nothing uses any more are deleted in the background
+	go handlers.NewUploadSweeper(db, blobs, log.Default()).Run(context.Background())
 	paymentSvc := handlers.NewDefaultPaymentService(db, log.Default())
 
+	mailer, err := utils.NewMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+	accountSvc := handlers.NewAccountService(db, mailer, log.Default())
+
+	loginThrottle, err := handlers.NewLoginThrottleFromEnv(db, log.Default())
+	if err != nil {
+		log.Fatalf("Failed to configure login limiter: %v", err)
+	}
+	go loginThrottle.Run(context.Background())
+	apiKeySvc := handlers.NewAPIKeyService(db, log.Default())
+
+	oidcProviders, err := utils.LoadOIDCProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure OIDC providers: %v", err)
+	}
+	oidcSvc := handlers.NewOIDCService(db, oidcProviders, log.Default())
+
+	// Personal data exports and account deletions run in the background
+	dataRequestSvc := handlers.NewDataRequestService(db, mailer, log.Default())
+	go dataRequestSvc.Run(context.Background())
+	// Personal details in the audit log are scrubbed after the retention period
+	go handlers.NewAuditRetention(db, log.Default()).Run(context.Background())
+
 	// Set up routes for Hasura actions
-	http.HandleFunc("/hasura/login", handlers.HasuraLoginHandler)
-	http.HandleFunc("/hasura/signup", handlers.HasuraSignupHandler)
-	http.HandleFunc("/hasura/upload", handlers.HasuraUploadHandler)
-	http.HandleFunc("/hasura/payment/initialize", handlers.InitializePaymentHandler(paymentSvc))
-	http.HandleFunc("/hasura/payment/verify", handlers.VerifyPaymentHandler(paymentSvc))
+	actions := handlers.NewActionRegistry(http.DefaultServeMux, log.Default())
+	handlers.HandleAction(actions, "/hasura/login", handlers.LoginAction(loginThrottle))
+	handlers.HandleAction(actions, "/hasura/signup", handlers.SignupAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/magic-link/request", handlers.RequestMagicLinkAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/magic-link/consume", handlers.ConsumeMagicLinkAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/oidc/start", handlers.OIDCStartAction(oidcSvc))
+	handlers.HandleAction(actions, "/hasura/oidc/callback", handlers.OIDCCallbackAction(oidcSvc))
+	handlers.HandleAction(actions, "/hasura/refresh", handlers.RefreshAction)
+	handlers.HandleAction(actions, "/hasura/sessions", handlers.ListSessionsAction)
+	handlers.HandleAction(actions, "/hasura/sessions/revoke", handlers.RevokeSessionAction)
+	handlers.HandleAction(actions, "/hasura/sessions/revoke-others", handlers.RevokeOtherSessionsAction)
+	handlers.HandleAction(actions, "/hasura/password/request-reset", handlers.RequestPasswordResetAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/password/reset", handlers.ResetPasswordAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/email/verify", handlers.VerifyEmailAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/email/resend-verification", handlers.ResendVerificationAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/profile/update", handlers.UpdateProfileAction(accountSvc))
+	handlers.HandleAction(actions, "/hasura/profile/change-password", handlers.ChangePasswordAction(accountSvc, loginThrottle))
+	handlers.HandleAction(actions, "/hasura/profile/change-email", handlers.ChangeEmailAction(accountSvc, loginThrottle))
+	handlers.HandleAction(actions, "/hasura/2fa/enroll", handlers.EnrollTwoFactorAction)
+	handlers.HandleAction(actions, "/hasura/2fa/confirm", handlers.ConfirmTwoFactorAction)
+	handlers.HandleAction(actions, "/hasura/2fa/verify", handlers.VerifyTwoFactorAction(loginThrottle))
+	handlers.HandleAction(actions, "/hasura/2fa/disable", handlers.DisableTwoFactorAction)
+	handlers.HandleAction(actions, "/hasura/api-keys", handlers.ListAPIKeysAction(apiKeySvc))
+	handlers.HandleAction(actions, "/hasura/api-keys/create", handlers.CreateAPIKeyAction(apiKeySvc))
+	handlers.HandleAction(actions, "/hasura/api-keys/revoke", handlers.RevokeAPIKeyAction(apiKeySvc))
+	handlers.HandleAction(actions, "/hasura/account/export", handlers.RequestDataExportAction(dataRequestSvc))
+	handlers.HandleAction(actions, "/hasura/account/delete", handlers.RequestAccountDeletionAction(dataRequestSvc, loginThrottle))
+	handlers.HandleAction(actions, "/hasura/account/data-requests", handlers.DataRequestsAction(dataRequestSvc))
+	handlers.HandleAction(actions, "/hasura/admin/roles/grant", handlers.GrantRoleAction)
+	handlers.HandleAction(actions, "/hasura/admin/roles/revoke", handlers.RevokeRoleAction)
+	handlers.HandleAction(actions, "/hasura/admin/audit-events", handlers.AuditEventsAction)
+	handlers.HandleAction(actions, "/hasura/upload", handlers.UploadAction)
+	handlers.HandleAction(actions, "/hasura/upload/direct", handlers.CreateDirectUploadAction)
+	handlers.HandleAction(actions, "/hasura/upload/direct/complete", handlers.CompleteDirectUploadAction)
+	handlers.HandleAction(actions, "/hasura/payment/initialize", handlers.InitializePaymentAction(paymentSvc))
+	handlers.HandleAction(actions, "/hasura/payment/verify", handlers.VerifyPaymentAction(paymentSvc))
 	http.HandleFunc("/hasura/payment/callback", handlers.PaymentCallbackHandler(paymentSvc))
 	http.HandleFunc("/hasura/events/payment-status", handlers.PaymentEventHandler)
 	http.HandleFunc("/payment/", handlers.ConfirmPaymentHandler(paymentSvc))
+	http.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler)
+	http.HandleFunc("/data-exports/download", handlers.DownloadDataExportHandler(dataRequestSvc))
+	http.HandleFunc("/uploads", handlers.UploadHandler)
+	// The local storage driver's files are served by this server
+	if local, ok := blobs.(*utils.LocalStore); ok {
+		http.Handle("/files/", http.StripPrefix("/files", local.Handler()))
+	}
+
+	// Partner API, authenticated with API keys
+	http.HandleFunc("/api/v1/recipes", apiKeySvc.RequireAPIKey(handlers.ScopeRecipesRead, handlers.PartnerRecipesHandler))
+	http.HandleFunc("/api/v1/categories", apiKeySvc.RequireAPIKey(handlers.ScopeCategoriesRead, handlers.PartnerCategoriesHandler))
+	http.HandleFunc("/api/v1/purchases", apiKeySvc.RequireAPIKey(handlers.ScopePurchasesCreate, handlers.PartnerPurchasesHandler(paymentSvc)))
 
 	// Add CORS middleware for the frontend
-	handler := corsMiddleware(http.DefaultServeMux)
+	handler := corsMiddleware(handlers.RequireActionSecret(actionSecret, http.DefaultServeMux))
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -0,0 +1,35 @@
+-- V12: Per-device session registry.
+-- A session is the lifetime of one refresh token family, so the session id
+-- doubles as refresh_tokens.family_id and as the jti claim of access tokens.
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_label VARCHAR(255),
+    ip_address VARCHAR(64),
+    user_agent TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON user_sessions(user_id, revoked_at);
+
+-- Backfill sessions for refresh token families issued before this migration.
+INSERT INTO user_sessions (id, user_id, created_at, last_seen_at, revoked_at)
+SELECT family_id,
+       MIN(user_id),
+       MIN(created_at),
+       MAX(created_at),
+       CASE WHEN BOOL_AND(revoked_at IS NOT NULL OR used_at IS NOT NULL) THEN CURRENT_TIMESTAMP END
+FROM refresh_tokens
+GROUP BY family_id
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE refresh_tokens
+DROP CONSTRAINT IF EXISTS refresh_tokens_family_id_fkey;
+ALTER TABLE refresh_tokens
+ADD CONSTRAINT refresh_tokens_family_id_fkey
+FOREIGN KEY (family_id)
+REFERENCES user_sessions(id)
+ON DELETE CASCADE;
@@ -0,0 +1,56 @@
+-- V14: Email verification.
+-- Verification tokens carry the address they confirm so the same table can
+-- serve signup verification and later address changes.
+
+ALTER TABLE IF EXISTS users
+ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id ON email_verification_tokens(user_id);
+
+-- Runtime switches shared by the Go backend and database triggers.
+-- Flip a value with: UPDATE app_settings SET value = 'true' WHERE key = '...';
+CREATE TABLE IF NOT EXISTS app_settings (
+    key VARCHAR(100) PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO app_settings (key, value) VALUES
+    ('require_verified_email_for_checkout', 'false'),
+    ('require_verified_email_for_publish', 'false')
+ON CONFLICT (key) DO NOTHING;
+
+CREATE OR REPLACE FUNCTION app_setting_enabled(p_key TEXT)
+RETURNS BOOLEAN AS $$
+    SELECT COALESCE((SELECT LOWER(value) IN ('true', 'on', '1', 'yes') FROM app_settings WHERE key = p_key), FALSE);
+$$ LANGUAGE sql STABLE;
+
+-- Block recipe publishing for unverified accounts when the rule is on.
+CREATE OR REPLACE FUNCTION enforce_verified_email_for_publish()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF app_setting_enabled('require_verified_email_for_publish') AND NOT EXISTS (
+        SELECT 1 FROM users u WHERE u.id = NEW.user_id AND u.email_verified_at IS NOT NULL
+    ) THEN
+        RAISE EXCEPTION 'email address must be verified before publishing recipes'
+            USING ERRCODE = 'check_violation', HINT = 'email_not_verified';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_enforce_verified_email_for_publish ON recipes;
+CREATE TRIGGER trg_enforce_verified_email_for_publish
+BEFORE INSERT ON recipes
+FOR EACH ROW
+EXECUTE FUNCTION enforce_verified_email_for_publish();
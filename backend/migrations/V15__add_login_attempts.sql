@@ -0,0 +1,11 @@
+-- V15: Shared failed-login counters for LOGIN_LIMITER_BACKEND=postgres.
+-- Keys look like 'email:<address>' or 'ip:<client ip>'.
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_last_failure_at ON login_attempts(last_failure_at);
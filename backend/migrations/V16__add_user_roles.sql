@@ -0,0 +1,24 @@
+-- V16: Database-backed staff roles emitted in the Hasura JWT claims.
+-- Every account implicitly has the 'user' role; rows here add extra roles.
+-- Bootstrap the first admin by hand:
+--   INSERT INTO user_roles (user_id, role) VALUES (<id>, 'admin');
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(32) NOT NULL CHECK (role IN ('admin', 'moderator', 'creator')),
+    granted_by INT REFERENCES users(id) ON DELETE SET NULL,
+    granted_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role)
+);
+
+-- Audit trail of role grants and revocations.
+CREATE TABLE IF NOT EXISTS role_changes (
+    id BIGSERIAL PRIMARY KEY,
+    actor_user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    target_user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    role VARCHAR(32) NOT NULL,
+    action VARCHAR(16) NOT NULL CHECK (action IN ('grant', 'revoke')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_role_changes_target_user_id ON role_changes(target_user_id, created_at DESC);
@@ -0,0 +1,23 @@
+-- V18: Scoped API keys for partner integrations.
+-- Only the SHA-256 hash of a key is stored; key_prefix is kept in clear so
+-- owners can tell their keys apart. window_start/window_requests hold the
+-- fixed one-minute rate limit window of each key.
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL
+        CHECK (cardinality(scopes) > 0
+               AND scopes <@ ARRAY['recipes:read', 'categories:read', 'purchases:create']::TEXT[]),
+    rate_limit_per_minute INT NOT NULL CHECK (rate_limit_per_minute > 0),
+    window_start TIMESTAMPTZ,
+    window_requests INT NOT NULL DEFAULT 0,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
@@ -0,0 +1,34 @@
+-- V19: Personal data export and account deletion requests.
+-- Requests are processed by a background worker in the backend; the row is
+-- the status the user polls. user_id is cleared when the account is deleted
+-- so the request itself keeps no personal data.
+
+CREATE TABLE IF NOT EXISTS data_requests (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('export', 'deletion')),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+    attempts INT NOT NULL DEFAULT 0,
+    archive_path TEXT,
+    last_error TEXT,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_requests_status ON data_requests(status, requested_at);
+CREATE INDEX IF NOT EXISTS idx_data_requests_user_id ON data_requests(user_id, requested_at DESC);
+
+-- At most one open request of each kind per user.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_data_requests_open
+ON data_requests(user_id, kind)
+WHERE status IN ('pending', 'running');
+
+-- Purchases outlive deleted accounts and recipes for accounting, so both
+-- sides of a purchase may now be anonymized.
+ALTER TABLE IF EXISTS purchases ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE IF EXISTS purchases ALTER COLUMN recipe_id DROP NOT NULL;
+ALTER TABLE IF EXISTS payment_events ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE IF EXISTS payment_events ALTER COLUMN recipe_id DROP NOT NULL;
@@ -0,0 +1,62 @@
+-- V23: Resized variants and BlurHash placeholders of uploaded images.
+-- The backend generates the variants when it stores an upload and records
+-- them in image_variants under the original's URL. recipe_images rows and
+-- recipe thumbnails pick up their variants by URL when they are inserted or
+-- their URL changes, so clients keep saving plain upload URLs through Hasura.
+-- The variant columns stay NULL for images uploaded before this migration.
+
+CREATE TABLE IF NOT EXISTS image_variants (
+    url TEXT PRIMARY KEY,
+    thumbnail_url TEXT NOT NULL,
+    card_url TEXT NOT NULL,
+    full_url TEXT NOT NULL,
+    placeholder TEXT,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE recipe_images
+    ADD COLUMN IF NOT EXISTS thumbnail_url TEXT,
+    ADD COLUMN IF NOT EXISTS card_url TEXT,
+    ADD COLUMN IF NOT EXISTS full_url TEXT,
+    ADD COLUMN IF NOT EXISTS placeholder TEXT;
+
+ALTER TABLE recipes
+    ADD COLUMN IF NOT EXISTS thumbnail_card_url TEXT,
+    ADD COLUMN IF NOT EXISTS thumbnail_placeholder TEXT;
+
+CREATE OR REPLACE FUNCTION set_recipe_image_variants()
+RETURNS TRIGGER AS $$
+BEGIN
+    -- No matching row sets every column to NULL
+    SELECT v.thumbnail_url, v.card_url, v.full_url, v.placeholder
+    INTO NEW.thumbnail_url, NEW.card_url, NEW.full_url, NEW.placeholder
+    FROM image_variants v
+    WHERE v.url = NEW.url;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS recipe_images_set_variants ON recipe_images;
+CREATE TRIGGER recipe_images_set_variants
+BEFORE INSERT OR UPDATE OF url ON recipe_images
+FOR EACH ROW
+EXECUTE FUNCTION set_recipe_image_variants();
+
+CREATE OR REPLACE FUNCTION set_recipe_thumbnail_variants()
+RETURNS TRIGGER AS $$
+BEGIN
+    SELECT v.card_url, v.placeholder
+    INTO NEW.thumbnail_card_url, NEW.thumbnail_placeholder
+    FROM image_variants v
+    WHERE v.url = NEW.thumbnail_url;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS recipes_set_thumbnail_variants ON recipes;
+CREATE TRIGGER recipes_set_thumbnail_variants
+BEFORE INSERT OR UPDATE OF thumbnail_url ON recipes
+FOR EACH ROW
+EXECUTE FUNCTION set_recipe_thumbnail_variants();
@@ -0,0 +1,53 @@
+-- V24: Uploads sent by clients straight to storage with signed parameters.
+-- A row is created when the parameters are signed and completed once the
+-- backend has checked the stored file (see V23's image_variants). Only
+-- images the backend has checked, i.e. recorded in image_variants, can be
+-- attached to a recipe from now on; existing rows are left as they are.
+
+CREATE TABLE IF NOT EXISTS direct_uploads (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    storage_key TEXT NOT NULL UNIQUE,
+    purpose VARCHAR(32),
+    max_bytes BIGINT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'completed', 'rejected')),
+    url TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_direct_uploads_user_id ON direct_uploads(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_direct_uploads_pending ON direct_uploads(expires_at) WHERE status = 'pending';
+
+-- Rejects an image URL the backend has not checked. TG_ARGV[0] names the
+-- URL column; empty and unchanged values are allowed.
+CREATE OR REPLACE FUNCTION require_checked_image_url()
+RETURNS TRIGGER AS $$
+DECLARE
+    new_url TEXT := to_jsonb(NEW) ->> TG_ARGV[0];
+BEGIN
+    IF TG_OP = 'UPDATE' AND (to_jsonb(OLD) ->> TG_ARGV[0]) IS NOT DISTINCT FROM new_url THEN
+        RETURN NEW;
+    END IF;
+    IF COALESCE(new_url, '') <> ''
+        AND NOT EXISTS (SELECT 1 FROM image_variants WHERE url = new_url) THEN
+        RAISE EXCEPTION 'image % was not uploaded through the backend', new_url
+            USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS recipe_images_require_checked_url ON recipe_images;
+CREATE TRIGGER recipe_images_require_checked_url
+BEFORE INSERT OR UPDATE OF url ON recipe_images
+FOR EACH ROW
+EXECUTE FUNCTION require_checked_image_url('url');
+
+DROP TRIGGER IF EXISTS recipes_require_checked_thumbnail ON recipes;
+CREATE TRIGGER recipes_require_checked_thumbnail
+BEFORE INSERT OR UPDATE OF thumbnail_url ON recipes
+FOR EACH ROW
+EXECUTE FUNCTION require_checked_image_url('thumbnail_url');
@@ -0,0 +1,93 @@
+-- V25: Every file the backend stores, so unused ones can be deleted.
+-- The backend records an upload with its variants' storage keys when it
+-- stores it. Rows that use an uploaded image link to it through an
+-- upload_id column, set by trigger from the image URL, so clients keep
+-- saving plain URLs through Hasura. A background sweeper marks uploads
+-- nothing links to and deletes them from storage once they have stayed
+-- unreferenced past a grace period. Files stored before this migration are
+-- not recorded and are never swept.
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    storage_key TEXT NOT NULL UNIQUE,
+    url TEXT NOT NULL UNIQUE,
+    variant_keys TEXT[] NOT NULL DEFAULT '{}',
+    content_type VARCHAR(64) NOT NULL,
+    bytes BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- Set by the sweeper while nothing links to the upload; a new upload
+    -- starts unreferenced
+    unreferenced_since TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_uploads_user_id ON uploads(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_uploads_sha256 ON uploads(sha256);
+CREATE INDEX IF NOT EXISTS idx_uploads_unreferenced ON uploads(unreferenced_since)
+WHERE unreferenced_since IS NOT NULL;
+
+ALTER TABLE recipe_images ADD COLUMN IF NOT EXISTS upload_id BIGINT REFERENCES uploads(id) ON DELETE SET NULL;
+ALTER TABLE recipe_steps ADD COLUMN IF NOT EXISTS upload_id BIGINT REFERENCES uploads(id) ON DELETE SET NULL;
+ALTER TABLE recipes ADD COLUMN IF NOT EXISTS thumbnail_upload_id BIGINT REFERENCES uploads(id) ON DELETE SET NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_upload_id BIGINT REFERENCES uploads(id) ON DELETE SET NULL;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS image_upload_id BIGINT REFERENCES uploads(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_recipe_images_upload_id ON recipe_images(upload_id);
+CREATE INDEX IF NOT EXISTS idx_recipe_steps_upload_id ON recipe_steps(upload_id);
+CREATE INDEX IF NOT EXISTS idx_recipes_thumbnail_upload_id ON recipes(thumbnail_upload_id);
+CREATE INDEX IF NOT EXISTS idx_users_avatar_upload_id ON users(avatar_upload_id);
+CREATE INDEX IF NOT EXISTS idx_categories_image_upload_id ON categories(image_upload_id);
+
+-- Sets the upload id column TG_ARGV[1] from the URL column TG_ARGV[0];
+-- NULL when the URL is not a recorded upload.
+CREATE OR REPLACE FUNCTION link_upload()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW := jsonb_populate_record(NEW, jsonb_build_object(
+        TG_ARGV[1],
+        (SELECT id FROM uploads WHERE url = to_jsonb(NEW) ->> TG_ARGV[0])
+    ));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS recipe_images_link_upload ON recipe_images;
+CREATE TRIGGER recipe_images_link_upload
+BEFORE INSERT OR UPDATE OF url ON recipe_images
+FOR EACH ROW
+EXECUTE FUNCTION link_upload('url', 'upload_id');
+
+DROP TRIGGER IF EXISTS recipe_steps_link_upload ON recipe_steps;
+CREATE TRIGGER recipe_steps_link_upload
+BEFORE INSERT OR UPDATE OF image_url ON recipe_steps
+FOR EACH ROW
+EXECUTE FUNCTION link_upload('image_url', 'upload_id');
+
+DROP TRIGGER IF EXISTS recipes_link_thumbnail_upload ON recipes;
+CREATE TRIGGER recipes_link_thumbnail_upload
+BEFORE INSERT OR UPDATE OF thumbnail_url ON recipes
+FOR EACH ROW
+EXECUTE FUNCTION link_upload('thumbnail_url', 'thumbnail_upload_id');
+
+DROP TRIGGER IF EXISTS users_link_avatar_upload ON users;
+CREATE TRIGGER users_link_avatar_upload
+BEFORE INSERT OR UPDATE OF avatar_url ON users
+FOR EACH ROW
+EXECUTE FUNCTION link_upload('avatar_url', 'avatar_upload_id');
+
+DROP TRIGGER IF EXISTS categories_link_image_upload ON categories;
+CREATE TRIGGER categories_link_image_upload
+BEFORE INSERT OR UPDATE OF image_url ON categories
+FOR EACH ROW
+EXECUTE FUNCTION link_upload('image_url', 'image_upload_id');
+
+-- Whether anything links to an upload. Add new upload_id columns here.
+CREATE OR REPLACE FUNCTION upload_referenced(upload BIGINT)
+RETURNS BOOLEAN AS $$
+    SELECT EXISTS (SELECT 1 FROM recipe_images WHERE upload_id = upload)
+        OR EXISTS (SELECT 1 FROM recipe_steps WHERE upload_id = upload)
+        OR EXISTS (SELECT 1 FROM recipes WHERE thumbnail_upload_id = upload)
+        OR EXISTS (SELECT 1 FROM users WHERE avatar_upload_id = upload)
+        OR EXISTS (SELECT 1 FROM categories WHERE image_upload_id = upload);
+$$ LANGUAGE sql STABLE;
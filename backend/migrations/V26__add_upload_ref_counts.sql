@@ -0,0 +1,101 @@
+-- V26: Reference counts for uploads.
+-- The backend now reuses an upload when the same user stores identical
+-- content again (matched by sha256), so one file can back several recipes,
+-- steps and avatars. Each upload counts the rows linking to it, kept by
+-- trigger as upload_id columns change; unreferenced_since is set when the
+-- count drops to zero and cleared when it rises, and the sweeper only deletes
+-- uploads whose count is zero. This replaces the sweeper's marking pass with
+-- upload_referenced(), which is kept for checks by hand.
+
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS ref_count INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_uploads_user_sha256 ON uploads(user_id, sha256);
+
+-- Keeps uploads.ref_count for the upload id column TG_ARGV[0]. The link_upload
+-- triggers run before this one, so every write is counted whichever columns
+-- it names.
+CREATE OR REPLACE FUNCTION count_upload_refs()
+RETURNS TRIGGER AS $$
+DECLARE
+    old_id BIGINT;
+    new_id BIGINT;
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        old_id := (to_jsonb(OLD) ->> TG_ARGV[0])::BIGINT;
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        new_id := (to_jsonb(NEW) ->> TG_ARGV[0])::BIGINT;
+    END IF;
+    IF old_id IS NOT DISTINCT FROM new_id THEN
+        RETURN NULL;
+    END IF;
+
+    IF old_id IS NOT NULL THEN
+        UPDATE uploads
+        SET ref_count = ref_count - 1,
+            unreferenced_since = CASE WHEN ref_count = 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_since END
+        WHERE id = old_id;
+    END IF;
+    IF new_id IS NOT NULL THEN
+        UPDATE uploads
+        SET ref_count = ref_count + 1, unreferenced_since = NULL
+        WHERE id = new_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS recipe_images_count_upload_refs ON recipe_images;
+CREATE TRIGGER recipe_images_count_upload_refs
+AFTER INSERT OR UPDATE OR DELETE ON recipe_images
+FOR EACH ROW
+EXECUTE FUNCTION count_upload_refs('upload_id');
+
+DROP TRIGGER IF EXISTS recipe_steps_count_upload_refs ON recipe_steps;
+CREATE TRIGGER recipe_steps_count_upload_refs
+AFTER INSERT OR UPDATE OR DELETE ON recipe_steps
+FOR EACH ROW
+EXECUTE FUNCTION count_upload_refs('upload_id');
+
+DROP TRIGGER IF EXISTS recipes_count_thumbnail_upload_refs ON recipes;
+CREATE TRIGGER recipes_count_thumbnail_upload_refs
+AFTER INSERT OR UPDATE OR DELETE ON recipes
+FOR EACH ROW
+EXECUTE FUNCTION count_upload_refs('thumbnail_upload_id');
+
+DROP TRIGGER IF EXISTS users_count_avatar_upload_refs ON users;
+CREATE TRIGGER users_count_avatar_upload_refs
+AFTER INSERT OR UPDATE OR DELETE ON users
+FOR EACH ROW
+EXECUTE FUNCTION count_upload_refs('avatar_upload_id');
+
+DROP TRIGGER IF EXISTS categories_count_image_upload_refs ON categories;
+CREATE TRIGGER categories_count_image_upload_refs
+AFTER INSERT OR UPDATE OR DELETE ON categories
+FOR EACH ROW
+EXECUTE FUNCTION count_upload_refs('image_upload_id');
+
+-- Count the links made before this migration
+UPDATE uploads u
+SET ref_count = refs.n,
+    unreferenced_since = CASE
+        WHEN refs.n > 0 THEN NULL
+        ELSE COALESCE(u.unreferenced_since, CURRENT_TIMESTAMP)
+    END
+FROM (
+    SELECT uploads.id, COALESCE(SUM(l.n), 0)::INT AS n
+    FROM uploads
+    LEFT JOIN (
+        SELECT upload_id AS id, COUNT(*) AS n FROM recipe_images WHERE upload_id IS NOT NULL GROUP BY upload_id
+        UNION ALL
+        SELECT upload_id, COUNT(*) FROM recipe_steps WHERE upload_id IS NOT NULL GROUP BY upload_id
+        UNION ALL
+        SELECT thumbnail_upload_id, COUNT(*) FROM recipes WHERE thumbnail_upload_id IS NOT NULL GROUP BY thumbnail_upload_id
+        UNION ALL
+        SELECT avatar_upload_id, COUNT(*) FROM users WHERE avatar_upload_id IS NOT NULL GROUP BY avatar_upload_id
+        UNION ALL
+        SELECT image_upload_id, COUNT(*) FROM categories WHERE image_upload_id IS NOT NULL GROUP BY image_upload_id
+    ) l ON l.id = uploads.id
+    GROUP BY uploads.id
+) refs
+WHERE u.id = refs.id;
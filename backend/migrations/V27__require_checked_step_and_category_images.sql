@@ -0,0 +1,16 @@
+-- V27: Step and category images must be checked uploads too.
+-- V24 only guarded recipe images and thumbnails, so an unchecked direct
+-- upload could still be attached to a recipe step or a category. Existing
+-- values are kept; see require_checked_image_url.
+
+DROP TRIGGER IF EXISTS recipe_steps_require_checked_image ON recipe_steps;
+CREATE TRIGGER recipe_steps_require_checked_image
+BEFORE INSERT OR UPDATE OF image_url ON recipe_steps
+FOR EACH ROW
+EXECUTE FUNCTION require_checked_image_url('image_url');
+
+DROP TRIGGER IF EXISTS categories_require_checked_image ON categories;
+CREATE TRIGGER categories_require_checked_image
+BEFORE INSERT OR UPDATE OF image_url ON categories
+FOR EACH ROW
+EXECUTE FUNCTION require_checked_image_url('image_url');
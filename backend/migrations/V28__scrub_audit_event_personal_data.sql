@@ -0,0 +1,75 @@
+-- V28: Erase personal details from the audit log.
+-- V22 made audit_events append-only, which also kept IP addresses, user
+-- agents and masked emails forever, even for deleted accounts. Rows can now
+-- be scrubbed, but only through the two functions below, and a scrub can only
+-- clear those details: the event itself, its user ids and its time stay as
+-- they were.
+
+-- Metadata keys that hold (masked) email addresses.
+CREATE OR REPLACE FUNCTION audit_event_personal_keys()
+RETURNS TEXT[] AS $$
+    SELECT ARRAY['email', 'old_email', 'new_email'];
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION reject_audit_event_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+       AND current_setting('audit_events.scrubbing', true) = 'on'
+       AND NEW.id = OLD.id
+       AND NEW.actor_user_id IS NOT DISTINCT FROM OLD.actor_user_id
+       AND NEW.subject_user_id IS NOT DISTINCT FROM OLD.subject_user_id
+       AND NEW.action = OLD.action
+       AND NEW.created_at = OLD.created_at
+       AND NEW.ip_address IS NULL
+       AND NEW.user_agent IS NULL
+       AND OLD.metadata @> NEW.metadata THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+-- scrub_audit_events_for_user erases the personal details of every event the
+-- user acted in or was the subject of. Called by the account deletion job.
+CREATE OR REPLACE FUNCTION scrub_audit_events_for_user(p_user_id INT)
+RETURNS INT AS $$
+DECLARE
+    scrubbed INT;
+BEGIN
+    PERFORM set_config('audit_events.scrubbing', 'on', true);
+    UPDATE audit_events
+    SET ip_address = NULL,
+        user_agent = NULL,
+        metadata = metadata - audit_event_personal_keys()
+    WHERE (actor_user_id = p_user_id OR subject_user_id = p_user_id)
+      AND (ip_address IS NOT NULL OR user_agent IS NOT NULL OR metadata ?| audit_event_personal_keys());
+    GET DIAGNOSTICS scrubbed = ROW_COUNT;
+    PERFORM set_config('audit_events.scrubbing', 'off', true);
+    RETURN scrubbed;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+-- scrub_audit_events_before erases the personal details of every event older
+-- than p_cutoff, including failed logins for unknown emails that belong to
+-- no account. Called by the audit retention job.
+CREATE OR REPLACE FUNCTION scrub_audit_events_before(p_cutoff TIMESTAMPTZ)
+RETURNS INT AS $$
+DECLARE
+    scrubbed INT;
+BEGIN
+    PERFORM set_config('audit_events.scrubbing', 'on', true);
+    UPDATE audit_events
+    SET ip_address = NULL,
+        user_agent = NULL,
+        metadata = metadata - audit_event_personal_keys()
+    WHERE created_at < p_cutoff
+      AND (ip_address IS NOT NULL OR user_agent IS NOT NULL OR metadata ?| audit_event_personal_keys());
+    GET DIAGNOSTICS scrubbed = ROW_COUNT;
+    PERFORM set_config('audit_events.scrubbing', 'off', true);
+    RETURN scrubbed;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+REVOKE ALL ON FUNCTION scrub_audit_events_for_user(INT) FROM PUBLIC;
+REVOKE ALL ON FUNCTION scrub_audit_events_before(TIMESTAMPTZ) FROM PUBLIC;
@@ -0,0 +1,10 @@
+-- V29: Bind OpenID Connect login state to the browser that started it.
+-- oidc_start now also returns a browser binding that the frontend keeps and
+-- sends back with the code; only its hash is stored. Without it, a callback
+-- link made by an attacker could sign the victim in to the attacker's account.
+-- In-flight attempts from before have no binding and are dropped.
+
+DELETE FROM oidc_login_states;
+
+ALTER TABLE oidc_login_states
+    ADD COLUMN IF NOT EXISTS binding_hash CHAR(64) NOT NULL;
@@ -0,0 +1,15 @@
+-- V30: Single-use 2FA login challenges with an attempt limit.
+-- A challenge token carries a jti naming a row here. Each code submitted
+-- against it uses up an attempt before the code is checked; the row is
+-- deleted when the login succeeds, so a token works once, and a token whose
+-- attempts are spent is refused until the user logs in again.
+
+CREATE TABLE IF NOT EXISTS two_factor_challenges (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_two_factor_challenges_expires_at ON two_factor_challenges(expires_at);
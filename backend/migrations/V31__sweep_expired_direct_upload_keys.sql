@@ -0,0 +1,11 @@
+-- V31: Clear the client's key of every direct upload once its signed
+-- parameters expire. Until then they can write to the key again, also after
+-- the upload was completed or rejected, so deleting it then is not enough.
+-- storage_cleared_at marks rows whose key the sweeper has deleted; rows that
+-- already expired are cleared on the next sweep.
+
+ALTER TABLE direct_uploads
+    ADD COLUMN IF NOT EXISTS storage_cleared_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS idx_direct_uploads_pending;
+CREATE INDEX IF NOT EXISTS idx_direct_uploads_uncleared ON direct_uploads(expires_at) WHERE storage_cleared_at IS NULL;
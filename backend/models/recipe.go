@@ -14,17 +14,29 @@ type Unit struct {
 }
 
 type Recipe struct {
-	ID              int           `db:"id" json:"id"`
-	UserID          int           `db:"user_id" json:"user_id"`
-	CategoryID      int           `db:"category_id" json:"category_id"`
-	Title           string        `db:"title" json:"title"`
-	Description     string        `db:"description" json:"description"`
-	PreparationTime int           `db:"preparation_time" json:"preparation_time"` // in minutes
-	Price           float64       `db:"price" json:"price"`
-	ThumbnailURL    string        `db:"thumbnail_url" json:"thumbnail_url"`
-	CreatedAt       time.Time     `db:"created_at" json:"created_at"`
-	Images          []RecipeImage `json:"images"`
-	FeaturedImageID int           `json:"featured_image_id"`
+	ID                   int           `db:"id" json:"id"`
+	UserID               int           `db:"user_id" json:"user_id"`
+	CategoryID           int           `db:"category_id" json:"category_id"`
+	Title                string        `db:"title" json:"title"`
+	Description          string        `db:"description" json:"description"`
+	PreparationTime      int           `db:"preparation_time" json:"preparation_time"` // in minutes
+	Price                float64       `db:"price" json:"price"`
+	ThumbnailURL         string        `db:"thumbnail_url" json:"thumbnail_url"`
+	ThumbnailCardURL     string        `db:"thumbnail_card_url" json:"thumbnail_card_url"`
+	ThumbnailPlaceholder string        `db:"thumbnail_placeholder" json:"thumbnail_placeholder"`
+	CreatedAt            time.Time     `db:"created_at" json:"created_at"`
+	Images               []RecipeImage `json:"images"`
+	FeaturedImageID      int           `json:"featured_image_id"`
+}
+
+// ImageVariants are the resized copies of an uploaded image and a BlurHash
+// placeholder to show while they load. For images uploaded before variants
+// were generated, the URLs are the original's and the placeholder is empty.
+type ImageVariants struct {
+	ThumbnailURL string `db:"thumbnail_url" json:"thumbnail_url"`
+	CardURL      string `db:"card_url" json:"card_url"`
+	FullURL      string `db:"full_url" json:"full_url"`
+	Placeholder  string `db:"placeholder" json:"placeholder"`
 }
 
 // RecipeImage represents an image for a recipe
@@ -33,6 +45,7 @@ type RecipeImage struct {
 	RecipeID   int    `db:"recipe_id" json:"recipe_id"`
 	URL        string `db:"url" json:"url"`
 	IsFeatured bool   `db:"is_featured" json:"is_featured"`
+	ImageVariants
 }
 
 type RecipeIngredient struct {
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps uploaded files. Keys are relative paths such as
+// "1712345678.jpg"; see ValidBlobKey.
+type BlobStore interface {
+	// Put stores the content read from r under key and returns its public URL.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// URL returns the public URL of key. URL("") is the base every stored
+	// file's URL starts with.
+	URL(key string) string
+}
+
+// ErrBlobNotFound is returned by DirectUploader.Open for a key with no file.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// DirectUploader is implemented by stores that clients can upload to
+// directly, so the file does not pass through this server.
+type DirectUploader interface {
+	BlobStore
+	// SignUpload returns the request a client sends to store one file
+	// under key, valid until policy.Expires.
+	SignUpload(key string, policy DirectUploadPolicy) (*SignedUpload, error)
+	// Open reads the file stored under key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+var (
+	_ DirectUploader = (*CloudinaryStore)(nil)
+	_ DirectUploader = (*S3Store)(nil)
+)
+
+// DirectUploadPolicy limits what a signed upload accepts. A backend that
+// cannot enforce a limit leaves it to whoever checks the file afterwards.
+type DirectUploadPolicy struct {
+	MaxBytes int64
+	// Formats are file extensions without the dot, e.g. "jpg".
+	Formats []string
+	Expires time.Time
+}
+
+// SignedUpload is a multipart/form-data POST: Fields first, then the file
+// in FileField.
+type SignedUpload struct {
+	URL       string            `json:"url"`
+	Fields    map[string]string `json:"fields"`
+	FileField string            `json:"file_field"`
+}
+
+// ValidBlobKey reports whether key is safe to use with every backend: a
+// relative path of letters, digits, '.', '_', '-' and '/', without empty or
+// dot segments.
+func ValidBlobKey(key string) bool {
+	if key == "" || len(key) > 512 {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewBlobStoreFromEnv picks the storage backend from STORAGE_DRIVER
+// ("cloudinary", "local" or "s3").
+// Default: cloudinary when CLOUDINARY_CLOUD_NAME is set, otherwise local, so
+// development and CI work without a Cloudinary account.
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	driver := strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE_DRIVER")))
+	if driver == "" {
+		driver = "local"
+		if os.Getenv("CLOUDINARY_CLOUD_NAME") != "" {
+			driver = "cloudinary"
+		}
+	}
+
+	switch driver {
+	case "cloudinary":
+		return NewCloudinaryStoreFromEnv()
+	case "local":
+		return NewLocalStoreFromEnv()
+	case "s3":
+		return NewS3StoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", os.Getenv("STORAGE_DRIVER"))
+	}
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps files in a directory on disk. The Go server serves them
+// through Handler, mounted at /files/.
+type LocalStore struct {
+	Dir string
+	// BaseURL is the public URL Handler is mounted at, without a trailing slash.
+	BaseURL string
+}
+
+// NewLocalStoreFromEnv reads STORAGE_LOCAL_DIR and STORAGE_PUBLIC_URL.
+// Default: ./uploads, served at API_URL/files (http://localhost:8081/files without API_URL)
+func NewLocalStoreFromEnv() (*LocalStore, error) {
+	dir := strings.TrimSpace(os.Getenv("STORAGE_LOCAL_DIR"))
+	if dir == "" {
+		dir = "uploads"
+	}
+	baseURL := strings.TrimSpace(os.Getenv("STORAGE_PUBLIC_URL"))
+	if baseURL == "" {
+		apiURL := strings.TrimSpace(os.Getenv("API_URL"))
+		if apiURL == "" {
+			apiURL = "http://localhost:8081"
+		}
+		baseURL = strings.TrimSuffix(apiURL, "/") + "/files"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage directory: %w", err)
+	}
+	return &LocalStore{Dir: dir, BaseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first so readers never see a partial file.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error) {
+	if !ValidBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	dest := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+	return s.URL(key), nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	if !ValidBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStore) URL(key string) string {
+	return s.BaseURL + "/" + key
+}
+
+// Handler serves stored files by key, relative to where it is mounted.
+// Directories are not listed and temporary files are not served.
+func (s *LocalStore) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if !ValidBlobKey(key) || strings.HasPrefix(filepath.Base(key), ".") {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(s.path(key))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
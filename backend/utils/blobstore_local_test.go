@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidBlobKey(t *testing.T) {
+	valid := []string{"a.jpg", "recipes/12/cover-1_2.webp", "direct/7/x"}
+	invalid := []string{"", "/abs.jpg", "a//b", "./a", "a/../b", "..", "a b", "a\\b", "ü.jpg", "a?b", strings.Repeat("a", 513)}
+	for _, key := range valid {
+		if !ValidBlobKey(key) {
+			t.Errorf("ValidBlobKey(%q) = false", key)
+		}
+	}
+	for _, key := range invalid {
+		if ValidBlobKey(key) {
+			t.Errorf("ValidBlobKey(%q) = true", key)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	s := &LocalStore{Dir: t.TempDir(), BaseURL: "http://localhost:8081/files"}
+	ctx := context.Background()
+
+	url, err := s.Put(ctx, "recipes/1/cover.jpg", strings.NewReader("jpeg bytes"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "http://localhost:8081/files/recipes/1/cover.jpg" {
+		t.Errorf("Put URL = %s", url)
+	}
+	data, err := os.ReadFile(filepath.Join(s.Dir, "recipes", "1", "cover.jpg"))
+	if err != nil || string(data) != "jpeg bytes" {
+		t.Fatalf("stored file = %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.Dir, "recipes", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the key's directory, want only the upload", len(entries))
+	}
+
+	if _, err := s.Put(ctx, "recipes/1/cover.jpg", strings.NewReader("replaced"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.Dir, "recipes", "1", "cover.jpg")); string(data) != "replaced" {
+		t.Errorf("overwritten file = %q", data)
+	}
+
+	if err := s.Delete(ctx, "recipes/1/cover.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "recipes", "1", "cover.jpg")); !os.IsNotExist(err) {
+		t.Errorf("file still exists after Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "recipes/1/cover.jpg"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+
+	for _, key := range []string{"../escape.jpg", "/etc/passwd", "a//b"} {
+		if _, err := s.Put(ctx, key, strings.NewReader("x"), ""); err == nil {
+			t.Errorf("Put(%q) accepted an invalid key", key)
+		}
+		if err := s.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) accepted an invalid key", key)
+		}
+	}
+
+	t.Run("cancelled put leaves nothing behind", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := s.Put(cancelled, "late.jpg", strings.NewReader("x"), ""); err == nil {
+			t.Fatal("Put succeeded with a cancelled context")
+		}
+		entries, _ := os.ReadDir(s.Dir)
+		for _, e := range entries {
+			if e.Name() != "recipes" {
+				t.Errorf("left %s behind", e.Name())
+			}
+		}
+	})
+}
+
+func TestLocalStoreHandler(t *testing.T) {
+	s := &LocalStore{Dir: t.TempDir(), BaseURL: "http://localhost:8081/files"}
+	if _, err := s.Put(context.Background(), "recipes/1/cover.jpg", strings.NewReader("jpeg bytes"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.Dir, "recipes", ".upload-123"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/files", s.Handler()))
+	defer srv.Close()
+
+	get := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get(http.MethodGet, "/files/recipes/1/cover.jpg")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "jpeg bytes" {
+		t.Fatalf("GET stored file = %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("stored files are served without nosniff")
+	}
+
+	for _, path := range []string{"/files/recipes/1", "/files/recipes/.upload-123", "/files/missing.jpg", "/files/recipes/../../etc/passwd"} {
+		if resp := get(http.MethodGet, path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, resp.StatusCode)
+		}
+	}
+	if resp := get(http.MethodDelete, "/files/recipes/1/cover.jpg"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE = %d, want 405", resp.StatusCode)
+	}
+}
@@ -0,0 +1,372 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each multipart upload part. Files smaller than
+// one part go up in a single PUT.
+const s3PartSize = 5 << 20
+
+// S3Store keeps files in an S3-compatible bucket (AWS S3, MinIO, R2, ...).
+// Requests use path-style addressing so any endpoint works without DNS setup.
+type S3Store struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PublicURL is where the bucket's objects can be read, without a
+	// trailing slash.
+	PublicURL  string
+	httpClient *http.Client
+}
+
+// NewS3StoreFromEnv reads S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY_ID,
+// S3_SECRET_ACCESS_KEY and S3_PUBLIC_URL.
+// Default: region us-east-1, the AWS endpoint for the region, and objects
+// read from <endpoint>/<bucket>
+func NewS3StoreFromEnv() (*S3Store, error) {
+	s := &S3Store{
+		Endpoint:        strings.TrimSuffix(strings.TrimSpace(os.Getenv("S3_ENDPOINT")), "/"),
+		Region:          strings.TrimSpace(os.Getenv("S3_REGION")),
+		Bucket:          strings.TrimSpace(os.Getenv("S3_BUCKET")),
+		AccessKeyID:     strings.TrimSpace(os.Getenv("S3_ACCESS_KEY_ID")),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PublicURL:       strings.TrimSuffix(strings.TrimSpace(os.Getenv("S3_PUBLIC_URL")), "/"),
+		httpClient:      &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s.Bucket == "" || s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set for the s3 storage driver")
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %w", err)
+	}
+	if s.PublicURL == "" {
+		s.PublicURL = s.Endpoint + "/" + s.Bucket
+	}
+	return s, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error) {
+	if !ValidBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		header := http.Header{"Content-Type": {contentType}}
+		resp, err := s.do(ctx, http.MethodPut, key, nil, header, buf[:n])
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return s.URL(key), nil
+	case err != nil:
+		return "", err
+	}
+
+	if err := s.putMultipart(ctx, key, contentType, buf, r); err != nil {
+		return "", err
+	}
+	return s.URL(key), nil
+}
+
+// putMultipart uploads first followed by the rest of r part by part, so at
+// most one part is held in memory. The upload is aborted on any error.
+func (s *S3Store) putMultipart(ctx context.Context, key, contentType string, first []byte, r io.Reader) error {
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("s3 multipart upload: no upload id in response")
+	}
+	uploadID := initiated.UploadID
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+
+	err = func() error {
+		part := first
+		for number := 1; ; number++ {
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+			resp, err := s.do(ctx, http.MethodPut, key, query, nil, part)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+			n, err := io.ReadFull(r, first)
+			if n == 0 && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+				return nil
+			}
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return err
+			}
+			part = first[:n]
+		}
+	}()
+	if err == nil {
+		body, _ := xml.Marshal(struct {
+			XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+			Parts   []completedPart `xml:"Part"`
+		}{Parts: parts})
+		err = s.completeMultipart(ctx, key, uploadID, body)
+	}
+	if err != nil {
+		// Best effort: an upload that is never aborted keeps its parts billed.
+		if resp, abortErr := s.do(context.WithoutCancel(ctx), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// completeMultipart finishes an upload. S3 can answer 200 and still report a
+// failure in the body, so the body is checked for an <Error> element.
+func (s *S3Store) completeMultipart(ctx context.Context, key, uploadID string, body []byte) error {
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return fmt.Errorf("s3 complete multipart upload failed: %s", string(b))
+	}
+	return nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if !ValidBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		var statusErr *s3StatusError
+		if errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) URL(key string) string {
+	return s.PublicURL + "/" + key
+}
+
+// s3StatusError is returned by do for responses with a 4xx/5xx status.
+type s3StatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *s3StatusError) Error() string {
+	return fmt.Sprintf("s3 request failed with status %d: %s", e.Status, e.Body)
+}
+
+// do sends a signed request for key in the bucket. Responses with an error
+// status are turned into an *s3StatusError; the caller closes the body of
+// successful ones.
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.signV4(req, body, time.Now().UTC())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &s3StatusError{Status: resp.StatusCode, Body: string(b)}
+	}
+	return resp, nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Store) signV4(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(day), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// signingKey derives the SigV4 key for day (YYYYMMDD).
+func (s *S3Store) signingKey(day string) []byte {
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+// SignUpload returns a presigned POST policy for key. S3 enforces MaxBytes;
+// the formats are left to the caller to check. The object is stored as
+// application/octet-stream so it is never rendered before it is checked.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html
+func (s *S3Store) SignUpload(key string, policy DirectUploadPolicy) (*SignedUpload, error) {
+	if !ValidBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	now := time.Now().UTC()
+	day := now.Format("20060102")
+	fields := map[string]string{
+		"key":              key,
+		"Content-Type":     "application/octet-stream",
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": s.AccessKeyID + "/" + day + "/" + s.Region + "/s3/aws4_request",
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	conditions := []interface{}{
+		map[string]string{"bucket": s.Bucket},
+		[]interface{}{"content-length-range", 1, policy.MaxBytes},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{name: value})
+	}
+	doc, err := json.Marshal(map[string]interface{}{
+		"expiration": policy.Expires.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(doc)
+	fields["policy"] = encoded
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(s.signingKey(day), encoded))
+
+	return &SignedUpload{URL: s.Endpoint + "/" + s.Bucket, Fields: fields, FileField: "file"}, nil
+}
+
+// Open downloads key with a signed GET, so the bucket need not be public.
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !ValidBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		var statusErr *s3StatusError
+		if errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3CanonicalQuery encodes query sorted by name with spaces as %20, the form
+// SigV4 signs; sending the same string keeps the signature valid.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	escape := func(s string) string {
+		return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+	}
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
@@ -10,135 +9,104 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// CloudinaryStore keeps files in a Cloudinary account. It supports unsigned
+// uploads via an upload preset or signed uploads with the API key and secret;
+// deleting always needs the key and secret.
+type CloudinaryStore struct {
+	CloudName    string
+	APIKey       string
+	APISecret    string
+	UploadPreset string
+	httpClient   *http.Client
+}
 
-// It supports unsigned uploads via CLOUDINARY_UPLOAD_PRESET or signed uploads using CLOUDINARY_API_KEY and CLOUDINARY_API_SECRET.
-func UploadToCloudinary(ctx context.Context, file interface{}, filename string) (string, error) {
-	cloudName := os.Getenv("CLOUDINARY_CLOUD_NAME")
-	apiKey := os.Getenv("CLOUDINARY_API_KEY")
-	apiSecret := os.Getenv("CLOUDINARY_API_SECRET")
-	uploadPreset := os.Getenv("CLOUDINARY_UPLOAD_PRESET")
-
-	if cloudName == "" {
-		return "", fmt.Errorf("CLOUDINARY_CLOUD_NAME not set")
-	}
-
-	endpoint := fmt.Sprintf("https://api.cloudinary.com/v1_1/%s/auto/upload", cloudName)
-
-	var reader io.Reader
-	var closer io.Closer
-
-	switch v := file.(type) {
-	case nil:
-		return "", fmt.Errorf("file is nil")
-	case string:
-		f, err := os.Open(v)
-		if err != nil {
-			return "", err
-		}
-		reader = f
-		closer = f
-		if filename == "" {
-			filename = filepath.Base(v)
-		}
-	case []byte:
-		reader = bytes.NewReader(v)
-	case *os.File:
-		reader = v
-		closer = v
-	case *multipart.FileHeader:
-		f, err := v.Open()
-		if err != nil {
-			return "", err
-		}
-		reader = f
-		closer = f
-		if filename == "" {
-			filename = v.Filename
-		}
-	default:
-		if r, ok := v.(io.Reader); ok {
-			reader = r
-		} else {
-			return "", fmt.Errorf("unsupported file type %T", file)
-		}
-	}
-
-	if filename == "" {
-		filename = fmt.Sprintf("upload_%d", time.Now().Unix())
+// NewCloudinaryStoreFromEnv reads CLOUDINARY_CLOUD_NAME, CLOUDINARY_API_KEY,
+// CLOUDINARY_API_SECRET and CLOUDINARY_UPLOAD_PRESET.
+func NewCloudinaryStoreFromEnv() (*CloudinaryStore, error) {
+	s := &CloudinaryStore{
+		CloudName:    strings.TrimSpace(os.Getenv("CLOUDINARY_CLOUD_NAME")),
+		APIKey:       strings.TrimSpace(os.Getenv("CLOUDINARY_API_KEY")),
+		APISecret:    os.Getenv("CLOUDINARY_API_SECRET"),
+		UploadPreset: strings.TrimSpace(os.Getenv("CLOUDINARY_UPLOAD_PRESET")),
+		httpClient:   &http.Client{Timeout: 5 * time.Minute},
 	}
-
-	publicID := strings.TrimSpace(filename)
-	if ext := filepath.Ext(publicID); ext != "" {
-		publicID = strings.TrimSuffix(publicID, ext)
+	if s.CloudName == "" {
+		return nil, fmt.Errorf("CLOUDINARY_CLOUD_NAME must be set for the cloudinary storage driver")
 	}
-	if publicID == "" {
-		publicID = fmt.Sprintf("upload_%d", time.Now().Unix())
+	if s.UploadPreset == "" && (s.APIKey == "" || s.APISecret == "") {
+		return nil, fmt.Errorf("set CLOUDINARY_UPLOAD_PRESET, or CLOUDINARY_API_KEY and CLOUDINARY_API_SECRET")
 	}
+	return s, nil
+}
 
-	if closer != nil {
-		defer closer.Close()
-	}
+// cloudinaryPublicID is the Cloudinary id of key: the key without its extension.
+func cloudinaryPublicID(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key))
+}
 
-	var body bytes.Buffer
-	mw := multipart.NewWriter(&body)
+// sign returns the Cloudinary signature of params:
+// sha1(<sorted params joined as k=v&k=v> + api_secret)
+func (s *CloudinaryStore) sign(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + params[name]
+	}
+	h := sha1.New()
+	h.Write([]byte(strings.Join(pairs, "&") + s.APISecret))
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	fw, err := mw.CreateFormFile("file", filename)
-	if err != nil {
-		return "", err
+func (s *CloudinaryStore) Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error) {
+	if !ValidBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
 	}
-	if _, err := io.Copy(fw, reader); err != nil {
-		mw.Close()
-		return "", err
-	}
-
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-
-	if uploadPreset != "" {
-		_ = mw.WriteField("upload_preset", uploadPreset)
-		_ = mw.WriteField("public_id", publicID)
+	fields := map[string]string{"public_id": cloudinaryPublicID(key)}
+	if s.UploadPreset != "" {
+		fields["upload_preset"] = s.UploadPreset
 	} else {
-		_ = mw.WriteField("timestamp", timestamp)
-		if publicID != "" {
-			_ = mw.WriteField("public_id", publicID)
-		}
-		// create signature: sha1(<params_to_sign> + api_secret)
-		var toSign string
-		if publicID != "" {
-			toSign = fmt.Sprintf("public_id=%s&timestamp=%s", publicID, timestamp)
-		} else {
-			toSign = fmt.Sprintf("timestamp=%s", timestamp)
-		}
-		toSign = toSign + apiSecret
-		h := sha1.New()
-		h.Write([]byte(toSign))
-		signature := hex.EncodeToString(h.Sum(nil))
-		_ = mw.WriteField("api_key", apiKey)
-		_ = mw.WriteField("signature", signature)
-	}
-
-	mw.Close()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+		fields["timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+		fields["signature"] = s.sign(fields)
+		fields["api_key"] = s.APIKey
+	}
+
+	// Stream the form through a pipe so the file is never held in memory;
+	// a read error from the source aborts the request.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(mw, fields, path.Base(key), r))
+	}()
+
+	endpoint := fmt.Sprintf("https://api.cloudinary.com/v1_1/%s/auto/upload", s.CloudName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, pr)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("Content-Type", mw.FormDataContentType())
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
 		return "", fmt.Errorf("upload failed: %s", string(b))
 	}
 
@@ -158,3 +126,122 @@ func UploadToCloudinary(ctx context.Context, file interface{}, filename string)
 
 	return "", fmt.Errorf("no url in cloudinary response")
 }
+
+// writeUploadForm writes the signing fields first and the file last, then
+// closes the form.
+func writeUploadForm(mw *multipart.Writer, fields map[string]string, filename string, file io.Reader) error {
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, file); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+func (s *CloudinaryStore) Delete(ctx context.Context, key string) error {
+	if s.APIKey == "" || s.APISecret == "" {
+		return fmt.Errorf("deleting from Cloudinary needs CLOUDINARY_API_KEY and CLOUDINARY_API_SECRET")
+	}
+	params := map[string]string{
+		"public_id": cloudinaryPublicID(key),
+		"timestamp": strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	form := url.Values{}
+	for name, value := range params {
+		form.Set(name, value)
+	}
+	form.Set("signature", s.sign(params))
+	form.Set("api_key", s.APIKey)
+
+	endpoint := fmt.Sprintf("https://api.cloudinary.com/v1_1/%s/image/destroy", s.CloudName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Result string `json:"result"`
+	}
+	if resp.StatusCode >= 400 || json.NewDecoder(resp.Body).Decode(&res) != nil {
+		return fmt.Errorf("cloudinary delete failed with status %d", resp.StatusCode)
+	}
+	// "not found" means it is already gone
+	if res.Result != "ok" && res.Result != "not found" {
+		return fmt.Errorf("cloudinary delete failed: %s", res.Result)
+	}
+	return nil
+}
+
+func (s *CloudinaryStore) URL(key string) string {
+	base := "https://res.cloudinary.com/" + s.CloudName + "/image/upload/"
+	if key == "" {
+		return base
+	}
+	return base + cloudinaryPublicID(key)
+}
+
+// SignUpload signs an upload straight to Cloudinary. Cloudinary enforces the
+// formats, but not MaxBytes, and accepts a signature for an hour whatever
+// Expires says.
+func (s *CloudinaryStore) SignUpload(key string, policy DirectUploadPolicy) (*SignedUpload, error) {
+	if !ValidBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	if s.APIKey == "" || s.APISecret == "" {
+		return nil, fmt.Errorf("signed uploads need CLOUDINARY_API_KEY and CLOUDINARY_API_SECRET")
+	}
+	publicID := cloudinaryPublicID(key)
+	params := map[string]string{
+		"public_id": path.Base(publicID),
+		"timestamp": strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if folder := path.Dir(publicID); folder != "." {
+		params["folder"] = folder
+	}
+	if len(policy.Formats) > 0 {
+		params["allowed_formats"] = strings.Join(policy.Formats, ",")
+	}
+	fields := map[string]string{"signature": s.sign(params), "api_key": s.APIKey}
+	for name, value := range params {
+		fields[name] = value
+	}
+	return &SignedUpload{
+		URL:       fmt.Sprintf("https://api.cloudinary.com/v1_1/%s/image/upload", s.CloudName),
+		Fields:    fields,
+		FileField: "file",
+	}, nil
+}
+
+// Open downloads key from its public delivery URL.
+func (s *CloudinaryStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cloudinary download failed with status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
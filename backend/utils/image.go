@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupportedImage = errors.New("unsupported image type")
+	ErrInvalidImage     = errors.New("invalid image")
+	ErrImageDimensions  = errors.New("image dimensions exceed the limit")
+	ErrImagePixels      = errors.New("image has too many pixels")
+	ErrImageFrames      = errors.New("image has too many frames")
+)
+
+// ImageLimits bounds the images SanitizeImage accepts, so that decoding one
+// cannot take an unbounded amount of memory.
+type ImageLimits struct {
+	MaxDimension int // largest width or height
+	MaxPixels    int // largest width × height; for a GIF, of all frames together
+	MaxFrames    int // most frames of an animated GIF
+}
+
+// ImageInfo describes an image checked by SanitizeImage. ContentType and Ext
+// come from the image data, never from what the client claimed.
+type ImageInfo struct {
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+	// Orientation is the EXIF orientation (2-8) of a JPEG that has to be
+	// rotated or flipped for display, 0 otherwise.
+	Orientation int
+}
+
+// DisplaySize returns the size of the image once its orientation is applied.
+func (i ImageInfo) DisplaySize() (int, int) {
+	if i.Orientation >= 5 {
+		return i.Height, i.Width
+	}
+	return i.Width, i.Height
+}
+
+// SanitizeImage checks that data is a JPEG, PNG, WebP or GIF image within
+// limits, and returns it with its metadata (EXIF,
+// including GPS, XMP, IPTC, comments and text chunks) removed. Pixel data is
+// copied unchanged, so there is no re-encoding loss. A JPEG keeps its EXIF
+// orientation so photos still display upright.
+//
+// Dimensions, and a GIF's frames, are read from the headers before the image
+// is decoded, so a small file claiming a huge canvas or thousands of frames
+// is refused without allocating them. Animated WebP files cannot be decoded
+// and are refused.
+func SanitizeImage(data []byte, limits ImageLimits) ([]byte, ImageInfo, error) {
+	info := ImageInfo{ContentType: http.DetectContentType(data)}
+	switch info.ContentType {
+	case "image/jpeg":
+		info.Ext = ".jpg"
+	case "image/png":
+		info.Ext = ".png"
+	case "image/gif":
+		info.Ext = ".gif"
+	case "image/webp":
+		info.Ext = ".webp"
+	default:
+		return nil, info, ErrUnsupportedImage
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	info.Width, info.Height = cfg.Width, cfg.Height
+	if err != nil {
+		return nil, info, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, info, ErrInvalidImage
+	}
+	if info.Width > limits.MaxDimension || info.Height > limits.MaxDimension {
+		return nil, info, fmt.Errorf("%w: %dx%d", ErrImageDimensions, info.Width, info.Height)
+	}
+	if info.Width*info.Height > limits.MaxPixels {
+		return nil, info, fmt.Errorf("%w: %dx%d", ErrImagePixels, info.Width, info.Height)
+	}
+
+	var clean []byte
+	switch info.ContentType {
+	case "image/jpeg":
+		if _, err = jpeg.Decode(bytes.NewReader(data)); err == nil {
+			clean, info.Orientation, err = stripJPEGMetadata(data)
+		}
+	case "image/png":
+		if _, err = png.Decode(bytes.NewReader(data)); err == nil {
+			clean, err = stripPNGMetadata(data)
+		}
+	case "image/gif":
+		var frames, pixels int
+		if clean, frames, pixels, err = stripGIFMetadata(data); err != nil {
+			break
+		}
+		if frames > limits.MaxFrames {
+			return nil, info, fmt.Errorf("%w: %d", ErrImageFrames, frames)
+		}
+		if pixels > limits.MaxPixels {
+			return nil, info, fmt.Errorf("%w: %d in %d frames", ErrImagePixels, pixels, frames)
+		}
+		_, err = gif.DecodeAll(bytes.NewReader(clean))
+	case "image/webp":
+		if _, err = webp.Decode(bytes.NewReader(data)); err == nil {
+			clean, err = stripWebPMetadata(data)
+		}
+	}
+	if err != nil {
+		return nil, info, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	return clean, info, nil
+}
+
+var errMalformedImage = errors.New("malformed image structure")
+
+// stripJPEGMetadata copies the segments needed to display the image: APP0
+// JFIF, APP2 ICC profiles, APP14 Adobe and the non-APP segments. Other APPn
+// segments (EXIF, XMP, IPTC, MPF), comments and anything after EOI, such as
+// embedded secondary images, are dropped. The EXIF orientation is returned.
+func stripJPEGMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	i, orientation := 2, 0
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, 0, errMalformedImage
+		}
+		// Markers may be preceded by any number of 0xFF fill bytes
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, 0, errMalformedImage
+		}
+		marker := data[i]
+		i++
+
+		switch {
+		case marker == 0xD9: // EOI
+			return append(out, 0xFF, 0xD9), orientation, nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // no length
+			out = append(out, 0xFF, marker)
+			continue
+		}
+
+		if i+2 > len(data) {
+			return nil, 0, errMalformedImage
+		}
+		n := int(binary.BigEndian.Uint16(data[i:]))
+		if n < 2 || i+n > len(data) {
+			return nil, 0, errMalformedImage
+		}
+		segment := data[i : i+n]
+		payload := segment[2:]
+		i += n
+
+		switch {
+		case marker == 0xE1:
+			if o := exifOrientation(payload); o > 1 {
+				orientation = o
+				exif := orientationEXIF(o)
+				out = append(out, 0xFF, 0xE1, byte((len(exif)+2)>>8), byte(len(exif)+2))
+				out = append(out, exif...)
+			}
+			continue
+		case marker == 0xE0 && bytes.HasPrefix(payload, []byte("JFIF\x00")),
+			marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")),
+			marker == 0xEE && bytes.HasPrefix(payload, []byte("Adobe")):
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+			continue
+		}
+		out = append(out, 0xFF, marker)
+		out = append(out, segment...)
+
+		if marker == 0xDA { // SOS: entropy-coded data runs until the next marker
+			start := i
+			for i < len(data) {
+				if data[i] == 0xFF && i+1 < len(data) {
+					next := data[i+1]
+					if next != 0x00 && !(next >= 0xD0 && next <= 0xD7) {
+						break
+					}
+					i += 2
+					continue
+				}
+				i++
+			}
+			out = append(out, data[start:i]...)
+		}
+	}
+	return nil, 0, errMalformedImage
+}
+
+// exifOrientation returns the Orientation tag from the IFD0 of an APP1 EXIF
+// payload, or 0 when there is none.
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < count; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationEXIF returns an APP1 EXIF payload holding only the Orientation
+// tag: a big-endian TIFF header and an IFD0 with a single SHORT entry.
+func orientationEXIF(orientation int) []byte {
+	b := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	b = append(b, 0x00, 0x01)
+	b = append(b, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, byte(orientation), 0x00, 0x00)
+	return append(b, 0x00, 0x00, 0x00, 0x00)
+}
+
+// pngMetadataChunks are the PNG chunks that carry metadata rather than image
+// data.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata drops metadata chunks and anything after IEND.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+	i := len(signature)
+	for i+8 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, errMalformedImage
+		}
+		if !pngMetadataChunks[typ] {
+			out = append(out, data[i:end]...)
+		}
+		if typ == "IEND" {
+			return out, nil
+		}
+		i = end
+	}
+	return nil, errMalformedImage
+}
+
+// stripGIFMetadata drops comment extensions and application extensions
+// other than the looping ones (NETSCAPE2.0, ANIMEXTS1.0); XMP is stored as an
+// application extension. Anything after the trailer is dropped. It also
+// returns the number of frames and their total pixel count, and refuses
+// frames outside the logical screen.
+func stripGIFMetadata(data []byte) ([]byte, int, int, error) {
+	if len(data) < 13 {
+		return nil, 0, 0, errMalformedImage
+	}
+	screenWidth := int(binary.LittleEndian.Uint16(data[6:]))
+	screenHeight := int(binary.LittleEndian.Uint16(data[8:]))
+	frames, pixels := 0, 0
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << ((data[10] & 0x07) + 1)
+	}
+	if i > len(data) {
+		return nil, 0, 0, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension
+			if i+2 > len(data) {
+				return nil, 0, 0, errMalformedImage
+			}
+			label := data[i+1]
+			end, ok := skipGIFSubBlocks(data, i+2)
+			if !ok {
+				return nil, 0, 0, errMalformedImage
+			}
+			keep := label == 0xF9 || label == 0x01
+			if label == 0xFF && i+14 <= len(data) && data[i+2] == 11 {
+				app := string(data[i+3 : i+14])
+				keep = app == "NETSCAPE2.0" || app == "ANIMEXTS1.0"
+			}
+			if keep {
+				out = append(out, data[i:end]...)
+			}
+			i = end
+		case 0x2C: // image descriptor
+			j := i + 10
+			if j > len(data) {
+				return nil, 0, 0, errMalformedImage
+			}
+			left := int(binary.LittleEndian.Uint16(data[i+1:]))
+			top := int(binary.LittleEndian.Uint16(data[i+3:]))
+			width := int(binary.LittleEndian.Uint16(data[i+5:]))
+			height := int(binary.LittleEndian.Uint16(data[i+7:]))
+			if left+width > screenWidth || top+height > screenHeight {
+				return nil, 0, 0, errMalformedImage
+			}
+			frames++
+			pixels += width * height
+			if data[i+9]&0x80 != 0 {
+				j += 3 << ((data[i+9] & 0x07) + 1)
+			}
+			j++ // LZW minimum code size
+			end, ok := skipGIFSubBlocks(data, j)
+			if !ok {
+				return nil, 0, 0, errMalformedImage
+			}
+			out = append(out, data[i:end]...)
+			i = end
+		case 0x3B: // trailer
+			return append(out, 0x3B), frames, pixels, nil
+		default:
+			return nil, 0, 0, errMalformedImage
+		}
+	}
+	return nil, 0, 0, errMalformedImage
+}
+
+// skipGIFSubBlocks returns the offset just past the data sub-blocks starting
+// at i, including the zero-length terminator.
+func skipGIFSubBlocks(data []byte, i int) (int, bool) {
+	for i < len(data) {
+		n := int(data[i])
+		i++
+		if n == 0 {
+			return i, true
+		}
+		i += n
+	}
+	return 0, false
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks, clears their flags in the
+// VP8X header and drops anything after the RIFF container. It also checks
+// that every chunk fits in the container and that there is image data.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformedImage
+	}
+	end := 8 + int(binary.LittleEndian.Uint32(data[4:]))
+	if end > len(data) {
+		return nil, errMalformedImage
+	}
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	hasImageData := false
+	i := 12
+	for i < end {
+		if i+8 > end {
+			return nil, errMalformedImage
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		next := i + 8 + size + size&1
+		if size < 0 || i+8+size > end {
+			return nil, errMalformedImage
+		}
+		if next > end {
+			next = end
+		}
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(out)
+			out = append(out, data[i:next]...)
+			if size > 0 {
+				out[start+8] &^= 0x08 | 0x04 // EXIF and XMP present
+			}
+		default:
+			if fourCC == "VP8 " || fourCC == "VP8L" || fourCC == "ANMF" {
+				hasImageData = true
+			}
+			out = append(out, data[i:next]...)
+		}
+		i = next
+	}
+	if !hasImageData {
+		return nil, errMalformedImage
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// gpsMarker stands in for the GPS coordinates and other personal data the
+// test images carry in their metadata.
+var gpsMarker = []byte("GPS 9.0249N 38.7469E")
+
+var testLimits = ImageLimits{MaxDimension: 4096, MaxPixels: 4096 * 4096, MaxFrames: 10}
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+// gpsEXIF returns an APP1 EXIF payload with an Orientation tag in IFD0 and a
+// GPS IFD holding gpsMarker.
+func gpsEXIF(orientation int) []byte {
+	le := binary.LittleEndian
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00")
+	// IFD0 at 8: Orientation and a GPSInfo pointer.
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = le.AppendUint16(tiff, 0x0112)
+	tiff = le.AppendUint16(tiff, 3)
+	tiff = le.AppendUint32(tiff, 1)
+	tiff = le.AppendUint32(tiff, uint32(orientation))
+	tiff = le.AppendUint16(tiff, 0x8825)
+	tiff = le.AppendUint16(tiff, 4)
+	tiff = le.AppendUint32(tiff, 1)
+	tiff = le.AppendUint32(tiff, 8+2+2*12+4)
+	tiff = le.AppendUint32(tiff, 0)
+	// GPS IFD: one ASCII entry pointing at the marker.
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = le.AppendUint16(tiff, 0x0001)
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = le.AppendUint32(tiff, uint32(len(gpsMarker)))
+	tiff = le.AppendUint32(tiff, uint32(len(tiff)+4+4))
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, gpsMarker...)
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+func testJPEG(t *testing.T, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(8, 4), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, jpegSegment(0xE1, gpsEXIF(orientation))...)
+	out = append(out, jpegSegment(0xE1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), gpsMarker...))...)
+	out = append(out, jpegSegment(0xFE, gpsMarker)...)
+	out = append(out, data[2:]...)
+	return append(out, gpsMarker...) // trailing data after EOI
+}
+
+func pngChunk(typ string, payload []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	out = append(out, typ...)
+	out = append(out, payload...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(8, 4)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	const ihdrEnd = 8 + 12 + 13
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, pngChunk("eXIf", gpsEXIF(1)[6:])...)
+	out = append(out, pngChunk("tEXt", append([]byte("Comment\x00"), gpsMarker...))...)
+	out = append(out, pngChunk("iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), gpsMarker...))...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func gifExtension(label byte, blocks ...[]byte) []byte {
+	out := []byte{0x21, label}
+	for _, b := range blocks {
+		out = append(out, byte(len(b)))
+		out = append(out, b...)
+	}
+	return append(out, 0)
+}
+
+func testGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 8, 4), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << ((data[10] & 0x07) + 1)
+	}
+	out := append([]byte{}, data[:i]...)
+	out = append(out, gifExtension(0xFE, gpsMarker)...)
+	out = append(out, gifExtension(0xFF, []byte("XMP DataXMP"), gpsMarker)...)
+	return append(out, data[i:]...)
+}
+
+// testWebP is a 1x1 lossless WebP with a VP8X header announcing EXIF, and
+// EXIF and XMP chunks.
+func testWebP() []byte {
+	vp8l := []byte("\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00")
+	chunk := func(fourCC string, payload []byte) []byte {
+		out := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+		out = append(out, payload...)
+		if len(payload)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	var body []byte
+	body = append(body, chunk("VP8X", []byte{0x08 | 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0})...)
+	body = append(body, chunk("VP8L", vp8l[:13])...)
+	body = append(body, chunk("EXIF", gpsEXIF(1)[6:])...)
+	body = append(body, chunk("XMP ", gpsMarker)...)
+	out := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(body)))...)
+	out = append(out, "WEBP"...)
+	return append(out, body...)
+}
+
+func TestSanitizeImageStripsMetadata(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            []byte
+		wantType        string
+		wantWidth       int
+		wantHeight      int
+		wantOrientation int
+	}{
+		{"jpeg", testJPEG(t, 1), "image/jpeg", 8, 4, 0},
+		{"jpeg rotated", testJPEG(t, 6), "image/jpeg", 8, 4, 6},
+		{"png", testPNG(t), "image/png", 8, 4, 0},
+		{"gif", testGIF(t, 3), "image/gif", 8, 4, 0},
+		{"webp", testWebP(), "image/webp", 1, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Contains(tt.data, gpsMarker) {
+				t.Fatal("test image does not carry the marker")
+			}
+			clean, info, err := SanitizeImage(tt.data, testLimits)
+			if err != nil {
+				t.Fatalf("SanitizeImage: %v", err)
+			}
+			if bytes.Contains(clean, gpsMarker) {
+				t.Error("metadata survived sanitizing")
+			}
+			if info.ContentType != tt.wantType || info.Width != tt.wantWidth || info.Height != tt.wantHeight {
+				t.Errorf("info = %+v, want %s %dx%d", info, tt.wantType, tt.wantWidth, tt.wantHeight)
+			}
+			if info.Orientation != tt.wantOrientation {
+				t.Errorf("orientation = %d, want %d", info.Orientation, tt.wantOrientation)
+			}
+
+			img, format, err := image.Decode(bytes.NewReader(clean))
+			if err != nil {
+				t.Fatalf("sanitized image does not decode: %v", err)
+			}
+			if "image/"+format != tt.wantType {
+				t.Errorf("sanitized image decodes as %s", format)
+			}
+			if b := img.Bounds(); b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+				t.Errorf("sanitized image is %dx%d", b.Dx(), b.Dy())
+			}
+
+			// A second pass finds nothing more to remove.
+			again, _, err := SanitizeImage(clean, testLimits)
+			if err != nil || !bytes.Equal(again, clean) {
+				t.Errorf("sanitizing is not idempotent: %v", err)
+			}
+		})
+	}
+}
+
+func TestSanitizeImageKeepsOnlyOrientation(t *testing.T) {
+	clean, _, err := SanitizeImage(testJPEG(t, 6), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(clean, orientationEXIF(6)) {
+		t.Error("orientation EXIF segment missing")
+	}
+	if bytes.Contains(clean, []byte("II\x2a\x00")) {
+		t.Error("original EXIF block survived")
+	}
+}
+
+func TestSanitizeImageLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		limits  ImageLimits
+		wantErr error
+	}{
+		{"too wide", testJPEG(t, 1), ImageLimits{MaxDimension: 4, MaxPixels: 1 << 20, MaxFrames: 10}, ErrImageDimensions},
+		{"too many pixels", testPNG(t), ImageLimits{MaxDimension: 4096, MaxPixels: 31, MaxFrames: 10}, ErrImagePixels},
+		{"too many frames", testGIF(t, 3), ImageLimits{MaxDimension: 4096, MaxPixels: 1 << 20, MaxFrames: 2}, ErrImageFrames},
+		{"too many pixels in all frames", testGIF(t, 3), ImageLimits{MaxDimension: 4096, MaxPixels: 95, MaxFrames: 10}, ErrImagePixels},
+		{"not an image", []byte("%PDF-1.7\n"), testLimits, ErrUnsupportedImage},
+		{"truncated", testPNG(t)[:60], testLimits, ErrInvalidImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := SanitizeImage(tt.data, tt.limits)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
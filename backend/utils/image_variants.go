@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+)
+
+// ImageVariantSpec is one generated size of an uploaded image.
+type ImageVariantSpec struct {
+	Name     string
+	MaxWidth int
+}
+
+// ImageVariantSpecs are the variants generated for every uploaded image.
+// Clients pick variants by name, so names are never changed.
+var ImageVariantSpecs = []ImageVariantSpec{
+	{Name: "thumbnail", MaxWidth: 320},
+	{Name: "card", MaxWidth: 800},
+	{Name: "full", MaxWidth: 1600},
+}
+
+// ImageVariant is an encoded variant.
+type ImageVariant struct {
+	Name        string
+	Data        []byte
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+}
+
+// variantJPEGQuality trades a little sharpness for much smaller files.
+const variantJPEGQuality = 82
+
+// GenerateImageVariants decodes an image checked by SanitizeImage and returns
+// its variants, in ImageVariantSpecs order, and a BlurHash placeholder.
+// Variants are upright, never wider than the original, and encoded as JPEG,
+// or PNG when the image has transparency; there is no WebP encoder in Go, so
+// WebP uploads get JPEG or PNG variants too. Animated GIFs use their first
+// frame. Images of more than maxPixels pixels return ErrImagePixels without
+// being decoded.
+//
+// The decoded image is scaled down to the largest variant before anything
+// else, so apart from the decoder's own buffer only variant-sized images are
+// allocated.
+func GenerateImageVariants(data []byte, info ImageInfo, maxPixels int) ([]ImageVariant, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, "", fmt.Errorf("%w: %dx%d", ErrImagePixels, cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	largest := 0
+	for _, spec := range ImageVariantSpecs {
+		largest = max(largest, spec.MaxWidth)
+	}
+	// MaxWidth applies once the image is upright: a photo shot sideways is
+	// scaled by its height
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	displayWidth := sw
+	if info.Orientation >= 5 {
+		displayWidth = sh
+	}
+	if displayWidth > largest {
+		sw, sh = max(1, (sw*largest+displayWidth/2)/displayWidth), max(1, (sh*largest+displayWidth/2)/displayWidth)
+	}
+	img := orient(downscale(src, sw, sh), info.Orientation)
+	opaque := img.Opaque()
+
+	variants := make([]ImageVariant, 0, len(ImageVariantSpecs))
+	for _, spec := range ImageVariantSpecs {
+		resized := resizeToWidth(img, spec.MaxWidth)
+		v := ImageVariant{Name: spec.Name, Width: resized.Rect.Dx(), Height: resized.Rect.Dy()}
+		var buf bytes.Buffer
+		if opaque {
+			v.ContentType, v.Ext = "image/jpeg", ".jpg"
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: variantJPEGQuality})
+		} else {
+			v.ContentType, v.Ext = "image/png", ".png"
+			err = png.Encode(&buf, resized)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		v.Data = buf.Bytes()
+		variants = append(variants, v)
+	}
+	return variants, BlurHash(resizeToWidth(img, 32), 4, 3), nil
+}
+
+// downscale returns src as an RGBA image of width × height, no larger than
+// src, averaging the source pixels under each destination pixel. Source rows
+// are converted to RGBA a few at a time, so src is never copied whole.
+func downscale(src image.Image, width, height int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	strip := image.NewRGBA(image.Rect(0, 0, sw, (sh+height-1)/height+1))
+	sums := make([]uint64, width*4)
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := max((y+1)*sh/height, y0+1)
+		rows := image.Rect(0, 0, sw, y1-y0)
+		draw.Draw(strip, rows, src, image.Pt(b.Min.X, b.Min.Y+y0), draw.Src)
+
+		clear(sums)
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := max((x+1)*sw/width, x0+1)
+			for sy := 0; sy < y1-y0; sy++ {
+				row := strip.Pix[sy*strip.Stride+x0*4 : sy*strip.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sums[x*4] += uint64(row[i])
+					sums[x*4+1] += uint64(row[i+1])
+					sums[x*4+2] += uint64(row[i+2])
+					sums[x*4+3] += uint64(row[i+3])
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			o := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(sums[x*4+c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// orient rotates and flips src as EXIF orientation o asks.
+func orient(src *image.RGBA, o int) *image.RGBA {
+	if o < 2 || o > 8 {
+		return src
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flipped
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:])
+		}
+	}
+	return dst
+}
+
+// resizeToWidth scales src down to width, keeping its aspect ratio, by
+// averaging the source pixels under each destination pixel. src is returned
+// as is when it is not wider than width.
+func resizeToWidth(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if width >= sw {
+		return src
+	}
+	height := max(1, (sh*width+sw/2)/sw)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := max((y+1)*sh/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := max((x+1)*sw/width, x0+1)
+			var r, g, b, a uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			o := y*dst.Stride + x*4
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(b / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// BlurHash encodes img as a BlurHash (https://blurha.sh) with the given
+// number of horizontal and vertical components (1-9 each). img should be
+// small; every component visits every pixel.
+func BlurHash(img *image.RGBA, xComponents, yComponents int) string {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					o := y*img.Stride + x*4
+					f[0] += basis * srgbToLinear(img.Pix[o])
+					f[1] += basis * srgbToLinear(img.Pix[o+1])
+					f[2] += basis * srgbToLinear(img.Pix[o+2])
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(base83(quantisedMax, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+
+	hash.WriteString(base83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(base83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func base83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func TestBlurHashUniformImage(t *testing.T) {
+	// Characters 2-5 hold the average colour. Black has no AC energy at
+	// all, so every AC component encodes as zero ("fQ").
+	tests := []struct {
+		name   string
+		color  color.RGBA
+		wantDC string
+	}{
+		{"white", color.RGBA{255, 255, 255, 255}, "TSUA"},
+		{"black", color.RGBA{0, 0, 0, 255}, "0000"},
+		{"red", color.RGBA{255, 0, 0, 255}, "TI:j"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+			draw.Draw(img, img.Rect, image.NewUniform(tt.color), image.Point{}, draw.Src)
+			got := BlurHash(img, 4, 3)
+			if len(got) != 28 || got[0] != 'L' || got[2:6] != tt.wantDC {
+				t.Errorf("BlurHash = %q, want L?%s followed by 11 AC components", got, tt.wantDC)
+			}
+		})
+	}
+
+	black := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	draw.Draw(black, black.Rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	if got, want := BlurHash(black, 4, 3), "L00000"+strings.Repeat("fQ", 11); got != want {
+		t.Errorf("BlurHash of black = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateImageVariants(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(2400, 1600), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	tests := []struct {
+		name        string
+		orientation int
+		want        [][2]int // width, height per ImageVariantSpecs entry
+	}{
+		{"landscape", 0, [][2]int{{320, 213}, {800, 534}, {1600, 1067}}},
+		{"rotated 90°", 6, [][2]int{{320, 480}, {800, 1200}, {1600, 2400}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := ImageInfo{ContentType: "image/jpeg", Width: 2400, Height: 1600, Orientation: tt.orientation}
+			variants, hash, err := GenerateImageVariants(data, info, 2400*1600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hash) != 28 {
+				t.Errorf("BlurHash %q has length %d, want 28", hash, len(hash))
+			}
+			if len(variants) != len(tt.want) {
+				t.Fatalf("got %d variants, want %d", len(variants), len(tt.want))
+			}
+			for i, v := range variants {
+				if v.Name != ImageVariantSpecs[i].Name || v.Width != tt.want[i][0] || v.Height != tt.want[i][1] {
+					t.Errorf("variant %d = %s %dx%d, want %s %dx%d", i, v.Name, v.Width, v.Height, ImageVariantSpecs[i].Name, tt.want[i][0], tt.want[i][1])
+				}
+				cfg, err := jpeg.DecodeConfig(bytes.NewReader(v.Data))
+				if err != nil || cfg.Width != v.Width || cfg.Height != v.Height {
+					t.Errorf("variant %s does not decode to its size: %v", v.Name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateImageVariantsPixelLimit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(64, 64), nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := GenerateImageVariants(buf.Bytes(), ImageInfo{Width: 64, Height: 64}, 64*64-1)
+	if !errors.Is(err, ErrImagePixels) {
+		t.Errorf("err = %v, want ErrImagePixels", err)
+	}
+}
@@ -12,25 +12,23 @@ import (
 	"github.com/golang-jwt/jwt"
 )
 
+// getJWTSecret resolves the shared HS256 secret used when JWT_KEYS_DIR is not
+// configured. It reads JWT_SECRET, or the "key" of a Hasura-style JSON secret.
 func getJWTSecret() ([]byte, error) {
 	secret := os.Getenv("JWT_SECRET")
 	if secret == "" {
 		// Fallback to Hasura-style JSON secret if present.
-		hasuraSecret := os.Getenv("HASURA_GRAPHQL_JWT_SECRET")
+		hasuraSecret := strings.TrimSpace(os.Getenv("HASURA_GRAPHQL_JWT_SECRET"))
 		if hasuraSecret == "" {
 			return nil, errors.New("JWT_SECRET is not set")
 		}
-		trimmed := strings.TrimSpace(hasuraSecret)
-		if strings.HasPrefix(trimmed, "{") {
-			var payload struct {
-				Key string `json:"key"`
-			}
-			if err := json.Unmarshal([]byte(trimmed), &payload); err == nil && payload.Key != "" {
-				return []byte(payload.Key), nil
-			}
+		var payload struct {
+			Key string `json:"key"`
 		}
-		// Use raw value as a last resort.
-		return []byte(hasuraSecret), nil
+		if err := json.Unmarshal([]byte(hasuraSecret), &payload); err != nil || payload.Key == "" {
+			return nil, errors.New("HASURA_GRAPHQL_JWT_SECRET must be a JSON object with a \"key\"; set JWT_SECRET or JWT_KEYS_DIR instead")
+		}
+		return []byte(payload.Key), nil
 	}
 	return []byte(secret), nil
 }
@@ -40,30 +38,42 @@ func GetJWTSecret() ([]byte, error) {
 	return getJWTSecret()
 }
 
-// getTokenExpiration returns the token expiration duration
-// Default: 7 days (168 hours)
-// Can be overridden with JWT_EXPIRATION_HOURS environment variable
+// getTokenExpiration returns the access token expiration duration
+// Default: 15 minutes, clients renew through the refresh token flow
+// Can be overridden with JWT_ACCESS_TOKEN_MINUTES environment variable
 func getTokenExpiration() time.Duration {
-	// Default to 7 days
-	defaultExpiration := 7 * 24 * time.Hour
+	// Default to 15 minutes
+	defaultExpiration := 15 * time.Minute
 
 	// Check for environment variable
-	if expHours := os.Getenv("JWT_EXPIRATION_HOURS"); expHours != "" {
-		if hours, err := strconv.Atoi(expHours); err == nil && hours > 0 {
-			return time.Duration(hours) * time.Hour
+	if expMinutes := os.Getenv("JWT_ACCESS_TOKEN_MINUTES"); expMinutes != "" {
+		if minutes, err := strconv.Atoi(expMinutes); err == nil && minutes > 0 {
+			return time.Duration(minutes) * time.Minute
 		}
 	}
 
 	return defaultExpiration
 }
 
-// GenerateJWT creates a JWT token for a user
-func GenerateJWT(userID int, email string, name string) (string, error) {
-	jwtSecret, err := getJWTSecret()
-	if err != nil {
-		return "", err
+// CheckTokenConfig rejects JWT_EXPIRATION_HOURS, which set the lifetime of
+// the old week-long access tokens. Ignoring it would quietly shorten
+// sessions an operator configured, so the backend refuses to start instead.
+func CheckTokenConfig() error {
+	if strings.TrimSpace(os.Getenv("JWT_EXPIRATION_HOURS")) != "" {
+		return errors.New("JWT_EXPIRATION_HOURS is no longer supported: access tokens last JWT_ACCESS_TOKEN_MINUTES (default 15) and are renewed with refresh tokens; remove it")
 	}
+	return nil
+}
 
+// AccessTokenTTL exposes the access token lifetime for other packages.
+func AccessTokenTTL() time.Duration {
+	return getTokenExpiration()
+}
+
+// GenerateJWT creates a JWT token for a user, signed with the active key
+// sessionID identifies the login session and is emitted as the jti claim.
+// roles are the user's stored staff roles; "user" is always allowed and stays the default.
+func GenerateJWT(userID int, email string, name string, sessionID string, roles []string) (string, error) {
 	expiration := getTokenExpiration()
 	now := time.Now()
 	expirationTime := now.Add(expiration)
@@ -72,20 +82,65 @@ func GenerateJWT(userID int, email string, name string) (string, error) {
 	log.Printf("[JWT] Generating token for user %d, expires in %v (at %v)",
 		userID, expiration, expirationTime.Format(time.RFC3339))
 
+	allowedRoles := []string{"user"}
+	for _, role := range roles {
+		if role != "user" {
+			allowedRoles = append(allowedRoles, role)
+		}
+	}
+
 	claims := jwt.MapClaims{
 		"user_id": userID,
 		"email":   email,
 		"name":    name,
+		"jti":     sessionID,
 		"iat":     now.Unix(), // Issued at time
 		"exp":     expirationTime.Unix(),
 		"https://hasura.io/jwt/claims": jwt.MapClaims{
-			"x-hasura-allowed-roles": []string{"user"},
+			"x-hasura-allowed-roles": allowedRoles,
 			"x-hasura-default-role":  "user",
 			"x-hasura-user-id":       strconv.Itoa(userID),
 			"x-hasura-user-name":     name,
 			"x-hasura-user-email":    email,
+			"x-hasura-session-id":    sessionID,
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signToken(claims)
+}
+
+// GenerateChallengeToken issues a short-lived token that proves one step of a
+// multi-step login (for example the password step before 2FA). It carries no
+// Hasura claims, so Hasura will not accept it as a session token.
+func GenerateChallengeToken(userID int, purpose string, ttl time.Duration, extra map[string]interface{}) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": strconv.Itoa(userID),
+		"aud": purpose,
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	for k, v := range extra {
+		if _, reserved := claims[k]; !reserved {
+			claims[k] = v
+		}
+	}
+	return signToken(claims)
+}
+
+// ParseChallengeToken verifies a challenge token for the given purpose and
+// returns the user id and its claims.
+func ParseChallengeToken(tokenString, purpose string) (int, jwt.MapClaims, error) {
+	claims, err := ParseJWT(tokenString)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !claims.VerifyAudience(purpose, true) {
+		return 0, nil, errors.New("challenge token has the wrong purpose")
+	}
+	sub, _ := claims["sub"].(string)
+	userID, err := strconv.Atoi(sub)
+	if err != nil || userID <= 0 {
+		return 0, nil, errors.New("challenge token has no subject")
+	}
+	return userID, claims, nil
 }
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessTokenTTL(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", 15 * time.Minute},
+		{"5", 5 * time.Minute},
+		{"0", 15 * time.Minute},
+		{"-3", 15 * time.Minute},
+		{"soon", 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Setenv("JWT_ACCESS_TOKEN_MINUTES", tt.env)
+		if got := AccessTokenTTL(); got != tt.want {
+			t.Errorf("AccessTokenTTL() with %q = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTokenConfig(t *testing.T) {
+	t.Setenv("JWT_EXPIRATION_HOURS", "")
+	if err := CheckTokenConfig(); err != nil {
+		t.Errorf("CheckTokenConfig() = %v without JWT_EXPIRATION_HOURS", err)
+	}
+	t.Setenv("JWT_EXPIRATION_HOURS", "168")
+	if err := CheckTokenConfig(); err == nil {
+		t.Error("CheckTokenConfig() accepted JWT_EXPIRATION_HOURS")
+	}
+}
+
+func TestGenerateJWT(t *testing.T) {
+	useKeys(t, "", "")
+	t.Setenv("JWT_SECRET", "test-secret-that-is-long-enough-for-hs256")
+	token, err := GenerateJWT(7, "cook@example.com", "Cook", "session-1", []string{"user", "moderator"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["jti"] != "session-1" {
+		t.Errorf("jti = %v, want session-1", claims["jti"])
+	}
+	exp, _ := claims["exp"].(float64)
+	if ttl := time.Until(time.Unix(int64(exp), 0)); ttl > 15*time.Minute || ttl < 14*time.Minute {
+		t.Errorf("token lives %v, want 15m", ttl)
+	}
+	hasura, _ := claims["https://hasura.io/jwt/claims"].(map[string]interface{})
+	roles, _ := hasura["x-hasura-allowed-roles"].([]interface{})
+	if len(roles) != 2 || roles[0] != "user" || roles[1] != "moderator" || hasura["x-hasura-default-role"] != "user" {
+		t.Errorf("hasura claims = %v", hasura)
+	}
+	if hasura["x-hasura-session-id"] != "session-1" || hasura["x-hasura-user-id"] != "7" {
+		t.Errorf("hasura claims = %v", hasura)
+	}
+
+	// Challenge tokens must never pass for access tokens.
+	challenge, err := GenerateChallengeToken(7, "2fa", time.Minute, map[string]interface{}{"exp": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseChallengeToken(challenge, "2fa"); err != nil {
+		t.Errorf("ParseChallengeToken: %v", err)
+	}
+	if _, _, err := ParseChallengeToken(challenge, "magic_link"); err == nil {
+		t.Error("challenge token was accepted for another purpose")
+	}
+	if _, _, err := ParseChallengeToken(token, "2fa"); err == nil {
+		t.Error("access token was accepted as a challenge token")
+	}
+}
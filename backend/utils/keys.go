@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Asymmetric signing keys are read from JWT_KEYS_DIR. Each key is a PEM file
+// named after its key id (kid):
+//
+//	<kid>.pem      private RSA or Ed25519 key, can sign and verify
+//	<kid>.pub.pem  public key only, can verify (a retired key)
+//
+// JWT_ACTIVE_KID picks the signing key. It may be left unset while there is
+// a single private key; with more than one the backend refuses to start
+// without it, so adding a key never switches the signer by itself.
+//
+// Rotation procedure:
+//  1. Set JWT_ACTIVE_KID to the current kid if it is not set yet, add the new
+//     <kid>.pem and deploy. The new public key appears in
+//     /.well-known/jwks.json but nothing is signed with it yet.
+//  2. Once Hasura has refetched the JWKS (see the Cache-Control max-age),
+//     set JWT_ACTIVE_KID to the new kid. New tokens are signed with it and
+//     tokens signed with the old key still verify.
+//  3. After the access token lifetime has passed, replace the old <kid>.pem
+//     with <kid>.pub.pem, or delete it once nothing signed by it is valid.
+//
+// Without JWT_KEYS_DIR the backend falls back to HS256 with JWT_SECRET.
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey // nil for verify-only keys
+	public  crypto.PublicKey
+}
+
+// KeySet holds the keys used to sign and verify tokens.
+type KeySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var (
+	keySetOnce sync.Once
+	keySet     *KeySet
+	keySetErr  error
+)
+
+// loadKeySet reads JWT_KEYS_DIR once. A nil KeySet means HS256 mode.
+func loadKeySet() (*KeySet, error) {
+	keySetOnce.Do(func() {
+		dir := strings.TrimSpace(os.Getenv("JWT_KEYS_DIR"))
+		if dir == "" {
+			return
+		}
+		keySet, keySetErr = readKeySet(dir, strings.TrimSpace(os.Getenv("JWT_ACTIVE_KID")))
+	})
+	return keySet, keySetErr
+}
+
+func readKeySet(dir, activeKID string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	ks := &KeySet{keys: make(map[string]*signingKey)}
+	var privates []*signingKey
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(file)
+		var key *signingKey
+		if strings.HasSuffix(name, ".pub.pem") {
+			key, err = parsePublicKey(strings.TrimSuffix(name, ".pub.pem"), data)
+		} else {
+			key, err = parsePrivateKey(strings.TrimSuffix(name, ".pem"), data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if _, dup := ks.keys[key.kid]; dup {
+			return nil, fmt.Errorf("duplicate key id %q in %s", key.kid, dir)
+		}
+		ks.keys[key.kid] = key
+		if key.private != nil {
+			privates = append(privates, key)
+		}
+	}
+
+	if activeKID == "" {
+		if len(privates) > 1 {
+			return nil, fmt.Errorf("JWT_ACTIVE_KID must be set when %s holds more than one private key", dir)
+		}
+		if len(privates) == 1 {
+			ks.active = privates[0]
+		}
+	} else if key, ok := ks.keys[activeKID]; ok && key.private != nil {
+		ks.active = key
+	} else {
+		return nil, fmt.Errorf("JWT_ACTIVE_KID %q has no private key in %s", activeKID, dir)
+	}
+	if ks.active == nil {
+		return nil, fmt.Errorf("no private signing key found in %s", dir)
+	}
+	return ks, nil
+}
+
+func parsePrivateKey(kid string, data []byte) (*signingKey, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, private: edKey, public: edKey.Public()}, nil
+	}
+	return nil, errors.New("expected an RSA or Ed25519 private key")
+}
+
+func parsePublicKey(kid string, data []byte) (*signingKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, public: key}, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, public: key}, nil
+	}
+	return nil, errors.New("expected an RSA or Ed25519 public key")
+}
+
+// signToken signs claims with the active key, or with the HS256 secret when
+// no asymmetric keys are configured.
+func signToken(claims jwt.Claims) (string, error) {
+	ks, err := loadKeySet()
+	if err != nil {
+		return "", err
+	}
+	if ks == nil {
+		secret, err := getJWTSecret()
+		if err != nil {
+			return "", err
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	}
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.kid
+	return token.SignedString(ks.active.private)
+}
+
+// ParseJWT verifies a token issued by this backend and returns its claims.
+func ParseJWT(tokenString string) (jwt.MapClaims, error) {
+	ks, err := loadKeySet()
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if ks == nil {
+			if t.Method != jwt.SigningMethodHS256 {
+				return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+			}
+			return getJWTSecret()
+		}
+		kid, _ := t.Header["kid"].(string)
+		key, ok := ks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return key.public, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// JWK is one public key in a JSON Web Key Set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWKS returns every verification key. It is empty in HS256 mode,
+// where the shared secret must never be published.
+func PublicJWKS() (JWKS, error) {
+	ks, err := loadKeySet()
+	if err != nil {
+		return JWKS{}, err
+	}
+	set := JWKS{Keys: []JWK{}}
+	if ks == nil {
+		return set, nil
+	}
+
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		key := ks.keys[kid]
+		jwk := JWK{Kid: kid, Alg: key.method.Alg(), Use: "sig"}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
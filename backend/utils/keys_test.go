@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// useKeys points the key set at dir and reloads it on the next use.
+func useKeys(t *testing.T, dir, activeKID string) {
+	t.Helper()
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_ACTIVE_KID", activeKID)
+	keySetOnce, keySet, keySetErr = sync.Once{}, nil, nil
+	t.Cleanup(func() { keySetOnce, keySet, keySetErr = sync.Once{}, nil, nil })
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writePrivateKey stores key as <kid>.pem and returns its public half.
+func writePrivateKey(t *testing.T, dir, kid string, key crypto.Signer) crypto.PublicKey {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, kid+".pem"), "PRIVATE KEY", der)
+	return key.Public()
+}
+
+// writePublicKey stores pub as the verify-only <kid>.pub.pem.
+func writePublicKey(t *testing.T, dir, kid string, pub crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, kid+".pub.pem"), "PUBLIC KEY", der)
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestReadKeySet(t *testing.T) {
+	t.Run("single private key signs without JWT_ACTIVE_KID", func(t *testing.T) {
+		dir := t.TempDir()
+		writePrivateKey(t, dir, "2026-09", newEd25519Key(t))
+		ks, err := readKeySet(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks.active.kid != "2026-09" {
+			t.Errorf("active kid = %s, want 2026-09", ks.active.kid)
+		}
+	})
+
+	t.Run("several private keys need JWT_ACTIVE_KID", func(t *testing.T) {
+		dir := t.TempDir()
+		writePrivateKey(t, dir, "2026-09", newEd25519Key(t))
+		writePrivateKey(t, dir, "2026-10", newEd25519Key(t))
+		if _, err := readKeySet(dir, ""); err == nil || !strings.Contains(err.Error(), "JWT_ACTIVE_KID must be set") {
+			t.Fatalf("readKeySet without JWT_ACTIVE_KID: err = %v", err)
+		}
+		ks, err := readKeySet(dir, "2026-09")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks.active.kid != "2026-09" {
+			t.Errorf("active kid = %s, want 2026-09", ks.active.kid)
+		}
+	})
+
+	t.Run("retired keys do not count and cannot sign", func(t *testing.T) {
+		dir := t.TempDir()
+		writePrivateKey(t, dir, "2026-10", newEd25519Key(t))
+		writePublicKey(t, dir, "2026-09", newEd25519Key(t).Public())
+		ks, err := readKeySet(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks.active.kid != "2026-10" || len(ks.keys) != 2 {
+			t.Errorf("active = %s with %d keys, want 2026-10 with 2", ks.active.kid, len(ks.keys))
+		}
+		if _, err := readKeySet(dir, "2026-09"); err == nil {
+			t.Error("a verify-only key was accepted as JWT_ACTIVE_KID")
+		}
+	})
+
+	t.Run("rejects", func(t *testing.T) {
+		empty := t.TempDir()
+		if _, err := readKeySet(empty, ""); err == nil {
+			t.Error("an empty directory was accepted")
+		}
+
+		onlyPublic := t.TempDir()
+		writePublicKey(t, onlyPublic, "2026-09", newEd25519Key(t).Public())
+		if _, err := readKeySet(onlyPublic, ""); err == nil {
+			t.Error("a directory without private keys was accepted")
+		}
+
+		duplicate := t.TempDir()
+		key := newEd25519Key(t)
+		writePrivateKey(t, duplicate, "2026-09", key)
+		writePublicKey(t, duplicate, "2026-09", key.Public())
+		if _, err := readKeySet(duplicate, ""); err == nil {
+			t.Error("a duplicate kid was accepted")
+		}
+
+		garbage := t.TempDir()
+		writePEM(t, filepath.Join(garbage, "2026-09.pem"), "PRIVATE KEY", []byte("not a key"))
+		if _, err := readKeySet(garbage, ""); err == nil {
+			t.Error("an unreadable key was accepted")
+		}
+
+		if _, err := readKeySet(empty, "missing"); err == nil {
+			t.Error("an unknown JWT_ACTIVE_KID was accepted")
+		}
+	})
+}
+
+func tokenKID(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+// TestKeyRotation walks through the rotation procedure in keys.go.
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPublic := writePrivateKey(t, dir, "2026-09", oldKey)
+	useKeys(t, dir, "")
+	oldToken, err := GenerateJWT(7, "cook@example.com", "Cook", "session-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKID(t, oldToken); kid != "2026-09" {
+		t.Fatalf("kid = %s, want 2026-09", kid)
+	}
+
+	// 1. The new key is published, but the old one keeps signing.
+	writePrivateKey(t, dir, "2026-10", newEd25519Key(t))
+	useKeys(t, dir, "")
+	if _, err := PublicJWKS(); err == nil {
+		t.Fatal("a second private key without JWT_ACTIVE_KID was accepted")
+	}
+	useKeys(t, dir, "2026-09")
+	set, err := PublicJWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want 2", len(set.Keys))
+	}
+	token, err := GenerateJWT(7, "cook@example.com", "Cook", "session-2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKID(t, token); kid != "2026-09" {
+		t.Errorf("kid = %s before switching, want 2026-09", kid)
+	}
+
+	// 2. The new key signs; tokens from the old one still verify.
+	useKeys(t, dir, "2026-10")
+	newToken, err := GenerateJWT(7, "cook@example.com", "Cook", "session-3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKID(t, newToken); kid != "2026-10" {
+		t.Errorf("kid = %s after switching, want 2026-10", kid)
+	}
+	for _, tok := range []string{oldToken, newToken} {
+		if _, err := ParseJWT(tok); err != nil {
+			t.Errorf("ParseJWT(%s token): %v", tokenKID(t, tok), err)
+		}
+	}
+
+	// 3. Retired to a public key, the old key still verifies; deleted, it
+	// no longer does.
+	if err := os.Remove(filepath.Join(dir, "2026-09.pem")); err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, dir, "2026-09", oldPublic)
+	useKeys(t, dir, "")
+	if _, err := ParseJWT(oldToken); err != nil {
+		t.Errorf("token from a retired key: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "2026-09.pub.pem")); err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, dir, "")
+	if _, err := ParseJWT(oldToken); err == nil {
+		t.Error("token from a deleted key still verifies")
+	}
+	if _, err := ParseJWT(newToken); err != nil {
+		t.Errorf("token from the active key: %v", err)
+	}
+}
+
+func TestParseJWTRejectsForgedTokens(t *testing.T) {
+	dir := t.TempDir()
+	writePrivateKey(t, dir, "2026-10", newEd25519Key(t))
+	useKeys(t, dir, "")
+
+	claims := jwt.MapClaims{"user_id": 7, "exp": 4102444800}
+	unknown := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	unknown.Header["kid"] = "2026-10"
+	forged, err := unknown.SignedString(newEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJWT(forged); err == nil {
+		t.Error("token signed by another key was accepted")
+	}
+
+	// HS256 with the public key as the secret is the classic confusion.
+	set, err := PublicJWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hs.Header["kid"] = "2026-10"
+	confused, err := hs.SignedString([]byte(set.Keys[0].X))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJWT(confused); err == nil {
+		t.Error("HS256 token was accepted in asymmetric mode")
+	}
+
+	missing := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	noKID, err := missing.SignedString(keySet.active.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJWT(noKID); err == nil {
+		t.Error("token without a kid was accepted")
+	}
+}
+
+func TestPublicJWKS(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := newEd25519Key(t)
+	writePrivateKey(t, dir, "a-rsa", rsaKey)
+	writePublicKey(t, dir, "b-ed", edKey.Public())
+	useKeys(t, dir, "")
+
+	set, err := PublicJWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want 2", len(set.Keys))
+	}
+
+	rsaJWK := set.Keys[0]
+	if rsaJWK.Kid != "a-rsa" || rsaJWK.Kty != "RSA" || rsaJWK.Alg != "RS256" || rsaJWK.Use != "sig" {
+		t.Errorf("RSA JWK = %+v", rsaJWK)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(rsaJWK.E)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new(big.Int).SetBytes(n).Cmp(rsaKey.N) != 0 || int(new(big.Int).SetBytes(e).Int64()) != rsaKey.E {
+		t.Error("RSA JWK does not describe the key")
+	}
+
+	edJWK := set.Keys[1]
+	if edJWK.Kid != "b-ed" || edJWK.Kty != "OKP" || edJWK.Crv != "Ed25519" || edJWK.Alg != "EdDSA" {
+		t.Errorf("Ed25519 JWK = %+v", edJWK)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(edJWK.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.PublicKey(x).Equal(edKey.Public()) {
+		t.Error("Ed25519 JWK does not describe the key")
+	}
+
+	t.Run("HS256 mode publishes nothing", func(t *testing.T) {
+		useKeys(t, "", "")
+		t.Setenv("JWT_SECRET", "shared secret")
+		set, err := PublicJWKS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(set.Keys) != 0 {
+			t.Errorf("JWKS has %d keys in HS256 mode", len(set.Keys))
+		}
+	})
+}
@@ -0,0 +1,412 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, a JWKS and a token
+// endpoint that checks PKCE. authorize stands in for the browser step.
+type mockIssuer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	kid      string
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	useEC    bool
+	codes    map[string]authorization
+	jwksHits int
+	// claims are added to (or, when nil, removed from) every ID token.
+	claims map[string]interface{}
+	// discoveryIssuer overrides the issuer in the discovery document.
+	discoveryIssuer string
+}
+
+type authorization struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	clientID    string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{t: t, kid: "key-1", rsaKey: rsaKey, ecKey: ecKey, codes: map[string]authorization{}, claims: map[string]interface{}{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/token", m.token)
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:         "mock",
+		Issuer:       m.srv.URL,
+		ClientID:     "recipes-web",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"openid", "email", "profile"},
+		httpClient:   m.srv.Client(),
+	}
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	issuer := m.discoveryIssuer
+	m.mu.Unlock()
+	if issuer == "" {
+		issuer = m.srv.URL
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": m.srv.URL + "/authorize?prompt=login",
+		"token_endpoint":         m.srv.URL + "/token",
+		"jwks_uri":               m.srv.URL + "/jwks",
+	})
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jwksHits++
+	b64 := base64.RawURLEncoding.EncodeToString
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": m.kid, "use": "sig", "n": b64(m.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(m.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": m.kid + "-ec", "crv": "P-256", "x": b64(m.ecKey.X.Bytes()), "y": b64(m.ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(m.rsaKey.N.Bytes()), "e": "AQAB"},
+	}})
+}
+
+// authorize follows the authorization URL the way the browser and the
+// provider's login page would, and returns the code sent to the redirect.
+func (m *mockIssuer) authorize(authURL string) (code, state string) {
+	m.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("prompt") != "login" {
+		m.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code = fmt.Sprintf("code-%d", len(m.codes)+1)
+	m.codes[code] = authorization{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+		clientID:    q.Get("client_id"),
+	}
+	return code, q.Get("state")
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	auth, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok, r.PostForm.Get("grant_type") != "authorization_code":
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge:
+		http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+		return
+	case r.PostForm.Get("redirect_uri") != auth.redirectURI, r.PostForm.Get("client_id") != auth.clientID,
+		r.PostForm.Get("client_secret") != "s3cret":
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            m.srv.URL,
+		"aud":            auth.clientID,
+		"sub":            "mock-user-1",
+		"email":          "cook@example.com",
+		"email_verified": true,
+		"name":           "Mock Cook",
+		"nonce":          auth.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range m.claims {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	var signed string
+	var err error
+	if m.useEC {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		tok.Header["kid"] = m.kid + "-ec"
+		signed, err = tok.SignedString(m.ecKey)
+	} else {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = m.kid
+		signed, err = tok.SignedString(m.rsaKey)
+	}
+	if err != nil {
+		m.t.Error(err)
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+}
+
+// login runs one full flow against the mock issuer.
+func login(t *testing.T, m *mockIssuer, p *OIDCProvider) (*OIDCIdentity, error) {
+	t.Helper()
+	ctx := context.Background()
+	verifier, challenge, err := NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const redirect = "http://localhost:3000/auth/callback/mock"
+	authURL, err := p.AuthCodeURL(ctx, redirect, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := m.authorize(authURL)
+	if state != "state-1" {
+		t.Fatalf("state = %q, want state-1", state)
+	}
+	return p.Exchange(ctx, redirect, code, verifier, "nonce-1")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+	id, err := login(t, m, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OIDCIdentity{Subject: "mock-user-1", Email: "cook@example.com", EmailVerified: true, Name: "Mock Cook"}
+	if *id != want {
+		t.Errorf("identity = %+v, want %+v", *id, want)
+	}
+
+	t.Run("EC keys", func(t *testing.T) {
+		m.useEC = true
+		defer func() { m.useEC = false }()
+		if _, err := login(t, m, p); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("email_verified as a string", func(t *testing.T) {
+		m.claims = map[string]interface{}{"email_verified": "true"}
+		defer func() { m.claims = map[string]interface{}{} }()
+		id, err := login(t, m, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !id.EmailVerified {
+			t.Error("email_verified \"true\" was not accepted")
+		}
+	})
+
+	t.Run("refetches the JWKS after the provider rotates keys", func(t *testing.T) {
+		hits := m.jwksHits
+		newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.mu.Lock()
+		m.kid, m.rsaKey = "key-2", newKey
+		m.mu.Unlock()
+		if _, err := login(t, m, p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := login(t, m, p); err != nil {
+			t.Fatal(err)
+		}
+		if m.jwksHits != hits+1 {
+			t.Errorf("JWKS fetched %d times, want once", m.jwksHits-hits)
+		}
+	})
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{"another audience", map[string]interface{}{"aud": "someone-else"}},
+		{"another issuer", map[string]interface{}{"iss": "https://evil.example.com"}},
+		{"another nonce", map[string]interface{}{"nonce": "replayed"}},
+		{"no nonce", map[string]interface{}{"nonce": nil}},
+		{"no subject", map[string]interface{}{"sub": nil}},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockIssuer(t)
+			m.claims = tt.claims
+			if _, err := login(t, m, m.provider()); err == nil {
+				t.Error("Exchange accepted the ID token")
+			}
+		})
+	}
+
+	t.Run("wrong PKCE verifier", func(t *testing.T) {
+		m := newMockIssuer(t)
+		p := m.provider()
+		ctx := context.Background()
+		_, challenge, _ := NewPKCEVerifier()
+		other, _, _ := NewPKCEVerifier()
+		authURL, err := p.AuthCodeURL(ctx, "http://localhost:3000/cb", "s", "n", challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := m.authorize(authURL)
+		if _, err := p.Exchange(ctx, "http://localhost:3000/cb", code, other, "n"); err == nil {
+			t.Error("Exchange succeeded with another verifier")
+		}
+	})
+
+	t.Run("token signed with HS256", func(t *testing.T) {
+		m := newMockIssuer(t)
+		p := m.provider()
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"iss": m.srv.URL, "aud": p.ClientID, "sub": "x", "nonce": "n", "exp": time.Now().Add(time.Minute).Unix(),
+		})
+		tok.Header["kid"] = "key-1"
+		raw, err := tok.SignedString([]byte("s3cret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.verifyIDToken(context.Background(), raw, "n"); err == nil {
+			t.Error("HS256 ID token was accepted")
+		}
+	})
+
+	t.Run("key marked for encryption", func(t *testing.T) {
+		m := newMockIssuer(t)
+		p := m.provider()
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": m.srv.URL, "aud": p.ClientID, "sub": "x", "nonce": "n", "exp": time.Now().Add(time.Minute).Unix(),
+		})
+		tok.Header["kid"] = "enc"
+		raw, err := tok.SignedString(m.rsaKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.verifyIDToken(context.Background(), raw, "n"); err == nil {
+			t.Error("ID token signed with an encryption key was accepted")
+		}
+	})
+
+	t.Run("discovery for another issuer", func(t *testing.T) {
+		m := newMockIssuer(t)
+		m.discoveryIssuer = "https://evil.example.com"
+		if _, err := m.provider().AuthCodeURL(context.Background(), "http://localhost:3000/cb", "s", "n", "c"); err == nil {
+			t.Error("AuthCodeURL trusted a discovery document for another issuer")
+		}
+	})
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	m := newMockIssuer(t)
+	authURL, err := m.provider().AuthCodeURL(context.Background(), "http://localhost:3000/cb", "st", "no", "ch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, m.srv.URL+"/authorize?prompt=login&") {
+		t.Errorf("authorization URL %s does not keep the endpoint's query", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	for name, want := range map[string]string{
+		"client_id": "recipes-web", "redirect_uri": "http://localhost:3000/cb", "scope": "openid email profile",
+		"state": "st", "nonce": "no", "code_challenge": "ch", "code_challenge_method": "S256",
+	} {
+		if got := q.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNewPKCEVerifier(t *testing.T) {
+	verifier, challenge, err := NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Errorf("verifier length %d is outside RFC 7636's 43-128", len(verifier))
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Error("challenge is not the S256 of the verifier")
+	}
+	other, _, _ := NewPKCEVerifier()
+	if other == verifier {
+		t.Error("verifiers repeat")
+	}
+}
+
+func TestLoadOIDCProvidersFromEnv(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", " Google , my-idp,")
+	t.Setenv("OIDC_GOOGLE_ISSUER", "https://accounts.google.com/")
+	t.Setenv("OIDC_GOOGLE_CLIENT_ID", "google-client")
+	t.Setenv("OIDC_GOOGLE_LINK_BY_EMAIL", "TRUE")
+	t.Setenv("OIDC_MY_IDP_ISSUER", "http://localhost:8090/default")
+	t.Setenv("OIDC_MY_IDP_CLIENT_ID", "local")
+	t.Setenv("OIDC_MY_IDP_SCOPES", "openid email")
+
+	providers, err := LoadOIDCProvidersFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	google, idp := providers["google"], providers["my-idp"]
+	if len(providers) != 2 || google == nil || idp == nil {
+		t.Fatalf("providers = %v", providers)
+	}
+	if google.Issuer != "https://accounts.google.com" || !google.LinkByEmail || strings.Join(google.Scopes, " ") != "openid email profile" {
+		t.Errorf("google = %+v", google)
+	}
+	if idp.LinkByEmail || strings.Join(idp.Scopes, " ") != "openid email" {
+		t.Errorf("my-idp = %+v", idp)
+	}
+
+	t.Setenv("OIDC_MY_IDP_CLIENT_ID", "")
+	if _, err := LoadOIDCProvidersFromEnv(); err == nil {
+		t.Error("a provider without a client id was accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are hashed with Argon2id and stored in the PHC string format:
+//
+//	$argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+//
+// Hashes made with older settings, and bcrypt hashes from before Argon2id
+// was introduced, still verify; VerifyPassword reports them as needing a
+// rehash so the login path can upgrade them.
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// Argon2Params are the tunable Argon2id settings.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// CurrentArgon2Params returns the settings new hashes are made with
+// Default: 64 MiB memory, 3 iterations, parallelism 2
+// Can be overridden with ARGON2_MEMORY_KIB, ARGON2_ITERATIONS and ARGON2_PARALLELISM
+// (at most 255)
+func CurrentArgon2Params() Argon2Params {
+	return Argon2Params{
+		Memory:      uint32(envUint("ARGON2_MEMORY_KIB", 64*1024, 32)),
+		Iterations:  uint32(envUint("ARGON2_ITERATIONS", 3, 32)),
+		Parallelism: uint8(envUint("ARGON2_PARALLELISM", 2, 8)),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// envUint reads a positive integer that fits in bits bits; anything else
+// gives fallback.
+func envUint(key string, fallback uint64, bits int) uint64 {
+	if v, err := strconv.ParseUint(os.Getenv(key), 10, bits); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// HashPassword hashes a password with the current Argon2id settings.
+func HashPassword(password string) (string, error) {
+	p := CurrentArgon2Params()
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// dummyPasswordHash is an Argon2id hash of a random password, made with the
+// current settings.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	password := make([]byte, 32)
+	rand.Read(password)
+	hash, _ := HashPassword(string(password))
+	return hash
+})
+
+// VerifyDummyPassword checks password against a hash nothing matches. Call it
+// when there is no hash to check, such as for an unknown email, so that the
+// response takes as long as a real check and does not reveal which accounts
+// exist.
+func VerifyDummyPassword(password string) {
+	VerifyPassword(password, dummyPasswordHash())
+}
+
+// VerifyPassword checks a password against a stored hash. needsRehash is
+// true when the password matched but the hash uses an outdated algorithm or
+// parameters. An empty stored hash (accounts without a password) never
+// matches, but takes as long to check as a real one.
+func VerifyPassword(password, encoded string) (ok, needsRehash bool, err error) {
+	switch {
+	case encoded == "":
+		VerifyDummyPassword(password)
+		return false, false, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2Hash(encoded)
+		if err != nil {
+			return false, false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false, nil
+		}
+		current := CurrentArgon2Params()
+		outdated := params.Memory != current.Memory ||
+			params.Iterations != current.Iterations ||
+			params.Parallelism != current.Parallelism ||
+			uint32(len(salt)) != current.SaltLength ||
+			uint32(len(key)) != current.KeyLength
+		return true, outdated, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	default:
+		return false, false, ErrUnknownHashFormat
+	}
+}
+
+func decodeArgon2Hash(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	// argon2.IDKey panics on zero iterations or parallelism
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid argon2 hash")
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2 makes new hashes cheap; the verify path reads the parameters
+// from each hash.
+func fastArgon2(t *testing.T) {
+	t.Setenv("ARGON2_MEMORY_KIB", "1024")
+	t.Setenv("ARGON2_ITERATIONS", "1")
+	t.Setenv("ARGON2_PARALLELISM", "1")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	fastArgon2(t)
+	current, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ARGON2_ITERATIONS", "2")
+	upgraded, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ARGON2_ITERATIONS", "1")
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		password        string
+		hash            string
+		wantOK          bool
+		wantNeedsRehash bool
+		wantErr         bool
+	}{
+		{"argon2id, current parameters", "correct horse", current, true, false, false},
+		{"argon2id, wrong password", "battery staple", current, false, false, false},
+		{"argon2id, outdated parameters", "correct horse", upgraded, true, true, false},
+		{"bcrypt", "correct horse", string(legacy), true, true, false},
+		{"bcrypt, wrong password", "battery staple", string(legacy), false, false, false},
+		{"no password set", "", "", false, false, false},
+		{"unknown format", "correct horse", "$1$md5crypt", false, false, true},
+		{"zero memory", "x", "$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false, false, true},
+		{"zero iterations", "x", "$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$aGFzaA", false, false, true},
+		{"zero parallelism", "x", "$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$aGFzaA", false, false, true},
+		{"parallelism over 255", "x", "$argon2id$v=19$m=1024,t=1,p=256$c2FsdHNhbHQ$aGFzaA", false, false, true},
+		{"wrong version", "x", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false, false, true},
+		{"empty key", "x", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := VerifyPassword(tt.password, tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK || needsRehash != tt.wantNeedsRehash {
+				t.Errorf("VerifyPassword = %v, %v, want %v, %v", ok, needsRehash, tt.wantOK, tt.wantNeedsRehash)
+			}
+		})
+	}
+}
+
+func TestCurrentArgon2ParamsRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name, key, value string
+		want             Argon2Params
+	}{
+		{"parallelism over 255", "ARGON2_PARALLELISM", "256", Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}},
+		{"zero iterations", "ARGON2_ITERATIONS", "0", Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}},
+		{"negative memory", "ARGON2_MEMORY_KIB", "-1", Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}},
+		{"valid parallelism", "ARGON2_PARALLELISM", "255", Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"ARGON2_MEMORY_KIB", "ARGON2_ITERATIONS", "ARGON2_PARALLELISM"} {
+				t.Setenv(key, "")
+			}
+			t.Setenv(tt.key, tt.value)
+			got := CurrentArgon2Params()
+			if got.Memory != tt.want.Memory || got.Iterations != tt.want.Iterations || got.Parallelism != tt.want.Parallelism {
+				t.Errorf("CurrentArgon2Params = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GenerateOpaqueToken returns a random URL-safe token built from n random bytes.
+func GenerateOpaqueToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken returns the hex SHA-256 digest of an opaque token.
+// Only the digest is stored so a database leak does not expose usable tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshTokenTTL returns how long a refresh token stays valid
+// Default: 30 days
+// Can be overridden with REFRESH_TOKEN_DAYS environment variable
+func RefreshTokenTTL() time.Duration {
+	defaultTTL := 30 * 24 * time.Hour
+
+	if days := os.Getenv("REFRESH_TOKEN_DAYS"); days != "" {
+		if d, err := strconv.Atoi(days); err == nil && d > 0 {
+			return time.Duration(d) * 24 * time.Hour
+		}
+	}
+
+	return defaultTTL
+}